@@ -4,31 +4,195 @@ import (
 	"bufio"
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"maps"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
 )
 
 type (
 	Client struct {
+		// Header is added to the handshake request, see SetBasicAuth.
 		Header http.Header
 
+		// Subprotocols are offered to the server in preference order.
+		Subprotocols []string
+
+		// Extensions are sent to the server as is.
+		// The server must not accept extensions not offered.
+		// See Conn.ReservedBits for extensions using RSV bits.
+		Extensions []string
+
+		// UseHTTP2 makes Handshake bootstrap the connection with extended CONNECT
+		// over HTTP/2 (RFC 8441) instead of HTTP/1.1 Upgrade.
+		// Transport is used for that, and the server must enable extended CONNECT.
+		// The response Body is the stream owned by the Conn, so it's replaced with http.NoBody.
+		// Deadlines and so ctx cancellation of blocked reads and writes are not supported
+		// on such connections, Close the Conn to interrupt them.
+		UseHTTP2 bool
+
+		// Transport sends HTTP/2 handshake requests, it's required if UseHTTP2 is set.
+		// It must support extended CONNECT, as golang.org/x/net/http2.Transport does.
+		// net/http.Transport rejects the :protocol pseudo-header.
+		// Dialer, NetDial, TLSConfig, and Proxy are not used in that case.
+		Transport http.RoundTripper
+
+		// Compression offers permessage-deflate extension with the params if not nil.
+		// See Conn.CompressionParams for the negotiated ones.
+		Compression *CompressionParams
+
 		Dialer    net.Dialer
 		TLSDialer tls.Dialer
+
+		// NetDial is used instead of Dialer if set.
+		// TLS handshake for wss is done over the returned connection.
+		NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+		// TLSConfig is used instead of TLSDialer.Config if set.
+		// It's cloned and ServerName is set to the URL host if empty,
+		// so set ServerName to connect to an IP address with a certificate for a name.
+		TLSConfig *tls.Config
+
+		// Proxy returns the proxy to connect through, as in http.Transport.
+		// http, https, socks5, and socks5h proxy schemes are supported.
+		// socks5 resolves host names locally, socks5h sends them to the proxy.
+		// Direct connection is made if nil or nil url is returned.
+		Proxy func(*http.Request) (*url.URL, error)
+
+		// ProxyDialer connects to the server through a proxy instead of Proxy if set.
+		// golang.org/x/net/proxy dialers implement it (see proxy.ContextDialer),
+		// so any proxy supported there can be used.
+		// TLS handshake for wss is done over the returned connection.
+		ProxyDialer DialerContext
+
+		// MaxRedirects is the number of redirects to follow during Handshake.
+		// Sec-WebSocket-Key is regenerated and other headers are preserved,
+		// except for Authorization and Cookie on cross host redirects.
+		MaxRedirects int
+
+		// KeepConnOnError makes Handshake return the Conn along with the error
+		// if the server switched protocols but the response failed validation.
+		// The caller is responsible for closing the Conn in that case.
+		KeepConnOnError bool
+
+		// ReadBufferSize and WriteBufferSize are set to all the connections created.
+		// See Conn fields with the same names.
+		ReadBufferSize  int
+		WriteBufferSize int
+
+		// BufferPool is set to all the connections created.
+		BufferPool BufferPool
 	}
 
+	// DialerContext dials a connection, as net.Dialer or golang.org/x/net/proxy.ContextDialer.
 	DialerContext interface {
 		DialContext(ctx context.Context, net, addr string) (net.Conn, error)
 	}
+
+	// DialOption configures Dial.
+	DialOption func(*dialConfig)
+
+	dialConfig struct {
+		cl      Client
+		timeout time.Duration
+	}
+)
+
+const defaultHandshakeTimeout = 30 * time.Second
+
+const (
+	unixScheme = "http+unix" // request URL scheme for unix sockets, the host is the socket path
+	unixHost   = "localhost" // Host header for unix sockets
 )
 
+// Dial connects to the websocket server at rurl using Client configured with opts.
+// It's a shortcut for simple clients, use Client directly for everything else.
+//
+// The handshake is limited by defaultHandshakeTimeout, 30 seconds, see WithHandshakeTimeout.
+// The response is returned if the server responded, even if the handshake failed.
+// Its Body is closed.
+//
+//	c, resp, err := websocket.Dial(ctx, "wss://example.com/ws",
+//		websocket.WithSubprotocols("v2", "v1"),
+//		websocket.WithHeader("Authorization", "Bearer "+token))
+func Dial(ctx context.Context, rurl string, opts ...DialOption) (*Conn, *http.Response, error) {
+	d := dialConfig{timeout: defaultHandshakeTimeout}
+
+	for _, o := range opts {
+		o(&d)
+	}
+
+	if d.timeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	req, err := d.cl.NewRequest(ctx, rurl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("new request: %w", err)
+	}
+
+	conn, resp, err := d.cl.Handshake(ctx, req)
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		return conn, resp, fmt.Errorf("handshake: %w", err)
+	}
+
+	return conn, resp, nil
+}
+
+// WithHeader adds the header to the handshake request.
+func WithHeader(key, value string) DialOption {
+	return func(d *dialConfig) {
+		if d.cl.Header == nil {
+			d.cl.Header = make(http.Header)
+		}
+
+		d.cl.Header.Add(key, value)
+	}
+}
+
+// WithSubprotocols offers the subprotocols in preference order.
+func WithSubprotocols(protos ...string) DialOption {
+	return func(d *dialConfig) {
+		d.cl.Subprotocols = protos
+	}
+}
+
+// WithTLSConfig sets the TLS config for wss connections, see Client.TLSConfig.
+func WithTLSConfig(conf *tls.Config) DialOption {
+	return func(d *dialConfig) {
+		d.cl.TLSConfig = conf
+	}
+}
+
+// WithHandshakeTimeout limits the time to connect and complete the handshake.
+// Zero disables the timeout, ctx still applies.
+func WithHandshakeTimeout(timeout time.Duration) DialOption {
+	return func(d *dialConfig) {
+		d.timeout = timeout
+	}
+}
+
+// WithClient configures the Client used by Dial with anything not covered by the other options.
+func WithClient(f func(cl *Client)) DialOption {
+	return func(d *dialConfig) {
+		f(&d.cl)
+	}
+}
+
 func (c *Client) DialContext(ctx context.Context, rurl string) (*Conn, error) {
 	req, err := c.NewRequest(ctx, rurl)
 	if err != nil {
@@ -45,17 +209,45 @@ func (c *Client) DialContext(ctx context.Context, rurl string) (*Conn, error) {
 	return conn, nil
 }
 
+// NewRequest creates the handshake request for Handshake.
+// ws and wss schemes are converted to http and https.
+// URL userinfo is removed from the URL and sent as Basic Authorization,
+// Authorization set in Client.Header takes precedence.
+//
+// The request can be modified before the handshake: URL path and query,
+// and headers are sent as they are at the Handshake call.
+// The connection is made to req.URL, but the Host header is req.Host,
+// which is set to the original URL host, so update or clear it when changing req.URL.Host.
+// Sec-WebSocket-Accept is checked against the request Sec-WebSocket-Key, even if it's replaced.
+//
+// ws+unix:///path/to.sock:/http/path?query URLs connect to the unix socket.
+// The socket path ends at the first colon, the rest is the request path, "/" by default.
+// Such request URL has the http+unix scheme with the socket path as the host,
+// and the Host header is the localhost placeholder.
 func (c *Client) NewRequest(ctx context.Context, rurl string) (*http.Request, error) {
 	u, err := url.Parse(rurl)
 	if err != nil {
 		return nil, fmt.Errorf("parse url: %w", err)
 	}
 
+	var sock string
+
 	switch u.Scheme {
 	case "ws", "http":
 		u.Scheme = "http"
 	case "wss", "https":
 		u.Scheme = "https"
+	case "ws+unix":
+		sock, u.Path, _ = strings.Cut(u.Path, ":")
+		if u.Host != "" || sock == "" {
+			return nil, fmt.Errorf("bad unix socket url: %v", rurl)
+		}
+
+		if u.Path == "" {
+			u.Path = "/"
+		}
+
+		u.Scheme, u.Host, u.RawPath = "http", unixHost, ""
 	default:
 		return nil, fmt.Errorf("unsupported scheme: %v", u.Scheme)
 	}
@@ -64,11 +256,23 @@ func (c *Client) NewRequest(ctx context.Context, rurl string) (*http.Request, er
 	_, _ = rand.Read(key)
 	key64 := base64.StdEncoding.EncodeToString(key)
 
+	user := u.User
+	u.User = nil
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
 	if err != nil {
 		return nil, fmt.Errorf("new request: %w", err)
 	}
 
+	if sock != "" {
+		req.URL.Scheme, req.URL.Host = unixScheme, sock
+	}
+
+	if user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+	}
+
 	h := req.Header
 
 	h.Set("Connection", "Upgrade")
@@ -76,86 +280,328 @@ func (c *Client) NewRequest(ctx context.Context, rurl string) (*http.Request, er
 	h.Set("Sec-WebSocket-Version", "13")
 	h.Set("Sec-WebSocket-Key", key64)
 
+	if len(c.Subprotocols) != 0 {
+		h.Set("Sec-WebSocket-Protocol", strings.Join(c.Subprotocols, ", "))
+	}
+
+	exts := c.Extensions
+
+	if c.Compression != nil {
+		offer := *c.Compression
+
+		// we can't honour it, so the server must not be invited to limit our window
+		if limitsWindow(offer.ClientMaxWindowBits) {
+			offer.ClientMaxWindowBits = 0
+		}
+
+		exts = append(slices.Clip(exts), offer.String())
+	}
+
+	if len(exts) != 0 {
+		h.Set("Sec-WebSocket-Extensions", strings.Join(exts, ", "))
+	}
+
 	maps.Copy(h, c.Header)
 
 	return req, nil
 }
 
+// SetBasicAuth sets Basic Authorization header for all the handshake requests.
+func (c *Client) SetBasicAuth(user, pass string) {
+	if c.Header == nil {
+		c.Header = make(http.Header)
+	}
+
+	c.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+}
+
+// Handshake connects to the server and performs websocket handshake.
+// Up to MaxRedirects redirects are followed, the last response is returned.
+//
+// Frames the server sends right after the response, even in the same packet
+// or with the response and a frame split arbitrarily, are not lost
+// and are returned by the following reads in order.
+// The returned Conn can be written to right away, there is nothing left to drain.
+// Nothing is sent before the response is received and checked as RFC 6455 requires.
 func (cl *Client) Handshake(ctx context.Context, req *http.Request) (conn *Conn, resp *http.Response, err error) {
-	var d DialerContext
+	for redirects := 0; ; redirects++ {
+		conn, resp, err = cl.handshake(ctx, req)
+		if err == nil || resp == nil || redirects >= cl.MaxRedirects || !isRedirect(resp.StatusCode) {
+			return conn, resp, err
+		}
 
-	switch req.URL.Scheme {
-	case "http":
-		d = &cl.Dialer
-	case "https":
-		d = &cl.TLSDialer
-	default:
-		return nil, nil, fmt.Errorf("unsupported scheme: %v", req.URL.Scheme)
+		loc, lerr := resp.Location()
+		if lerr != nil {
+			return conn, resp, err
+		}
+
+		req, err = cl.redirectRequest(ctx, req, loc)
+		if err != nil {
+			return nil, resp, fmt.Errorf("redirect: %w", err)
+		}
 	}
+}
 
-	host := req.URL.Host
-	if req.URL.Port() == "" {
-		host = net.JoinHostPort(host, req.URL.Scheme)
+func (cl *Client) handshake(ctx context.Context, req *http.Request) (conn *Conn, resp *http.Response, err error) {
+	if cl.UseHTTP2 {
+		return cl.handshakeHTTP2(ctx, req)
 	}
 
-	c, err := d.DialContext(ctx, "tcp", host)
+	c, err := cl.dial(ctx, req)
 	if err != nil {
 		return nil, nil, fmt.Errorf("dial: %w", err)
 	}
 
-	defer closerOnErr(c, &err)
+	defer func() {
+		if err != nil && conn == nil {
+			_ = c.Close()
+		}
+	}()
+
+	defer Stopper(ctx, c.SetDeadline)()
 
 	err = req.Write(c)
 	if err != nil {
-		return nil, nil, fmt.Errorf("write request: %w", err)
+		return nil, nil, fmt.Errorf("write request: %w", FixError(ctx, err))
 	}
 
 	r := bufio.NewReader(c)
 
 	resp, err = http.ReadResponse(r, req)
 	if err != nil {
-		return nil, nil, fmt.Errorf("read response: %w", err)
+		return nil, nil, fmt.Errorf("read response: %w", FixError(ctx, err))
 	}
 
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		return nil, resp, fmt.Errorf("didn't switch protocol: %v (%d)", resp.Status, resp.StatusCode)
+		return nil, resp, &HandshakeError{Response: resp, Err: fmt.Errorf("%w: %v", ErrBadStatus, resp.Status)}
 	}
 
+	conn = &Conn{
+		Conn: c,
+
+		ReadBufferSize:  cl.ReadBufferSize,
+		WriteBufferSize: cl.WriteBufferSize,
+
+		client: 1,
+		pool:   cl.BufferPool,
+
+		subprotocol: resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions:  headerTokens(resp.Header, "Sec-WebSocket-Extensions"),
+
+		laddr: c.LocalAddr(),
+		raddr: c.RemoteAddr(),
+	}
+
+	err = conn.readBuffered(r)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	comp, err := checkResponse(req, resp)
+	conn.setCompression(comp)
+
+	if err != nil {
+		err = &HandshakeError{Response: resp, Err: err}
+	}
+
+	if err != nil && !cl.KeepConnOnError {
+		conn.discardReadBuf()
+
+		return nil, resp, err
+	}
+
+	return conn, resp, err
+}
+
+func checkResponse(req *http.Request, resp *http.Response) (*CompressionParams, error) {
 	h := resp.Header
 	accept := secKeyHash(req.Header.Get("Sec-WebSocket-Key"))
 
-	if q := h.Get("Connection"); strings.ToLower(q) != "upgrade" {
-		return nil, resp, fmt.Errorf("didn't upgrade: %v", q)
+	if !headerHasToken(h, "Connection", "upgrade") {
+		return nil, fmt.Errorf("%w: connection: %v", ErrUpgradeMismatch, h.Get("Connection"))
 	}
-	if q := h.Get("Upgrade"); strings.ToLower(q) != "websocket" {
-		return nil, resp, fmt.Errorf("upgraded protocol mismatch: %v", q)
+	if !headerHasProtocol(h, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("%w: upgraded protocol: %v", ErrUpgradeMismatch, h.Get("Upgrade"))
 	}
-	if q := h.Get("Sec-WebSocket-Accept"); q == "" {
-		return nil, resp, errors.New("no sec-accept in response")
-	} else if q != accept {
-		return nil, resp, errors.New("sec-accept mismatch")
+	// surrounding whitespace is not a part of the value
+	if q := strings.TrimSpace(h.Get("Sec-WebSocket-Accept")); q == "" {
+		return nil, fmt.Errorf("%w: no sec-accept in response", ErrBadAccept)
+	} else if subtle.ConstantTimeCompare([]byte(q), []byte(accept)) != 1 {
+		return nil, ErrBadAccept
 	}
 
-	conn = &Conn{
-		Conn: c,
+	return checkNegotiated(req, h)
+}
 
-		client: 1,
+// checkNegotiated checks the subprotocol and extensions accepted by the server were offered.
+func checkNegotiated(req *http.Request, h http.Header) (*CompressionParams, error) {
+	proto := h.Get("Sec-WebSocket-Protocol")
+	if proto != "" && !slices.Contains(headerTokens(req.Header, "Sec-WebSocket-Protocol"), proto) {
+		return nil, fmt.Errorf("subprotocol not requested: %v", proto)
 	}
 
-	if n := r.Buffered(); n != 0 {
-		conn.rbuf = grow(conn.rbuf, min(n, defaultReadBufSize))
+	offered := headerTokens(req.Header, "Sec-WebSocket-Extensions")
+	accepted := headerTokens(h, "Sec-WebSocket-Extensions")
 
-		m, err := r.Read(conn.rbuf[:n])
-		conn.end = m
+	for _, ext := range accepted {
+		if !slices.ContainsFunc(offered, func(o string) bool { return extensionName(o) == extensionName(ext) }) {
+			return nil, fmt.Errorf("extension not requested: %v", ext)
+		}
+	}
+
+	return compressionResponse(offered, accepted)
+}
+
+func (cl *Client) redirectRequest(ctx context.Context, req *http.Request, loc *url.URL) (*http.Request, error) {
+	rurl := loc.String()
+	if loc.Scheme == unixScheme {
+		rurl = "ws+unix://" + loc.Host + ":" + loc.RequestURI()
+	}
+
+	next, err := cl.NewRequest(ctx, rurl)
+	if err != nil {
+		return nil, err
+	}
+
+	// credentials are not sent to other hosts or over a downgraded scheme
+	sameOrigin := next.URL.Host == req.URL.Host && next.URL.Scheme == req.URL.Scheme
+
+	for k, v := range req.Header {
+		switch k {
+		case "Sec-Websocket-Key":
+			continue
+		case "Authorization", "Cookie":
+			if !sameOrigin {
+				continue
+			}
+		}
+
+		next.Header[k] = v
+	}
+
+	return next, nil
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+func (cl *Client) dial(ctx context.Context, req *http.Request) (c net.Conn, err error) {
+	// local sockets are not proxied
+	if req.URL.Scheme == unixScheme {
+		return cl.netDial(ctx, "unix", req.URL.Host)
+	}
+
+	addr := hostPort(req.URL)
+
+	var proxy *url.URL
+
+	if cl.Proxy != nil && cl.ProxyDialer == nil {
+		proxy, err = cl.Proxy(req)
 		if err != nil {
-			return nil, resp, errors.New("flush buffer")
+			return nil, fmt.Errorf("proxy: %w", err)
 		}
-		if m != n {
-			return nil, resp, fmt.Errorf("flush buffer: read %d of %d", m, n)
+	}
+
+	switch req.URL.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %v", req.URL.Scheme)
+	}
+
+	if proxy == nil && cl.ProxyDialer == nil && cl.NetDial == nil && cl.TLSConfig == nil {
+		if req.URL.Scheme == "https" {
+			return cl.TLSDialer.DialContext(ctx, "tcp", addr)
 		}
+
+		return cl.Dialer.DialContext(ctx, "tcp", addr)
 	}
 
-	return conn, resp, nil
+	switch {
+	case cl.ProxyDialer != nil:
+		c, err = cl.ProxyDialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	case proxy != nil:
+		c, err = cl.dialProxy(ctx, proxy, addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	default:
+		c, err = cl.netDial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if req.URL.Scheme == "https" {
+		c, err = cl.tlsClient(ctx, c, req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (cl *Client) netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if cl.NetDial != nil {
+		return cl.NetDial(ctx, network, addr)
+	}
+
+	return cl.Dialer.DialContext(ctx, network, addr)
+}
+
+// tlsClient performs tls handshake over c. c is closed on error.
+func (cl *Client) tlsClient(ctx context.Context, c net.Conn, host string) (_ net.Conn, err error) {
+	defer closerOnErr(c, &err)
+
+	cfg := &tls.Config{}
+
+	switch {
+	case cl.TLSConfig != nil:
+		cfg = cl.TLSConfig.Clone()
+	case cl.TLSDialer.Config != nil:
+		cfg = cl.TLSDialer.Config.Clone()
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	tc := tls.Client(c, cfg)
+
+	err = tc.HandshakeContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+
+	return tc, nil
+}
+
+// hostPort returns host:port address with the default port for the scheme if not set.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
 }
 
 func closerOnErr(c io.Closer, errp *error) {
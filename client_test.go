@@ -0,0 +1,1179 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientPipelinedFrame(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789"), 1000)
+
+	addr := rawServer(t, func(req *http.Request) []byte {
+		return append(switchResponse(secKeyHash(req.Header.Get("Sec-WebSocket-Key"))), frameBytes(FrameBinary, msg, true)...)
+	})
+
+	var cl Client
+
+	c, err := cl.DialContext(context.Background(), "ws://"+addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	op, data, err := c.appendMessage(context.Background(), nil)
+	if err != nil || op != FrameBinary || !bytes.Equal(data, msg) {
+		t.Errorf("read message: %v %v %v", op, len(data), err)
+	}
+}
+
+func TestClientFirstFrames(t *testing.T) {
+	ctx := context.Background()
+
+	cp, sp := newPipe()
+	defer sp.Close()
+
+	big := bytes.Repeat([]byte("0123456789"), 1000) // bigger than the read buffer
+	second := frameBytes(FrameText, []byte("second"), true)
+
+	errc := make(chan error, 1)
+
+	go func() {
+		r := bufio.NewReader(sp)
+
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		// the response, the first frame, and a part of the second one in the same write
+		b := switchResponse(secKeyHash(req.Header.Get("Sec-WebSocket-Key")))
+		b = append(b, frameBytes(FrameBinary, big, true)...)
+		b = append(b, second[:3]...)
+
+		_, err = sp.Write(b)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		// the client writes before reading anything
+		s := &Conn{Conn: sp}
+
+		err = s.readBuffered(r)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		_, data, err := s.ReadMessage(ctx)
+		if err == nil && string(data) != "first" {
+			err = fmt.Errorf("unexpected client message: %q", data)
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		_, err = sp.Write(second[3:])
+		errc <- err
+	}()
+
+	cl := Client{
+		ReadBufferSize: 0x100,
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cp, nil
+		},
+	}
+
+	c, err := cl.DialContext(ctx, "ws://pipe/")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	err = c.WriteMessage(FrameText, []byte("first"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	op, data, err := c.ReadMessage(ctx)
+	if err != nil || op != FrameBinary || !bytes.Equal(data, big) {
+		t.Errorf("read first message: %v %v %v", op, len(data), err)
+	}
+
+	op, data, err = c.ReadMessage(ctx)
+	if err != nil || op != FrameText || string(data) != "second" {
+		t.Errorf("read second message: %v %q %v", op, data, err)
+	}
+}
+
+func TestClientKeepConnOnError(t *testing.T) {
+	addr := rawServer(t, func(req *http.Request) []byte {
+		return append(switchResponse("bad accept"), frameBytes(FrameText, []byte("data"), true)...)
+	})
+
+	cl := Client{KeepConnOnError: true}
+
+	c, resp, err := cl.Handshake(context.Background(), newRequest(t, &cl, "ws://"+addr))
+	if err == nil || c == nil || resp == nil {
+		t.Fatalf("expected conn and error, got %v %v %v", c, resp, err)
+	}
+
+	defer c.Close()
+
+	_, data, err := c.ReadMessage(context.Background())
+	if err != nil || string(data) != "data" {
+		t.Errorf("read message: %q %v", data, err)
+	}
+}
+
+func TestClientHandshakeErrorPool(t *testing.T) {
+	addr := rawServer(t, func(req *http.Request) []byte {
+		return append(switchResponse("bad accept"), frameBytes(FrameText, []byte("data"), true)...)
+	})
+
+	var p countPool
+
+	cl := Client{BufferPool: &p}
+
+	_, _, err := cl.Handshake(context.Background(), newRequest(t, &cl, "ws://"+addr))
+	if !errors.Is(err, ErrBadAccept) {
+		t.Fatalf("expected %v, got %v", ErrBadAccept, err)
+	}
+
+	if out := p.Out(); out != 0 {
+		t.Errorf("buffers not returned: %d", out)
+	}
+}
+
+// rawServer accepts a single connection, reads the request and writes the response.
+func rawServer(t *testing.T, respond func(req *http.Request) []byte) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+
+		_, _ = c.Write(respond(req))
+
+		_, _ = io.Copy(io.Discard, c)
+	}()
+
+	return l.Addr().String()
+}
+
+func switchResponse(accept string) []byte {
+	return []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+}
+
+func TestClientAcceptPadded(t *testing.T) {
+	addr := rawServer(t, func(req *http.Request) []byte {
+		return switchResponse(" \t" + secKeyHash(req.Header.Get("Sec-WebSocket-Key")) + "\t ")
+	})
+
+	var cl Client
+
+	c, err := cl.DialContext(context.Background(), "ws://"+addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	_ = c.Close()
+
+	// header set not by the parser keeps the padding
+	req := newRequest(t, &cl, "ws://example.com")
+	accept := secKeyHash(req.Header.Get("Sec-WebSocket-Key"))
+
+	for _, tc := range []struct {
+		accept string
+		ok     bool
+	}{
+		{" " + accept + " ", true},
+		{accept[:len(accept)-1], false},
+		{accept + "x", false},
+	} {
+		resp := &http.Response{Header: http.Header{
+			"Connection":           {"Upgrade"},
+			"Upgrade":              {"websocket"},
+			"Sec-Websocket-Accept": {tc.accept},
+		}}
+
+		_, err = checkResponse(req, resp)
+		if (err == nil) != tc.ok {
+			t.Errorf("accept %q: %v", tc.accept, err)
+		}
+	}
+}
+
+func TestClientHandshakeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		respond func(accept string) []byte
+		err     error
+		status  int
+	}{
+		{"unauthorized", func(string) []byte {
+			return []byte("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\n\r\n")
+		}, ErrBadStatus, http.StatusUnauthorized},
+		{"connection", func(accept string) []byte {
+			return []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		}, ErrUpgradeMismatch, http.StatusSwitchingProtocols},
+		{"upgrade", func(accept string) []byte {
+			return []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		}, ErrUpgradeMismatch, http.StatusSwitchingProtocols},
+		{"no accept", func(string) []byte {
+			return switchResponse("")
+		}, ErrBadAccept, http.StatusSwitchingProtocols},
+		{"bad accept", func(string) []byte {
+			return switchResponse("bad accept")
+		}, ErrBadAccept, http.StatusSwitchingProtocols},
+	} {
+		addr := rawServer(t, func(req *http.Request) []byte {
+			return tc.respond(secKeyHash(req.Header.Get("Sec-WebSocket-Key")))
+		})
+
+		var cl Client
+
+		c, resp, err := cl.Handshake(context.Background(), newRequest(t, &cl, "ws://"+addr))
+		if c != nil {
+			t.Errorf("%s: unexpected conn", tc.name)
+			_ = c.Close()
+		}
+
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+
+		var herr *HandshakeError
+		if !errors.As(err, &herr) || herr.Response == nil || herr.Response != resp || resp.StatusCode != tc.status {
+			t.Errorf("%s: expected handshake error with response %d, got %v (%v)", tc.name, tc.status, err, resp)
+		}
+	}
+}
+
+func TestClientHTTPProxy(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			_, err := c.WriteFrame([]byte("hello"), FrameText, true)
+			return err
+		},
+	})
+	defer hs.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	defer l.Close()
+
+	connectc := make(chan string, 1)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+
+		connectc <- req.Method + " " + req.Host
+
+		tc, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+
+		defer tc.Close()
+
+		_, _ = c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+		go func() {
+			_, _ = io.Copy(tc, c)
+		}()
+
+		_, _ = io.Copy(c, tc)
+	}()
+
+	cl := Client{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()}),
+	}
+
+	c, err := cl.DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if q, exp := <-connectc, "CONNECT "+hs.Listener.Addr().String(); q != exp {
+		t.Errorf("expected %q, got %q", exp, q)
+	}
+
+	op, data, err := c.appendMessage(ctx, nil)
+	if err != nil || op != FrameText || string(data) != "hello" {
+		t.Errorf("read message: %v %q %v", op, data, err)
+	}
+}
+
+func TestClientSOCKS5Proxy(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			_, err := c.WriteFrame([]byte("hello"), FrameText, true)
+			return err
+		},
+	})
+	defer hs.Close()
+
+	_, port, _ := net.SplitHostPort(hs.Listener.Addr().String())
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	defer l.Close()
+
+	type request struct {
+		auth string
+		atyp byte
+		host string
+	}
+
+	reqc := make(chan request, 1)
+
+	// socks5 serves a single connection passing it to the test server
+	// whatever the requested address is.
+	socks5 := func(c net.Conn) {
+		defer c.Close()
+
+		var req request
+
+		r := bufio.NewReader(c)
+
+		b := make([]byte, 2)
+
+		_, err := io.ReadFull(r, b)
+		if err != nil || b[0] != 5 {
+			return
+		}
+
+		methods := make([]byte, b[1])
+
+		_, err = io.ReadFull(r, methods)
+		if err != nil {
+			return
+		}
+
+		if bytes.IndexByte(methods, 2) >= 0 {
+			_, _ = c.Write([]byte{5, 2})
+
+			b = make([]byte, 2)
+			_, _ = io.ReadFull(r, b)
+			user := make([]byte, b[1])
+			_, _ = io.ReadFull(r, user)
+			_, _ = io.ReadFull(r, b[:1])
+			pass := make([]byte, b[0])
+			_, _ = io.ReadFull(r, pass)
+
+			req.auth = string(user) + ":" + string(pass)
+
+			_, _ = c.Write([]byte{1, 0})
+		} else {
+			_, _ = c.Write([]byte{5, 0})
+		}
+
+		b = make([]byte, 4)
+
+		_, err = io.ReadFull(r, b)
+		if err != nil || b[1] != 1 {
+			return
+		}
+
+		req.atyp = b[3]
+
+		var host []byte
+
+		switch req.atyp {
+		case 1:
+			host = make([]byte, 4)
+		case 4:
+			host = make([]byte, 16)
+		case 3:
+			n, _ := r.ReadByte()
+			host = make([]byte, n)
+		}
+
+		_, err = io.ReadFull(r, host)
+		if err != nil {
+			return
+		}
+
+		req.host = string(host)
+		if req.atyp != 3 {
+			req.host = net.IP(host).String()
+		}
+
+		_, _ = io.ReadFull(r, b[:2])
+
+		reqc <- req
+
+		tc, err := net.Dial("tcp", hs.Listener.Addr().String())
+		if err != nil {
+			return
+		}
+
+		defer tc.Close()
+
+		_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+		go func() {
+			_, _ = io.Copy(tc, r)
+		}()
+
+		_, _ = io.Copy(c, tc)
+	}
+
+	for _, tc := range []struct {
+		proxy *url.URL
+		exp   func(request) bool
+	}{
+		{&url.URL{Scheme: "socks5h", Host: l.Addr().String()}, func(r request) bool {
+			return r.atyp == 3 && r.host == "localhost" && r.auth == ""
+		}},
+		{&url.URL{Scheme: "socks5", Host: l.Addr().String(), User: url.UserPassword("user", "pass")}, func(r request) bool {
+			ip := net.ParseIP(r.host)
+			return r.atyp != 3 && ip != nil && ip.IsLoopback() && r.auth == "user:pass"
+		}},
+	} {
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			socks5(c)
+		}()
+
+		cl := Client{
+			Proxy: http.ProxyURL(tc.proxy),
+		}
+
+		c, err := cl.DialContext(ctx, "ws://localhost:"+port)
+		if err != nil {
+			t.Fatalf("%v: dial: %v", tc.proxy.Scheme, err)
+		}
+
+		if req := <-reqc; !tc.exp(req) {
+			t.Errorf("%v: unexpected request: %+v", tc.proxy.Scheme, req)
+		}
+
+		op, data, err := c.appendMessage(ctx, nil)
+		if err != nil || op != FrameText || string(data) != "hello" {
+			t.Errorf("%v: read message: %v %q %v", tc.proxy.Scheme, op, data, err)
+		}
+
+		_ = c.Close()
+	}
+}
+
+type recordDialer struct {
+	net.Dialer
+	addr string
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addr = addr
+
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestClientProxyDialer(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			_, err := c.WriteFrame([]byte("hello"), FrameText, true)
+			return err
+		},
+	})
+	defer hs.Close()
+
+	var d recordDialer
+
+	cl := Client{
+		ProxyDialer: &d,
+		Proxy: func(*http.Request) (*url.URL, error) {
+			return nil, errors.New("not used")
+		},
+	}
+
+	c, err := cl.DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if exp := hs.Listener.Addr().String(); d.addr != exp {
+		t.Errorf("expected dial to %v, got %v", exp, d.addr)
+	}
+
+	op, data, err := c.appendMessage(ctx, nil)
+	if err != nil || op != FrameText || string(data) != "hello" {
+		t.Errorf("read message: %v %q %v", op, data, err)
+	}
+}
+
+func TestClientRedirect(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.Handle("/new", &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			_, err := c.WriteFrame([]byte(c.Subprotocol()), FrameText, true)
+			return err
+		},
+		Subprotocols: []string{"proto"},
+	})
+	mux.Handle("/old", http.RedirectHandler("/new", http.StatusFound))
+
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	cl := Client{Subprotocols: []string{"proto"}}
+
+	_, resp, err := cl.Handshake(ctx, newRequest(t, &cl, hs.URL+"/old"))
+	if err == nil || resp == nil || resp.StatusCode != http.StatusFound {
+		t.Errorf("expected redirect error, got %v %v", resp, err)
+	}
+
+	cl.MaxRedirects = 1
+
+	c, resp, err := cl.Handshake(ctx, newRequest(t, &cl, hs.URL+"/old"))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	defer c.Close()
+
+	if resp.Request.URL.Path != "/new" {
+		t.Errorf("final request path: %v", resp.Request.URL.Path)
+	}
+
+	_, data, err := c.appendMessage(ctx, nil)
+	if err != nil || string(data) != "proto" {
+		t.Errorf("read message: %q %v", data, err)
+	}
+}
+
+func TestClientRedirectCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	var cl Client
+
+	for _, tc := range []struct {
+		loc  string
+		keep bool
+	}{
+		{"wss://example.com/new", true},
+		{"https://example.com/new", true},
+		{"ws://example.com/new", false},
+		{"wss://example.com:8443/new", false},
+		{"wss://other.example.com/new", false},
+	} {
+		req := newRequest(t, &cl, "wss://example.com/old")
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Custom", "value")
+
+		loc, err := url.Parse(tc.loc)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+
+		next, err := cl.redirectRequest(ctx, req, loc)
+		if err != nil {
+			t.Fatalf("%s: redirect: %v", tc.loc, err)
+		}
+
+		auth, cookie := next.Header.Get("Authorization"), next.Header.Get("Cookie")
+		if (auth != "") != tc.keep || (cookie != "") != tc.keep {
+			t.Errorf("%s: expected credentials kept %v, got %q %q", tc.loc, tc.keep, auth, cookie)
+		}
+
+		if next.Header.Get("X-Custom") != "value" {
+			t.Errorf("%s: header is not kept", tc.loc)
+		}
+	}
+}
+
+func newRequest(t *testing.T, cl *Client, url string) *http.Request {
+	t.Helper()
+
+	req, err := cl.NewRequest(context.Background(), url)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+
+	return req
+}
+
+func TestClientModifiedRequest(t *testing.T) {
+	ctx := context.Background()
+
+	s := &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			req := c.Request()
+
+			return c.WriteMessage(FrameText, fmt.Appendf(nil, "%s %s %s", req.Host, req.URL.RequestURI(), req.Header.Get("X-Custom")))
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	var cl Client
+
+	req, err := cl.NewRequest(ctx, hs.URL+"/orig?a=b")
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+
+	req.URL.Path = "/custom/path"
+	req.URL.RawQuery = "token=abc&x=1"
+	req.Host = "virtual.example"
+	req.Header.Set("X-Custom", "value")
+
+	c, resp, err := cl.Handshake(ctx, req)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	defer c.Close()
+	defer resp.Body.Close()
+
+	_, data, err := c.ReadMessage(ctx)
+	if exp := "virtual.example /custom/path?token=abc&x=1 value"; err != nil || string(data) != exp {
+		t.Errorf("server got %q %v, expected %q", data, err, exp)
+	}
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	ctx := context.Background()
+
+	s := &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			req := c.Request()
+			user, pass, ok := req.BasicAuth()
+
+			return c.WriteMessage(FrameText, fmt.Appendf(nil, "%v %s %s %s", ok, user, pass, req.Host))
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	host := hs.Listener.Addr().String()
+
+	for _, tc := range []struct {
+		name string
+		cl   Client
+		url  string
+		exp  string
+	}{
+		{"none", Client{}, "ws://" + host, "false   " + host},
+		{"userinfo", Client{}, "ws://user:p%40ss@" + host + "/path", "true user p@ss " + host},
+		{"set", func() (cl Client) { cl.SetBasicAuth("name", "secret"); return }(), "ws://" + host, "true name secret " + host},
+		{"set overrides userinfo", func() (cl Client) { cl.SetBasicAuth("name", "secret"); return }(), "ws://user:pass@" + host, "true name secret " + host},
+	} {
+		c, err := tc.cl.DialContext(ctx, tc.url)
+		if err != nil {
+			t.Errorf("%s: dial: %v", tc.name, err)
+			continue
+		}
+
+		_, data, err := c.ReadMessage(ctx)
+		if err != nil || string(data) != tc.exp {
+			t.Errorf("%s: server got %q %v, expected %q", tc.name, data, err, tc.exp)
+		}
+
+		_ = c.Close()
+	}
+
+	var cl Client
+
+	req, err := cl.NewRequest(ctx, "ws://user:pass@"+host)
+	if err != nil || req.URL.User != nil || req.Host != host {
+		t.Errorf("userinfo leaked: %v %v %v", req.URL, req.Host, err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ctx := context.Background()
+
+	s := &Server{
+		Subprotocols: []string{"v1", "v2"},
+		Handler: func(ctx context.Context, c *Conn) error {
+			req := c.Request()
+
+			return c.WriteMessage(FrameText, fmt.Appendf(nil, "%v %v", req.Header.Values("X-Test"), req.Header.Get("X-Client")))
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	c, resp, err := Dial(ctx, hs.URL,
+		WithSubprotocols("v2"),
+		WithHeader("X-Test", "a"),
+		WithHeader("X-Test", "b"),
+		WithClient(func(cl *Client) { cl.ReadBufferSize = 128 }),
+		WithClient(func(cl *Client) { cl.Header.Set("X-Client", "c") }),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || c.Subprotocol() != "v2" || c.ReadBufferSize != 128 {
+		t.Errorf("response: %v %q %v", resp.Status, c.Subprotocol(), c.ReadBufferSize)
+	}
+
+	_, data, err := c.ReadMessage(ctx)
+	if err != nil || string(data) != "[a b] c" {
+		t.Errorf("read: %q %v", data, err)
+	}
+
+	_, resp, err = Dial(ctx, hs.URL+"/not-websocket", WithHeader("Upgrade", "nope"))
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %v %v", resp, err)
+	}
+
+	// server never responds
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		_, _ = io.Copy(io.Discard, c)
+	}()
+
+	_, _, err = Dial(ctx, "ws://"+l.Addr().String(), WithHandshakeTimeout(50*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	ctx := context.Background()
+
+	sock := filepath.Join(t.TempDir(), "ws.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	ws := &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			req := c.Request()
+
+			return c.WriteMessage(FrameText, fmt.Appendf(nil, "%v %v", req.Host, req.URL.RequestURI()))
+		},
+	}
+
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/old" {
+			http.Redirect(w, req, "/new?x=1", http.StatusFound)
+			return
+		}
+
+		ws.ServeHTTP(w, req)
+	})}
+
+	go func() { _ = hs.Serve(l) }()
+	defer hs.Close()
+
+	for _, tc := range []struct {
+		url  string
+		resp string
+	}{
+		{"ws+unix://" + sock + ":/some/path?a=b", "localhost /some/path?a=b"},
+		{"ws+unix:" + sock, "localhost /"},
+		{"ws+unix://" + sock + ":/old", "localhost /new?x=1"},
+	} {
+		c, _, err := Dial(ctx, tc.url, WithClient(func(cl *Client) {
+			cl.MaxRedirects = 1
+			cl.Proxy = func(*http.Request) (*url.URL, error) { return nil, errors.New("unix socket is proxied") }
+		}))
+		if err != nil {
+			t.Fatalf("%s: dial: %v", tc.url, err)
+		}
+
+		_, data, err := c.ReadMessage(ctx)
+		if err != nil || string(data) != tc.resp {
+			t.Errorf("%s: read: %q %v, expected %q", tc.url, data, err, tc.resp)
+		}
+
+		_ = c.Close()
+	}
+
+	var cl Client
+
+	for _, u := range []string{"ws+unix://host/path.sock:/", "ws+unix://"} {
+		_, err = cl.NewRequest(ctx, u)
+		if err == nil {
+			t.Errorf("%s: expected error", u)
+		}
+	}
+}
+
+func TestClientNetDialPipe(t *testing.T) {
+	ctx := context.Background()
+
+	l := newPipeListener()
+	defer l.Close()
+
+	go func() {
+		_ = http.Serve(l, &Server{
+			Handler: func(ctx context.Context, c *Conn) error {
+				_, err := c.WriteFrame([]byte("over pipe"), FrameText, true)
+				return err
+			},
+		})
+	}()
+
+	cl := Client{NetDial: l.Dial}
+
+	c, err := cl.DialContext(ctx, "ws://in-memory/")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	_, data, err := c.ReadMessage(ctx)
+	if err != nil || string(data) != "over pipe" {
+		t.Errorf("read message: %q %v", data, err)
+	}
+
+	_, _, err = c.ReadMessage(ctx) // net.Pipe is not buffered, wait for the server close frame before closing
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+type pipeListener struct {
+	connc chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		connc: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, s := net.Pipe()
+
+	select {
+	case l.connc <- s:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connc:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestClientTLSConfig(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewTLSServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			return c.WriteMessage(FrameText, []byte("secure"))
+		},
+	})
+	defer hs.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+
+	u := "wss://" + hs.Listener.Addr().String()
+	cfg := &tls.Config{RootCAs: roots}
+
+	for _, tc := range []struct {
+		name string
+		cfg  *tls.Config
+		ok   bool
+	}{
+		{"system roots", nil, false},
+		{"custom roots", cfg, true},
+		{"server name", &tls.Config{RootCAs: roots, ServerName: "example.com"}, true},
+		{"wrong server name", &tls.Config{RootCAs: roots, ServerName: "wrong.host"}, false},
+	} {
+		cl := Client{TLSConfig: tc.cfg}
+
+		c, err := cl.DialContext(ctx, u)
+		if !tc.ok {
+			if err == nil {
+				_ = c.Close()
+				t.Errorf("%s: expected error", tc.name)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: dial: %v", tc.name, err)
+			continue
+		}
+
+		_, data, err := c.ReadMessage(ctx)
+		if err != nil || string(data) != "secure" {
+			t.Errorf("%s: read message: %q %v", tc.name, data, err)
+		}
+
+		_ = c.Close()
+	}
+
+	if cfg.ServerName != "" {
+		t.Errorf("user config modified: %q", cfg.ServerName)
+	}
+}
+
+func TestClientHandshakeContext(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	defer l.Close()
+
+	closedc := make(chan error, 1)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		_, err = io.Copy(io.Discard, c) // never respond, wait for the client to close
+		closedc <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var cl Client
+
+	_, err = cl.DialContext(ctx, "ws://"+l.Addr().String())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	select {
+	case err := <-closedc:
+		if err != nil {
+			t.Errorf("server conn: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client conn is not closed")
+	}
+}
+
+// streamTransport emulates HTTP/2 transport supporting extended CONNECT,
+// serving the stream with h in the same process.
+type streamTransport struct {
+	t *testing.T
+	h func(req *http.Request, w *headerWriter)
+}
+
+func (tr streamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodConnect || req.Header.Get(":protocol") != "websocket" ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" || req.Header.Get("Sec-WebSocket-Key") != "" ||
+		req.Header.Get("Upgrade") != "" {
+		tr.t.Errorf("request: %v %v", req.Method, req.Header)
+
+		return &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request", Body: http.NoBody}, nil
+	}
+
+	pr, pw := io.Pipe()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Body:       pr,
+	}
+
+	hdr := make(chan http.Header)
+
+	go func() {
+		defer pw.Close()
+
+		tr.h(req, &headerWriter{w: pw, hdr: hdr})
+	}()
+
+	resp.Header = <-hdr
+
+	return resp, nil
+}
+
+// headerWriter sends the response header before the first write.
+type headerWriter struct {
+	w   io.Writer
+	hdr chan http.Header
+}
+
+func (w *headerWriter) WriteHeader(h http.Header) {
+	if w.hdr != nil {
+		w.hdr <- h
+		w.hdr = nil
+	}
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(make(http.Header))
+
+	return w.w.Write(p)
+}
+
+func TestClientHTTP2(t *testing.T) {
+	ctx := context.Background()
+
+	tr := streamTransport{t: t, h: func(req *http.Request, w *headerWriter) {
+		w.WriteHeader(http.Header{"Sec-Websocket-Protocol": {"v1"}})
+
+		c := &Conn{Conn: &streamConn{r: req.Body, w: w, close: req.Body.Close}}
+
+		for {
+			op, data, err := c.ReadMessage(ctx)
+			if err != nil {
+				return
+			}
+
+			err = c.WriteMessage(op, data)
+			if err != nil {
+				t.Errorf("server write: %v", err)
+				return
+			}
+		}
+	}}
+
+	cl := Client{UseHTTP2: true, Transport: tr, Subprotocols: []string{"v1"}}
+
+	c, err := cl.DialContext(ctx, "wss://example.com/path")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if c.Subprotocol() != "v1" || c.RemoteAddr().String() != "example.com" {
+		t.Errorf("subprotocol %q, remote addr %v", c.Subprotocol(), c.RemoteAddr())
+	}
+
+	for i := range 3 {
+		msg := fmt.Appendf(nil, "message %d", i)
+
+		err = c.WriteMessage(FrameText, msg)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		_, data, err := c.ReadMessage(ctx)
+		if err != nil || !bytes.Equal(data, msg) {
+			t.Fatalf("read: %q %v", data, err)
+		}
+	}
+
+	_, err = (&Client{UseHTTP2: true}).DialContext(ctx, "wss://example.com/path")
+	if err == nil {
+		t.Errorf("expected error without transport")
+	}
+}
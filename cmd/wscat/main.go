@@ -8,6 +8,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"time"
 
 	"nikand.dev/go/cli"
@@ -32,7 +33,7 @@ func main() {
 			Action: serverRun,
 			Flags: []*cli.Flag{
 				cli.NewFlag("listen,l", "localhost:8080", "listen http"),
-				cli.NewFlag("handler,h", "echo", "echo|ticker"),
+				cli.NewFlag("handler,h", "", "echo|ticker, routed by request path (/echo, /ticker) if empty"),
 			},
 		}},
 
@@ -199,17 +200,11 @@ func serverRun(c *cli.Command) (err error) {
 	tlog.Printw("listening", "addr", l.Addr())
 
 	var ws websocket.Server
-	var h websocket.Handler
 
-	switch c.String("handler") {
-	case "echo":
-		h = Echo
-	case "ticker":
-		h = Ticker
-	}
+	handler := c.String("handler")
 
 	ws.Handler = func(ctx context.Context, c *websocket.Conn) (err error) {
-		tr := tlog.SpanFromContext(ctx).Or(tlog.Root()).Spawn("connection", "raddr", c.Conn.RemoteAddr())
+		tr := tlog.SpanFromContext(ctx).Or(tlog.Root()).Spawn("connection", "raddr", c.RemoteAddr(), "path", c.Request().URL.Path)
 		defer tr.Finish("err", &err)
 
 		ctx = tlog.ContextWithSpan(ctx, tr)
@@ -218,7 +213,19 @@ func serverRun(c *cli.Command) (err error) {
 			c.Conn = &Dumper{c.Conn}
 		}
 
-		return h(ctx, c)
+		name := handler
+		if name == "" {
+			name = strings.TrimPrefix(c.Request().URL.Path, "/")
+		}
+
+		switch name {
+		case "echo":
+			return Echo(ctx, c)
+		case "ticker":
+			return Ticker(ctx, c)
+		default:
+			return c.CloseWriterText(websocket.StatusPolicy, "unknown handler: "+name)
+		}
 	}
 
 	err = http.Serve(l, &ws)
@@ -270,6 +277,11 @@ func Echo(ctx context.Context, c *websocket.Conn) error {
 }
 
 func Ticker(ctx context.Context, c *websocket.Conn) error {
+	// reading notices the client close and cancels ctx
+	go func() {
+		_, _ = io.Copy(io.Discard, c)
+	}()
+
 	t := time.NewTicker(time.Second)
 	defer t.Stop()
 
@@ -0,0 +1,503 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// CompressionParams are permessage-deflate extension parameters (RFC 7692).
+	CompressionParams struct {
+		// ServerNoContextTakeover makes the server reset its compressor after each message.
+		ServerNoContextTakeover bool
+
+		// ClientNoContextTakeover makes the client reset its compressor after each message.
+		ClientNoContextTakeover bool
+
+		// ServerMaxWindowBits limits the server compressor window to 1<<n bytes, from 8 to 15.
+		// Zero means the parameter is absent, which is the same as 15.
+		// compress/flate always uses the 15-bit window,
+		// so the server declines offers limiting its window further,
+		// while the client accepts any server window as decompression works with any.
+		ServerMaxWindowBits int
+
+		// ClientMaxWindowBits is the same for the client compressor.
+		// In the offer it allows the server to limit the client window,
+		// the value is optional and 15 is used if it's omitted.
+		// The client can't limit its own window, so values below 15 are not offered,
+		// the parameter is omitted then. The client fails the handshake if the server limits it below 15.
+		ClientMaxWindowBits int
+	}
+
+	// deflateState is the permessage-deflate state of the Conn.
+	// Writer fields are guarded by wmu and reader fields by rmu.
+	deflateState struct {
+		params CompressionParams
+
+		w      *flate.Writer
+		wbuf   bytes.Buffer
+		wreset bool // no context takeover for our messages
+		level  int  // flate compression level
+
+		r      io.ReadCloser
+		br     bufio.Reader
+		src    inflateSource
+		dict   []byte // the last window of decompressed data
+		rreset bool   // no context takeover for peer messages
+		rerr   error  // inflate was interrupted, the decompressor state is lost
+	}
+
+	// inflateSource reads the compressed message payload across fragments
+	// followed by deflateTail.
+	inflateSource struct {
+		c   *Conn
+		ctx context.Context
+
+		fin  bool // the last frame of the message is being read
+		data bool // any payload is read
+		tail int
+
+		err error // the connection read error, flate doesn't keep it intact
+	}
+
+	inflateReader struct {
+		c   *Conn
+		ctx context.Context
+	}
+)
+
+const deflateExtension = "permessage-deflate"
+
+const (
+	rsvDeflate = 0x40
+
+	deflateWindow = 1 << 15
+)
+
+// deflateTail is appended to the message payload before decompression.
+// It's the trailer removed by the sender followed by an empty final block,
+// so the flate reader ends with io.EOF.
+// Empty payload has no block header for the trailer,
+// so only the final block is used for it.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+const deflateEmptyTail = 4 // deflateTail offset of the final block
+
+// String formats the params as a Sec-WebSocket-Extensions element.
+func (p CompressionParams) String() string {
+	s := deflateExtension
+
+	if p.ServerNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.ClientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.ServerMaxWindowBits != 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.ServerMaxWindowBits)
+	}
+	if p.ClientMaxWindowBits != 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.ClientMaxWindowBits)
+	}
+
+	return s
+}
+
+// CompressionParams returns the negotiated permessage-deflate parameters.
+// ok is false if compression was not negotiated.
+func (c *Conn) CompressionParams() (p CompressionParams, ok bool) {
+	if c.deflate == nil {
+		return p, false
+	}
+
+	return c.deflate.params, true
+}
+
+// SetCompressionLevel sets the flate level our messages are compressed with,
+// from flate.HuffmanOnly to flate.BestCompression. flate.DefaultCompression is used by default.
+// It has no effect if permessage-deflate is not negotiated.
+// Changing the level resets the compressor, so the next message doesn't benefit from the previous ones.
+func (c *Conn) SetCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("%w: %d", ErrCompressionLevel, level)
+	}
+
+	defer c.unlockWrite()
+	c.wmu.Lock()
+
+	d := c.deflate
+	if d == nil || d.level == level {
+		return nil
+	}
+
+	d.level = level
+	d.w = nil
+
+	return nil
+}
+
+// setCompression enables permessage-deflate if p is not nil.
+// It must be called after the client role is set.
+func (c *Conn) setCompression(p *CompressionParams) {
+	if p == nil {
+		return
+	}
+
+	c.deflate = &deflateState{
+		params: *p,
+		level:  flate.DefaultCompression,
+		wreset: csel(c.client != 0, p.ClientNoContextTakeover, p.ServerNoContextTakeover),
+		rreset: csel(c.client != 0, p.ServerNoContextTakeover, p.ClientNoContextTakeover),
+	}
+
+	c.ReservedBits |= rsvDeflate
+}
+
+// parseCompressionParams parses permessage-deflate extension element.
+// Unknown, duplicated and malformed parameters are rejected.
+func parseCompressionParams(ext string) (p CompressionParams, err error) {
+	_, params, _ := strings.Cut(ext, ";")
+
+	for param := range strings.SplitSeq(params, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+
+		name, val, hasVal := strings.Cut(param, "=")
+		name = strings.TrimSpace(name)
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+
+		var dup bool
+
+		switch {
+		case name == "server_no_context_takeover" && !hasVal:
+			dup = p.ServerNoContextTakeover
+			p.ServerNoContextTakeover = true
+		case name == "client_no_context_takeover" && !hasVal:
+			dup = p.ClientNoContextTakeover
+			p.ClientNoContextTakeover = true
+		case name == "server_max_window_bits" && hasVal:
+			dup = p.ServerMaxWindowBits != 0
+			p.ServerMaxWindowBits, err = parseWindowBits(val)
+		case name == "client_max_window_bits":
+			dup = p.ClientMaxWindowBits != 0
+			p.ClientMaxWindowBits, err = parseWindowBits(csel(hasVal, val, "15"))
+		default:
+			return p, fmt.Errorf("%w: %v", ErrCompressionParams, param)
+		}
+
+		if dup {
+			return p, fmt.Errorf("%w: duplicated %v", ErrCompressionParams, name)
+		}
+		if err != nil {
+			return p, fmt.Errorf("%w: %v", ErrCompressionParams, param)
+		}
+	}
+
+	return p, nil
+}
+
+// parseWindowBits parses window bits value from 8 to 15 without leading zeros.
+func parseWindowBits(val string) (int, error) {
+	bits, err := strconv.Atoi(val)
+	if err != nil || bits < 8 || bits > 15 || strconv.Itoa(bits) != val {
+		return 0, errors.New("bad window bits")
+	}
+
+	return bits, nil
+}
+
+// limitsWindow reports whether the window bits parameter limits the window below
+// the 15 bits compress/flate always uses.
+func limitsWindow(bits int) bool {
+	return bits != 0 && bits < 15
+}
+
+// negotiateCompression accepts the first supported permessage-deflate offer.
+// Other extensions are returned in rest.
+func (s *Server) negotiateCompression(offered []string) (p *CompressionParams, rest []string) {
+	for _, ext := range offered {
+		if extensionName(ext) != deflateExtension {
+			rest = append(rest, ext)
+			continue
+		}
+
+		if p != nil {
+			continue
+		}
+
+		op, err := parseCompressionParams(ext)
+		if err != nil {
+			continue
+		}
+
+		// our compressor window can't be limited
+		if limitsWindow(op.ServerMaxWindowBits) || limitsWindow(s.Compression.ServerMaxWindowBits) {
+			continue
+		}
+
+		op.ServerNoContextTakeover = op.ServerNoContextTakeover || s.Compression.ServerNoContextTakeover
+		op.ClientNoContextTakeover = op.ClientNoContextTakeover || s.Compression.ClientNoContextTakeover
+
+		// any client window can be decompressed, so it's not limited
+		op.ClientMaxWindowBits = 0
+
+		p = &op
+	}
+
+	return p, rest
+}
+
+// compressionResponse checks permessage-deflate response against the offer.
+func compressionResponse(offered, accepted []string) (p *CompressionParams, err error) {
+	for _, ext := range accepted {
+		if extensionName(ext) != deflateExtension {
+			continue
+		}
+
+		if p != nil {
+			return nil, fmt.Errorf("%w: accepted twice", ErrCompressionParams)
+		}
+
+		rp, err := parseCompressionParams(ext)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range offered {
+			if extensionName(o) != deflateExtension {
+				continue
+			}
+
+			op, err := parseCompressionParams(o)
+			if err != nil {
+				continue
+			}
+
+			if op.ServerNoContextTakeover && !rp.ServerNoContextTakeover {
+				return nil, fmt.Errorf("%w: server_no_context_takeover ignored", ErrCompressionParams)
+			}
+			if op.ServerMaxWindowBits != 0 && (rp.ServerMaxWindowBits == 0 || rp.ServerMaxWindowBits > op.ServerMaxWindowBits) {
+				return nil, fmt.Errorf("%w: server_max_window_bits ignored", ErrCompressionParams)
+			}
+			if rp.ClientMaxWindowBits != 0 && op.ClientMaxWindowBits == 0 {
+				return nil, fmt.Errorf("%w: client_max_window_bits not offered", ErrCompressionParams)
+			}
+
+			// our compressor window can't be limited,
+			// the value in the offer is only a hint, so it's the response that matters
+			if limitsWindow(rp.ClientMaxWindowBits) {
+				return nil, fmt.Errorf("%w: client_max_window_bits=%d unsupported", ErrCompressionParams, rp.ClientMaxWindowBits)
+			}
+
+			break
+		}
+
+		p = &rp
+	}
+
+	return p, nil
+}
+
+// writeCompressed writes the whole message as a single compressed frame.
+func (c *Conn) writeCompressed(p []byte, op Opcode) (int, error) {
+	z, err := c.deflate.compress(p)
+	if err != nil {
+		return 0, fmt.Errorf("compress: %w", err)
+	}
+
+	_, err = c.writeFrameRSV(z, op, true, rsvDeflate)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (d *deflateState) compress(p []byte) ([]byte, error) {
+	d.wbuf.Reset()
+
+	if d.w == nil {
+		d.w, _ = flate.NewWriter(&d.wbuf, d.level)
+	} else if d.wreset {
+		d.w.Reset(&d.wbuf)
+	}
+
+	_, err := d.w.Write(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// sync flush trailer is removed as RFC 7692 requires
+	return bytes.TrimSuffix(d.wbuf.Bytes(), deflateTail[:4]), nil
+}
+
+// startInflate starts decompressing the message if the frame just read is compressed.
+func (c *Conn) startInflate(ctx context.Context) bool {
+	d := c.deflate
+
+	if d == nil || c.header.RSV()&rsvDeflate == 0 {
+		return false
+	}
+
+	d.src = inflateSource{c: c, ctx: ctx, fin: c.header.Fin()}
+	d.br.Reset(&d.src)
+
+	var dict []byte
+	if !d.rreset {
+		dict = d.dict
+	}
+
+	if d.r == nil {
+		d.r = flate.NewReaderDict(&d.br, dict)
+	} else {
+		_ = d.r.(flate.Resetter).Reset(&d.br, dict)
+	}
+
+	c.inflating = true
+
+	return true
+}
+
+// inflate reads the decompressed message started by startInflate.
+// io.EOF is returned at the end of the message.
+//
+// The decompressor can't resume after the connection read is interrupted,
+// so the following calls fail with an error wrapping ErrReadInterrupted.
+// Close frame received in the middle of the message ends it with the close error,
+// io.ErrUnexpectedEOF if it's a clean close.
+func (c *Conn) inflate(ctx context.Context, p []byte) (n int, err error) {
+	d := c.deflate
+
+	if d.rerr != nil {
+		return 0, d.rerr
+	}
+
+	d.src.ctx = ctx
+
+	n, err = d.r.Read(p)
+
+	if !d.rreset {
+		d.dict = append(d.dict, p[:n]...)
+
+		if len(d.dict) > 2*deflateWindow {
+			d.dict = d.dict[:copy(d.dict, d.dict[len(d.dict)-deflateWindow:])]
+		}
+	}
+
+	if (err == nil || errors.Is(err, io.EOF)) && c.msgOp == FrameText && !c.text.valid(p[:n], err != nil) {
+		return n, c.fail(StatusFormat)
+	}
+
+	var corrupt flate.CorruptInputError
+
+	switch {
+	case d.src.err != nil && c.readerClosed:
+		c.inflating = false
+
+		err = d.src.err
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return n, err
+	case d.src.err != nil:
+		d.rerr = fmt.Errorf("%w: %v", ErrReadInterrupted, d.src.err)
+
+		return n, d.src.err
+	case errors.Is(err, io.EOF):
+		c.inflating = false
+
+		// the message may have had a final block before the tail
+		_, err = io.Copy(io.Discard, &d.br)
+		if err != nil {
+			return n, err
+		}
+
+		return n, io.EOF
+	case err == io.ErrUnexpectedEOF || errors.As(err, &corrupt): //nolint:errorlint
+		c.inflating = false
+
+		return n, c.fail(StatusProtocol)
+	}
+
+	return n, err
+}
+
+// appendInflated appends the decompressed message to b respecting MaxMessageSize.
+// st is where the message starts in b.
+func (c *Conn) appendInflated(ctx context.Context, b []byte, st int) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+
+		n, err := c.inflate(ctx, b[len(b):cap(b)])
+		b = b[:len(b)+n]
+
+		if c.MaxMessageSize != 0 && len(b)-st > c.MaxMessageSize {
+			return b, c.fail(StatusTooBig)
+		}
+		if errors.Is(err, io.EOF) {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+}
+
+func (r inflateReader) Read(p []byte) (int, error) {
+	return r.c.inflate(r.ctx, p)
+}
+
+func (s *inflateSource) Read(p []byte) (n int, err error) {
+	c := s.c
+
+	for c.more == 0 && !s.fin {
+		_, _, s.fin, err = c.readDataFrameHeader(s.ctx)
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+
+	if c.more == 0 {
+		if !s.data && s.tail == 0 {
+			s.tail = deflateEmptyTail
+		}
+
+		n = copy(p, deflateTail[s.tail:])
+		s.tail += n
+
+		if n == 0 {
+			return 0, io.EOF
+		}
+
+		return n, nil
+	}
+
+	n, err = c.readFrame(s.ctx, p)
+	s.data = s.data || n != 0
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		s.err = err
+	}
+
+	return n, err
+}
@@ -0,0 +1,603 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressionContextTakeover(t *testing.T) {
+	ctx := context.Background()
+	msg := []byte(strings.Repeat("compressible message payload, ", 10))
+
+	for _, p := range []CompressionParams{
+		{},
+		{ServerNoContextTakeover: true},
+		{ClientNoContextTakeover: true},
+		{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+	} {
+		t.Run(p.String(), func(t *testing.T) {
+			for _, client := range []byte{0, 1} {
+				var f FakeConn
+
+				w := &Conn{Conn: &f, client: client}
+				r := &Conn{Conn: &f, client: 1 - client}
+
+				w.setCompression(&p)
+				r.setCompression(&p)
+
+				reset := csel(client != 0, p.ClientNoContextTakeover, p.ServerNoContextTakeover)
+
+				var sizes []int
+
+				for i := range 5 {
+					st := len(f.b)
+
+					err := w.WriteMessage(FrameText, msg)
+					if err != nil {
+						t.Fatalf("write %d: %v", i, err)
+					}
+
+					if f.b[st]&rsvDeflate == 0 {
+						t.Errorf("message %d is not compressed", i)
+					}
+
+					sizes = append(sizes, len(f.b)-st)
+
+					op, data, err := r.ReadMessage(ctx)
+					if err != nil || op != FrameText || !bytes.Equal(data, msg) {
+						t.Fatalf("read %d: %v %q %v", i, op, data, err)
+					}
+				}
+
+				// history makes the following identical messages smaller
+				for i := 1; i < len(sizes); i++ {
+					if reset && sizes[i] != sizes[0] || !reset && sizes[i] >= sizes[0] {
+						t.Errorf("client %v reset %v: compressed sizes %v", client, reset, sizes)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionReadMethods(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	// the client resets its compressor, so the raw frame read doesn't break the next messages
+	w.setCompression(&CompressionParams{ClientNoContextTakeover: true})
+	r.setCompression(&CompressionParams{ClientNoContextTakeover: true})
+
+	var msgs [][]byte
+
+	for i := range 4 {
+		msgs = append(msgs, fmt.Appendf(nil, "message %d %s", i, strings.Repeat("abc", 100*i)))
+
+		err := w.WriteMessage(FrameBinary, msgs[i])
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	_, data, err := r.ReadMessage(ctx)
+	if err != nil || !bytes.Equal(data, msgs[0]) {
+		t.Errorf("read message: %q %v", data, err)
+	}
+
+	var buf bytes.Buffer
+
+	n, op, err := r.ReadTo(ctx, &buf)
+	if err != nil || op != FrameBinary || n != int64(len(msgs[1])) || !bytes.Equal(buf.Bytes(), msgs[1]) {
+		t.Errorf("read to: %v %v %q %v", n, op, buf.Bytes(), err)
+	}
+
+	fr, err := r.NextFrame(ctx)
+	if err != nil || !fr.Compressed {
+		t.Errorf("next frame: %+v %v", fr, err)
+	}
+
+	_, err = fr.ReadAppendTo(ctx, nil)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("read raw frame: %v", err)
+	}
+
+	got := make([]byte, len(msgs[3]))
+	p := got
+
+	for len(p) != 0 {
+		n, err := r.Read(p[:min(len(p), 7)])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		p = p[n:]
+	}
+
+	if !bytes.Equal(got, msgs[3]) {
+		t.Errorf("read: %q", got)
+	}
+}
+
+// compressedFragments writes msg compressed and split into two frames.
+func compressedFragments(t *testing.T, w *Conn, msg []byte) (first, rest func()) {
+	t.Helper()
+
+	z, err := w.deflate.compress(msg)
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	half := len(z) / 2
+
+	first = func() { _, _ = w.writeFrameRSV(z[:half], FrameText, false, rsvDeflate) }
+	rest = func() { _, _ = w.writeFrame(z[half:], FrameContinue, true) }
+
+	return first, rest
+}
+
+func TestCompressionInterrupted(t *testing.T) {
+	msg := []byte(strings.Repeat("compressible message payload, ", 10))
+
+	cp, sp := newPipe()
+	defer cp.Close()
+
+	w := &Conn{Conn: cp, client: 1}
+	r := &Conn{Conn: sp}
+
+	w.setCompression(&CompressionParams{})
+	r.setCompression(&CompressionParams{})
+
+	first, rest := compressedFragments(t, w, msg)
+
+	first()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := r.ReadMessage(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	rest()
+
+	op, data, err := r.ReadMessage(context.Background())
+	if !errors.Is(err, ErrReadInterrupted) || len(data) != 0 {
+		t.Errorf("read message after interrupted: %v %q %v", op, data, err)
+	}
+
+	n, err := r.Read(make([]byte, 100))
+	if !errors.Is(err, ErrReadInterrupted) || n != 0 {
+		t.Errorf("read after interrupted: %d %v", n, err)
+	}
+}
+
+func TestCompressionCloseInMessage(t *testing.T) {
+	ctx := context.Background()
+	msg := []byte(strings.Repeat("compressible message payload, ", 10))
+
+	for _, tc := range []struct {
+		close  []byte
+		status Status
+	}{
+		{maskedFrameBytes(FrameClose, []byte("\x03\xe9bye"), true), StatusGoingAway},
+		{maskedFrameBytes(FrameClose, []byte{0x03, 0xe8}, true), StatusOK},
+	} {
+		var in FakeConn
+
+		w := &Conn{Conn: &in, client: 1}
+		w.setCompression(&CompressionParams{})
+
+		first, _ := compressedFragments(t, w, msg)
+		first()
+
+		in.b = append(in.b, tc.close...)
+
+		var out FakeConn
+
+		r := &Conn{Conn: &splitConn{r: bytes.NewReader(in.b), w: &out}}
+		r.setCompression(&CompressionParams{})
+
+		_, _, err := r.ReadMessage(ctx)
+		if !errors.Is(err, ErrClosed) || CloseStatus(err) != tc.status {
+			t.Errorf("%v: read message: %v (status %v)", tc.status, err, CloseStatus(err))
+		}
+
+		// no protocol error close frame is sent in reply
+		if bytes.Contains(out.b, []byte{0x03, 0xea}) {
+			t.Errorf("%v: unexpected reply: % x", tc.status, out.b)
+		}
+	}
+}
+
+func TestCompressionInvalidText(t *testing.T) {
+	valid := []byte(strings.Repeat("сжимаемый текст ", 10))
+	invalid := []byte(strings.Repeat("compressible text ", 10) + "\xff")
+
+	for _, tc := range []struct {
+		name string
+		read func(c *Conn) error
+	}{
+		{"ReadMessage", func(c *Conn) error {
+			_, _, err := c.ReadMessage(context.Background())
+			return err
+		}},
+		{"Read", func(c *Conn) (err error) {
+			for err == nil {
+				_, err = c.Read(make([]byte, 10))
+			}
+
+			return err
+		}},
+		{"ReadTo", func(c *Conn) error {
+			_, _, err := c.ReadTo(context.Background(), io.Discard)
+			return err
+		}},
+	} {
+		var in FakeConn
+
+		w := &Conn{Conn: &in, client: 1}
+		w.setCompression(&CompressionParams{})
+
+		for _, msg := range [][]byte{valid, invalid} {
+			first, rest := compressedFragments(t, w, msg)
+			first()
+			rest()
+		}
+
+		var out FakeConn
+
+		r := &Conn{Conn: &splitConn{r: bytes.NewReader(in.b), w: &out}}
+		r.setCompression(&CompressionParams{})
+
+		// ReadMessage and ReadTo return the valid message first, Read reads through it
+		err := tc.read(r)
+		if tc.name != "Read" {
+			if err != nil {
+				t.Errorf("%s: valid message: %v", tc.name, err)
+			}
+
+			err = tc.read(r)
+		}
+
+		if !errors.Is(err, StatusFormat) {
+			t.Errorf("%s: expected %v, got %v", tc.name, StatusFormat, err)
+		}
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		server, client *CompressionParams
+		exp            *CompressionParams
+	}{
+		{nil, &CompressionParams{}, nil},
+		{&CompressionParams{}, nil, nil},
+		{&CompressionParams{}, &CompressionParams{}, &CompressionParams{}},
+		{&CompressionParams{ServerNoContextTakeover: true}, &CompressionParams{ClientNoContextTakeover: true},
+			&CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}},
+		{&CompressionParams{}, &CompressionParams{ServerMaxWindowBits: 15}, &CompressionParams{ServerMaxWindowBits: 15}},
+		{&CompressionParams{}, &CompressionParams{ServerMaxWindowBits: 10}, nil},
+		{&CompressionParams{ServerMaxWindowBits: 9}, &CompressionParams{}, nil},
+		{&CompressionParams{}, &CompressionParams{ClientMaxWindowBits: 15}, &CompressionParams{}},
+		{&CompressionParams{}, &CompressionParams{ClientMaxWindowBits: 10}, &CompressionParams{}},
+		{&CompressionParams{ClientNoContextTakeover: true}, &CompressionParams{ClientMaxWindowBits: 8},
+			&CompressionParams{ClientNoContextTakeover: true}},
+	} {
+		t.Run(fmt.Sprintf("%v_%v", tc.server, tc.client), func(t *testing.T) {
+			s := &Server{
+				Compression: tc.server,
+				Handler: func(ctx context.Context, c *Conn) error {
+					p, ok := c.CompressionParams()
+					if ok != (tc.exp != nil) || ok && p != *tc.exp {
+						t.Errorf("server params: %+v %v", p, ok)
+					}
+
+					for {
+						op, data, err := c.ReadMessage(ctx)
+						if errors.Is(err, io.EOF) {
+							return nil
+						}
+						if err != nil {
+							return err
+						}
+
+						err = c.WriteMessage(op, data)
+						if err != nil {
+							return err
+						}
+					}
+				},
+			}
+
+			hs := httptest.NewServer(s)
+			defer hs.Close()
+
+			cl := Client{Compression: tc.client}
+
+			c, err := cl.DialContext(ctx, hs.URL)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+
+			defer c.Close()
+
+			p, ok := c.CompressionParams()
+			if ok != (tc.exp != nil) || ok && p != *tc.exp {
+				t.Errorf("client params: %+v %v", p, ok)
+			}
+
+			for i := range 3 {
+				msg := fmt.Appendf(nil, "message %d %s", i, strings.Repeat("echo ", 50))
+
+				err = c.WriteMessage(FrameText, msg)
+				if err != nil {
+					t.Fatalf("write: %v", err)
+				}
+
+				_, data, err := c.ReadMessage(ctx)
+				if err != nil || !bytes.Equal(data, msg) {
+					t.Fatalf("read: %q %v", data, err)
+				}
+			}
+
+			err = c.CloseWriter(StatusOK)
+			if err != nil {
+				t.Errorf("close writer: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseCompressionParams(t *testing.T) {
+	for _, tc := range []struct {
+		ext string
+		exp CompressionParams
+		err bool
+	}{
+		{ext: "permessage-deflate"},
+		{ext: "permessage-deflate; server_no_context_takeover", exp: CompressionParams{ServerNoContextTakeover: true}},
+		{ext: "permessage-deflate;client_no_context_takeover ; server_no_context_takeover",
+			exp: CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}},
+		{ext: "permessage-deflate; server_no_context_takeover; server_no_context_takeover", err: true},
+		{ext: "permessage-deflate; client_no_context_takeover=1", err: true},
+		{ext: "permessage-deflate; unknown", err: true},
+		{ext: "permessage-deflate; server_max_window_bits=10", exp: CompressionParams{ServerMaxWindowBits: 10}},
+		{ext: `permessage-deflate; server_max_window_bits = "8"; client_max_window_bits=15`,
+			exp: CompressionParams{ServerMaxWindowBits: 8, ClientMaxWindowBits: 15}},
+		{ext: "permessage-deflate; client_max_window_bits", exp: CompressionParams{ClientMaxWindowBits: 15}},
+		{ext: "permessage-deflate; client_max_window_bits=9; client_no_context_takeover",
+			exp: CompressionParams{ClientMaxWindowBits: 9, ClientNoContextTakeover: true}},
+		{ext: "permessage-deflate; server_max_window_bits", err: true},
+		{ext: "permessage-deflate; server_max_window_bits=7", err: true},
+		{ext: "permessage-deflate; server_max_window_bits=16", err: true},
+		{ext: "permessage-deflate; server_max_window_bits=010", err: true},
+		{ext: "permessage-deflate; client_max_window_bits=", err: true},
+		{ext: "permessage-deflate; client_max_window_bits=12; client_max_window_bits=12", err: true},
+	} {
+		p, err := parseCompressionParams(tc.ext)
+		if (err != nil) != tc.err || err == nil && p != tc.exp {
+			t.Errorf("%q: %+v %v", tc.ext, p, err)
+		}
+		if err != nil && !errors.Is(err, ErrCompressionParams) {
+			t.Errorf("%q: unexpected error: %v", tc.ext, err)
+		}
+
+		if err == nil {
+			if q, _ := parseCompressionParams(p.String()); q != p {
+				t.Errorf("%q: round trip: %+v", tc.ext, q)
+			}
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1, CompressionThreshold: 10}
+	r := &Conn{Conn: &f}
+
+	w.setCompression(&CompressionParams{})
+	r.setCompression(&CompressionParams{})
+
+	for _, tc := range []struct {
+		size       int
+		compressed bool
+	}{
+		{0, false},
+		{9, false},
+		{10, true},
+		{11, true},
+		{1, false},
+	} {
+		msg := bytes.Repeat([]byte{'a'}, tc.size)
+		st := len(f.b)
+
+		err := w.WriteMessage(FrameBinary, msg)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		if compressed := f.b[st]&rsvDeflate != 0; compressed != tc.compressed {
+			t.Errorf("size %d: compressed %v, expected %v", tc.size, compressed, tc.compressed)
+		}
+
+		_, p, err := r.ReadMessage(ctx)
+		if err != nil || !bytes.Equal(p, msg) {
+			t.Errorf("size %d: read: %q %v", tc.size, p, err)
+		}
+	}
+}
+
+func TestCompressionEmptyMessage(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	w.setCompression(&CompressionParams{})
+	r.setCompression(&CompressionParams{})
+
+	err := w.WriteMessage(FrameText, nil)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// zero length compressed frames are not produced by us but allowed from peers
+	f.b = append(f.b, maskedFrameBytes(FrameText, nil, true)...)
+	f.b[len(f.b)-6] |= rsvDeflate
+
+	f.b = append(f.b, maskedFrameBytes(FrameBinary, nil, false)...)
+	f.b[len(f.b)-6] |= rsvDeflate
+	f.b = append(f.b, maskedFrameBytes(FrameContinue, nil, true)...)
+
+	for i, op := range []Opcode{FrameText, FrameText, FrameBinary} {
+		rop, p, err := r.ReadMessage(ctx)
+		if err != nil || rop != op || len(p) != 0 {
+			t.Errorf("message %d: %v %q %v", i, rop, p, err)
+		}
+	}
+
+	// the context is kept after empty messages
+	msg := []byte("message after the empty ones")
+
+	err = w.WriteMessage(FrameText, msg)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	_, p, err := r.ReadMessage(ctx)
+	if err != nil || !bytes.Equal(p, msg) {
+		t.Errorf("read: %q %v", p, err)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	ctx := context.Background()
+	msg := []byte(strings.Repeat(`{"id":12345,"name":"compressible","tags":["a","b","c"]}`, 50))
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	w.setCompression(&CompressionParams{})
+	r.setCompression(&CompressionParams{})
+
+	for _, level := range []int{flate.HuffmanOnly - 1, flate.BestCompression + 1} {
+		err := w.SetCompressionLevel(level)
+		if !errors.Is(err, ErrCompressionLevel) {
+			t.Errorf("level %d: expected invalid level, got %v", level, err)
+		}
+	}
+
+	sizes := map[int]int{}
+
+	// the level is changed between messages with the context kept by the reader
+	for _, level := range []int{flate.DefaultCompression, flate.NoCompression, flate.HuffmanOnly, flate.BestSpeed, flate.BestCompression, flate.DefaultCompression} {
+		err := w.SetCompressionLevel(level)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+
+		st := len(f.b)
+
+		err = w.WriteMessage(FrameText, msg)
+		if err != nil {
+			t.Fatalf("level %d: write: %v", level, err)
+		}
+
+		sizes[level] = len(f.b) - st
+
+		_, data, err := r.ReadMessage(ctx)
+		if err != nil || !bytes.Equal(data, msg) {
+			t.Fatalf("level %d: read: %v", level, err)
+		}
+	}
+
+	if !(sizes[flate.NoCompression] > len(msg) && sizes[flate.HuffmanOnly] < len(msg) &&
+		sizes[flate.BestSpeed] < sizes[flate.HuffmanOnly] && sizes[flate.BestCompression] <= sizes[flate.BestSpeed]) {
+		t.Errorf("message %d bytes, compressed sizes by level: %v", len(msg), sizes)
+	}
+
+	// no compression negotiated
+	c := &Conn{Conn: &f}
+
+	err := c.SetCompressionLevel(flate.BestSpeed)
+	if err != nil {
+		t.Errorf("set level without compression: %v", err)
+	}
+}
+
+func BenchmarkCompressionLevel(b *testing.B) {
+	var msg []byte
+	for i := range 200 {
+		msg = fmt.Appendf(msg, `{"id":%d,"name":"user%d","score":%d,"tags":["a","b"]}`, i, i*7, i*i%1000)
+	}
+
+	for _, level := range []int{flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		b.Run(fmt.Sprintf("level=%v", level), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+
+			w := &Conn{Conn: &splitConn{w: io.Discard}, client: 1}
+			w.setCompression(&CompressionParams{})
+
+			err := w.SetCompressionLevel(level)
+			if err != nil {
+				b.Fatalf("set level: %v", err)
+			}
+
+			for b.Loop() {
+				err = w.WriteMessage(FrameText, msg)
+				if err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionResponseWindowBits(t *testing.T) {
+	for _, tc := range []struct {
+		offered, accepted string
+		err               bool
+	}{
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate; client_max_window_bits=15", false},
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate; client_max_window_bits=10", true},
+		{"permessage-deflate; client_max_window_bits=10", "permessage-deflate", false},
+		{"permessage-deflate; client_max_window_bits=10", "permessage-deflate; client_max_window_bits=10", true},
+		{"permessage-deflate", "permessage-deflate; client_max_window_bits=15", true},
+		{"permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=9", false},
+		{"permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=12", true},
+		{"permessage-deflate; server_max_window_bits=10", "permessage-deflate", true},
+		{"permessage-deflate", "permessage-deflate; server_max_window_bits=8", false},
+	} {
+		_, err := compressionResponse([]string{tc.offered}, []string{tc.accepted})
+		if (err != nil) != tc.err {
+			t.Errorf("offered %q accepted %q: %v", tc.offered, tc.accepted, err)
+		}
+		if err != nil && !errors.Is(err, ErrCompressionParams) {
+			t.Errorf("offered %q accepted %q: unexpected error: %v", tc.offered, tc.accepted, err)
+		}
+	}
+}
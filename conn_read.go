@@ -1,30 +1,116 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 type (
+	// Conn is a websocket connection.
+	//
+	// It supports one reader and one writer goroutine running concurrently.
+	// Read methods (Read, NextFrame, ReadMessage, Frame methods, and so on) are serialized
+	// by one mutex and write methods by another, so two concurrent readers
+	// don't corrupt the state but the order in which they get frames is undefined.
+	// Frame returned by NextFrame must be read by the same goroutine before the next read call.
+	//
+	// Control frames are written under the same write lock as data frames,
+	// so they are never interleaved with a data frame being written.
+	// Replies sent by the reader (automatic pongs, close frame on protocol errors)
+	// don't wait for the lock though. They are queued and written by the writer
+	// after its current frame, so a writer blocked on a slow connection doesn't stall reading.
+	// Only the latest pong is kept in the queue.
+	// Deadline setters are safe to call from any goroutine.
 	Conn struct {
 		net.Conn
 
+		// MaxMessageSize limits the size of messages read as a whole, as in ReadJSON.
+		// Exceeding it fails the connection with StatusTooBig.
+		// Zero means no limit.
+		MaxMessageSize int
+
+		// AllowUnmaskedFromClient disables the server side check that all client frames are masked.
+		// Client side always rejects masked frames.
+		AllowUnmaskedFromClient bool
+
+		// ReservedBits are RSV bits (see HeaderBits.RSV) claimed by the negotiated extensions.
+		// Frames with other RSV bits set are rejected with StatusProtocol.
+		ReservedBits byte
+
+		// ReadBufferSize is the initial read buffer size, defaultReadBufSize if zero.
+		// It's limited from below by minReadBufSize.
+		ReadBufferSize int
+
+		// MaxReadBufferSize enables the read buffer to grow up to this size
+		// if frames routinely don't fit into it. Zero disables growth.
+		MaxReadBufferSize int
+
+		// WriteBufferSize is the initial write buffer capacity.
+		// The buffer grows to fit frames anyway.
+		// It's also the size buffered frames are flushed at, see SetWriteBuffering.
+		WriteBufferSize int
+
+		// CompressionThreshold is the minimal message size to compress if permessage-deflate is negotiated.
+		// Smaller messages are sent uncompressed as deflate would likely enlarge them.
+		// Zero compresses all the messages.
+		CompressionThreshold int
+
+		// WriteTimeout bounds each write call: Write, WriteFrame, WriteMessage, Flush, Close, and so on.
+		// A write not finished in time fails with an error wrapping os.ErrDeadlineExceeded,
+		// so a handler writing to a dead peer doesn't hang forever.
+		// The earlier of the timeout and the write deadline is used. Zero disables the timeout.
+		// The connection is broken for writing if the frame was written partially.
+		// Pongs and close frames sent in reply by the reader are bounded as well,
+		// their write errors are reported by the following writes and Close.
+		WriteTimeout time.Duration
+
+		// MaskKey generates masking keys for client frames.
+		// crypto/rand is used if nil. Fixed keys are only useful for tests.
+		MaskKey func() [4]byte
+
 		client byte
 
+		subprotocol string
+		extensions  []string
+		req         *http.Request // server handshake request
+
+		laddr, raddr net.Addr // captured at the handshake
+
 		writerClosed bool
 		readerClosed bool
+		closeErr     error  // the reason the reader is closed, returned by message reads after that
+		closeRecv    bool   // close frame received
+		fragmented   bool   // data message continuation expected
+		msgOp        Opcode // opcode of the data message being read
+		rerr         error  // a message read was interrupted, the reading side is broken
 
-		wmu  sync.Mutex
-		wbuf []byte
+		wmu       writeLock
+		wbuf      []byte
+		werr      error // connection is broken for writing
+		wbuffered bool  // data frames are kept in wbuf until Flush
 
-		//	rmu  sync.Mutex
+		// control frame queued by the reader, see queueControl
+		qmu    sync.Mutex
+		qop    Opcode
+		qlen   int
+		qbuf   [maxLen7]byte
+		queued atomic.Bool
+
+		pool BufferPool
+
+		rmu      sync.Mutex
+		rrelease atomic.Bool // Close asked to return rbuf to the pool, see releaseBuffers
 
 		rbuf []byte
 
@@ -37,29 +123,245 @@ type (
 		more  int // more bytes to read in frame
 
 		// end of rmu
+
+		rdead, wdead deadline     // user set deadlines
+		idle         atomic.Int64 // idle timeout in ns
+
+		pingHandler func([]byte) error
+		pongHandler func([]byte) error
+
+		cancel context.CancelCauseFunc // Server.Handler context, canceled when reading ends
+
+		pmu     sync.Mutex
+		pingTag [8]byte // random prefix of Ping payloads
+		pingID  uint64
+		pings   []pingWaiter // outstanding Ping calls in id order
+		pingErr error        // pongs can't be received anymore
+
+		ctrl [maxLen7]byte // control frame payload
+
+		bigFrames int // consecutive frames not fitting into rbuf
+
+		deflate   *deflateState // permessage-deflate state if negotiated
+		inflating bool          // compressed message is being read
+
+		text utf8State // validation state of the text message being read
+
+		stats connStats
 	}
 
+	// Frame is a frame returned by NextFrame or NextRawFrame.
 	Frame struct {
 		Opcode Opcode
 		Length int
 		Final  bool
 
+		// Compressed is set on the first frame of a permessage-deflate compressed message.
+		// Frame methods return the payload as is, use ReadMessage, ReadTo, or Read to get it decompressed.
+		// Reading compressed messages by frames breaks decompression of the following messages
+		// unless the peer resets its compressor after each message.
+		Compressed bool
+
 		c *Conn
 	}
+
+	pingWaiter struct {
+		id uint64
+		ch chan error // nil on pong
+	}
 )
 
 const (
-	defaultReadBufSize = 0x1000
-	minReadBufSize     = 0x20
+	defaultReadBufSize  = 0x1000
+	defaultWriteBufSize = 0x1000 // buffered frames flush threshold
+	minReadBufSize      = 0x20
+
+	growReadBufAfter = 4 // consecutive big frames to grow the read buffer
+
+	pingPayloadSize = 16 // Ping tag and sequence number
+
+	writevMinSize = 0x1000 // payload size to write without copying it into wbuf
+	writeFromSize = 0x8000 // WriteFrom fragment size if there is no BufferPool
+
+	maxConsecutiveEmptyReads = 100 // WriteFrom gives up on a reader making no progress
 )
 
+// LocalAddr returns the local address captured at the handshake,
+// so it's available even if Conn.Conn is replaced with a wrapper.
+// The underlying connection address is returned if the Conn is created directly.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.laddr != nil {
+		return c.laddr
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// RemoteAddr is the same as LocalAddr but for the remote address.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// IsClient reports whether the connection is the client side,
+// which masks its frames and expects unmasked ones from the peer.
+func (c *Conn) IsClient() bool {
+	return c.client != 0
+}
+
+// IsServer reports whether the connection is the server side.
+func (c *Conn) IsServer() bool {
+	return c.client == 0
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Request returns the handshake request the connection was accepted with.
+// Its Body is already closed and replaced with http.NoBody.
+// It's nil for client connections.
+func (c *Conn) Request() *http.Request {
+	return c.req
+}
+
+// NegotiatedExtensions returns the extensions agreed on during the handshake.
+func (c *Conn) NegotiatedExtensions() []string {
+	return c.extensions
+}
+
+// SetDeadline is the same as calling SetReadDeadline and SetWriteDeadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rdead.Store(t)
+	c.wdead.Store(t)
+
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+// Unlike calling it on the embedded net.Conn directly
+// the deadline is restored after context cancellation in ReadContext.
+//
+// Read interrupted by the deadline returns an error wrapping os.ErrDeadlineExceeded.
+// Partially read frame is not lost and can be continued after the deadline is extended.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rdead.Store(t)
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetIdleTimeout makes reads fail with a timeout error
+// if nothing is received from the peer for d.
+// Only received data counts as activity, so a ping or pong from the peer resets the timer,
+// while frames sent by us, including our own pings, do not.
+// To keep a healthy but quiet connection open send pings more often than d,
+// so that the peer pongs reset the timer.
+// The earlier of the idle and the read deadline is used. Zero d disables the timeout.
+func (c *Conn) SetIdleTimeout(d time.Duration) error {
+	c.idle.Store(int64(d))
+
+	if d != 0 {
+		c.stats.lastRead.CompareAndSwap(0, time.Now().UnixNano())
+	}
+
+	return c.setReadDeadline(time.Time{})
+}
+
+func (c *Conn) setReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		t = c.readDeadline()
+	}
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// armIdle moves the read deadline forward according to the idle timeout before reading.
+func (c *Conn) armIdle() error {
+	if c.idle.Load() == 0 {
+		return nil
+	}
+
+	err := c.setReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("set idle deadline: %w", err)
+	}
+
+	return nil
+}
+
+// readDeadline returns the user read deadline limited by the idle timeout.
+func (c *Conn) readDeadline() time.Time {
+	t := c.rdead.Load()
+
+	idle := c.idle.Load()
+	if idle == 0 {
+		return t
+	}
+
+	it := time.Unix(0, c.stats.lastRead.Load()+idle)
+
+	if t.IsZero() || it.Before(t) {
+		return it
+	}
+
+	return t
+}
+
+// MessageOpcode returns the opcode of the first frame of the data message being read,
+// FrameText or FrameBinary. Continuation frames returned by NextFrame have FrameContinue opcode,
+// this is how to know the type of the message they belong to.
+// Interleaved control frames don't change it.
+// The value is kept after the message is finished and is zero before the first message.
+// It waits for the read lock, so calling it concurrently with a blocked read blocks too.
+func (c *Conn) MessageOpcode() Opcode {
+	defer c.unlockRead()
+	c.rmu.Lock()
+
+	return c.msgOp
+}
+
+// SetPingHandler sets the handler called with received ping payloads.
+// The handler is responsible for replying with pong, for example using WritePong.
+// Pings are replied automatically if the handler is nil.
+// The payload must not be retained after the handler returns.
+// The handler is called from the reading goroutine, the error is returned from the read.
+// It must not be called concurrently with reads.
+func (c *Conn) SetPingHandler(h func(payload []byte) error) {
+	c.pingHandler = h
+}
+
+// SetPongHandler sets the handler called with received pong payloads,
+// both unsolicited and replying to Ping.
+// Pongs are read and discarded if the handler is nil,
+// they reset the idle timeout either way.
+// The payload must not be retained after the handler returns.
+// The handler is called from the reading goroutine, the error is returned from the read,
+// so the connection can be failed on unexpected pongs.
+// It must not be called concurrently with reads.
+func (c *Conn) SetPongHandler(h func(payload []byte) error) {
+	c.pongHandler = h
+}
+
+// Read reads data frames payload skipping control frames.
+// p doesn't need to fit the whole frame, the rest is returned by the following calls.
+// Frame and message boundaries are not preserved, use NextFrame or ReadMessage for that.
+// Compressed messages are decompressed.
+// Text is validated as it's read, invalid UTF-8 fails the connection with StatusFormat.
+// Empty frames result in zero reads, StreamConn skips them.
 func (c *Conn) Read(p []byte) (n int, err error) {
 	return c.ReadContext(nil, p)
 }
 
+// ReadContext is the same as Read but interrupts the read if ctx is canceled.
+// ctx may be nil, which is what Read does, then only deadlines stop the read.
+// The same is true for all the methods taking ctx.
 func (c *Conn) ReadContext(ctx context.Context, p []byte) (n int, err error) {
-	//	defer c.rmu.Unlock()
-	//	c.rmu.Lock()
+	defer c.unlockRead()
+	c.rmu.Lock()
 
 	//	defer func(f dbgfn) {
 	//		f(n, err)
@@ -70,6 +372,15 @@ func (c *Conn) ReadContext(ctx context.Context, p []byte) (n int, err error) {
 		return 0, err
 	}
 
+	if c.inflating {
+		n, err = c.inflate(ctx, p)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+
+		return n, err
+	}
+
 	n, err = c.readFrame(ctx, p)
 	if errors.Is(err, io.EOF) {
 		err = nil
@@ -79,7 +390,7 @@ func (c *Conn) ReadContext(ctx context.Context, p []byte) (n int, err error) {
 }
 
 func (c *Conn) waitForDataFrame(ctx context.Context) error {
-	if c.more != 0 {
+	if c.more != 0 || c.inflating {
 		return nil
 	}
 
@@ -88,12 +399,20 @@ func (c *Conn) waitForDataFrame(ctx context.Context) error {
 		return err
 	}
 
+	c.startInflate(ctx)
+
 	return nil
 }
 
+// NextFrame reads the next data frame header handling control frames met before it.
+// The frame payload is read with Frame methods until More returns 0.
+// Unread payload is skipped by the next NextFrame call.
+// Frame is only valid until the next call reading from the Conn.
+// Uncompressed text frames are validated as they are read, an incomplete rune
+// may continue in the next frame, invalid UTF-8 fails the connection with StatusFormat.
 func (c *Conn) NextFrame(ctx context.Context) (Frame, error) {
-	//	defer c.rmu.Unlock()
-	//	c.rmu.Lock()
+	defer c.unlockRead()
+	c.rmu.Lock()
 
 	op, l, fin, err := c.readDataFrameHeader(ctx)
 	if err != nil {
@@ -105,15 +424,19 @@ func (c *Conn) NextFrame(ctx context.Context) (Frame, error) {
 		Length: l,
 		Final:  fin,
 
+		Compressed: c.deflate != nil && c.header.RSV()&rsvDeflate != 0,
+
 		c: c,
 	}
 
 	return f, nil
 }
 
+// NextRawFrame is the same as NextFrame but returns control frames as well
+// leaving them to the caller to process.
 func (c *Conn) NextRawFrame(ctx context.Context) (Frame, error) {
-	//	defer c.rmu.Unlock()
-	//	c.rmu.Lock()
+	defer c.unlockRead()
+	c.rmu.Lock()
 
 	op, l, fin, err := c.readFrameHeader(ctx)
 	if err != nil {
@@ -125,12 +448,221 @@ func (c *Conn) NextRawFrame(ctx context.Context) (Frame, error) {
 		Length: l,
 		Final:  fin,
 
+		Compressed: c.deflate != nil && c.header.RSV()&rsvDeflate != 0,
+
 		c: c,
 	}
 
 	return f, nil
 }
 
+// ReadMessage reads the whole message joining its fragments.
+// Returned opcode is the opcode of the first frame.
+// MaxMessageSize is respected, for compressed messages it limits the decompressed size.
+// The connection is failed with StatusTooBig if it's exceeded.
+// Text messages with invalid UTF-8 fail the connection with StatusFormat.
+// Empty messages are returned with nil error and empty data.
+//
+// Each complete message is returned with nil error.
+// Once the close frame is received, or the connection is failed on a protocol violation,
+// this and all the following calls return an error wrapping ErrClosed and the close status.
+// The clean close error also wraps io.EOF, as do the errors of the following calls.
+// An error not wrapping ErrClosed means the connection ended without the close frame
+// or the read was interrupted.
+//
+// A read interrupted by a deadline or ctx before the first frame header is read can be retried.
+// The message data read is lost if it's interrupted after that,
+// so the following message reads fail with an error wrapping ErrReadInterrupted.
+// Read and NextFrame still return the rest of the stream.
+func (c *Conn) ReadMessage(ctx context.Context) (op Opcode, data []byte, err error) {
+	defer c.unlockRead()
+	c.rmu.Lock()
+
+	op, data, err = c.appendMessage(ctx, nil)
+
+	return op, data, c.closedErr(err)
+}
+
+// closedErr wraps the reason the reading side is closed into closedError.
+// err is returned as is if the reader is not closed.
+func (c *Conn) closedErr(err error) error {
+	if err == nil || !c.readerClosed {
+		return err
+	}
+
+	if c.closeErr == nil || err == c.closeErr { //nolint:errorlint
+		return &closedError{err: err}
+	}
+
+	return &closedError{err: c.closeErr, eof: errors.Is(err, io.EOF)}
+}
+
+// ReadTo streams the whole message payload into w using the read buffer,
+// so the message is never accumulated in memory.
+// Returned opcode is the opcode of the first frame.
+// Unlike ReadMessage, MaxMessageSize is not respected.
+// Text is validated as it's streamed, invalid UTF-8 fails the connection with StatusFormat,
+// but the data before the invalid bytes may already be written to w.
+// Compressed messages are decompressed.
+// Interrupted reads break the reading side as they do for ReadMessage.
+func (c *Conn) ReadTo(ctx context.Context, w io.Writer) (n int64, op Opcode, err error) {
+	defer c.unlockRead()
+	c.rmu.Lock()
+
+	if c.rerr != nil {
+		return 0, 0, c.rerr
+	}
+
+	started := false
+
+	defer func() {
+		if err != nil && started {
+			err = c.interrupted(err)
+		}
+	}()
+
+	for first := true; ; first = false {
+		fop, _, fin, err := c.readDataFrameHeader(ctx)
+		if err != nil {
+			return n, op, err
+		}
+
+		started = true
+
+		if first {
+			op = c.messageOpcode(fop)
+
+			if c.startInflate(ctx) {
+				n, err = io.Copy(w, inflateReader{c: c, ctx: ctx})
+				return n, op, err
+			}
+		}
+
+		m, err := c.copyFrame(ctx, w)
+		n += m
+		if err != nil {
+			return n, op, err
+		}
+
+		if fin {
+			return n, op, nil
+		}
+	}
+}
+
+// copyFrame writes the rest of the frame payload to w.
+func (c *Conn) copyFrame(ctx context.Context, w io.Writer) (n int64, err error) {
+	for c.more != 0 {
+		if c.i >= c.end {
+			nread, err := c.read(ctx)
+			if nread == 0 && err != nil {
+				return n, unexpectedEOF(err)
+			}
+
+			continue
+		}
+
+		end := min(c.end, c.i+c.more)
+		p := c.rbuf[c.i:end]
+
+		maskBuf(p, c.key, c.i-c.start)
+		c.i = end
+		c.more -= len(p)
+
+		err := c.validateText(p)
+		if err != nil {
+			return n, err
+		}
+
+		m, err := w.Write(p)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (c *Conn) appendMessage(ctx context.Context, b []byte) (op Opcode, _ []byte, err error) {
+	if c.rerr != nil {
+		return 0, b, c.rerr
+	}
+
+	st := len(b)
+	started := false
+
+	defer func() {
+		if err != nil && started {
+			err = c.interrupted(err)
+		}
+	}()
+
+	for first := true; ; first = false {
+		fop, l, fin, err := c.readDataFrameHeader(ctx)
+		if err != nil {
+			return op, b, err
+		}
+
+		started = true
+
+		if first {
+			op = c.messageOpcode(fop)
+
+			if c.startInflate(ctx) {
+				b, err = c.appendInflated(ctx, b, st)
+				if err != nil {
+					return op, b, err
+				}
+
+				break
+			}
+		}
+
+		if c.MaxMessageSize != 0 && len(b)-st+l > c.MaxMessageSize {
+			return op, b, c.fail(StatusTooBig)
+		}
+
+		b, err = c.appendFrame(ctx, b, l)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		if err != nil {
+			return op, b, err
+		}
+
+		if fin {
+			break
+		}
+	}
+
+	return op, b, nil
+}
+
+// messageOpcode returns the opcode of the message the frame with op belongs to.
+// The message may have been started by Read or NextFrame.
+func (c *Conn) messageOpcode(op Opcode) Opcode {
+	if op == FrameContinue {
+		return c.msgOp
+	}
+
+	return op
+}
+
+// interrupted breaks message reads if a message read failed after it started
+// as the data read so far is lost and the rest of the message can't be returned as a message.
+// Read and NextFrame still work as frames are kept in sync.
+// Closed reader errors are returned as is.
+func (c *Conn) interrupted(err error) error {
+	if c.readerClosed || c.rerr != nil {
+		return err
+	}
+
+	c.rerr = fmt.Errorf("%w: %v", ErrReadInterrupted, err)
+
+	return err
+}
+
 func (c *Conn) readDataFrameHeader(ctx context.Context) (op Opcode, l int, fin bool, err error) {
 	for {
 		op, l, fin, err = c.readFrameHeader(ctx)
@@ -142,26 +674,59 @@ func (c *Conn) readDataFrameHeader(ctx context.Context) (op Opcode, l int, fin b
 		case FrameContinue, FrameText, FrameBinary:
 			return op, l, fin, nil
 		case FramePing:
-			err = c.processPing()
+			h := c.pingHandler
+			if h == nil {
+				h = c.autoPong
+			}
+
+			err = c.handleControl(ctx, h)
 			if err != nil {
 				return op, 0, false, err
 			}
 		case FramePong:
+			err = c.handleControl(ctx, c.handlePong)
+			if err != nil {
+				return op, 0, false, err
+			}
 		case FrameClose:
 			return op, 0, false, c.processClose(ctx)
 		default:
-			return op, 0, false, errors.New("invalid frame")
+			return op, 0, false, c.fail(StatusProtocol)
 		}
 	}
 }
 
+// handleControl reads control frame payload and calls h with it.
+func (c *Conn) handleControl(ctx context.Context, h func([]byte) error) error {
+	p, err := c.appendFrame(ctx, c.ctrl[:0], c.more)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return h(p)
+}
+
+// handlePong completes Ping calls waiting for p and calls the pong handler.
+func (c *Conn) handlePong(p []byte) error {
+	if len(p) == pingPayloadSize {
+		c.completePings(p)
+	}
+
+	if c.pongHandler == nil {
+		return nil
+	}
+
+	return c.pongHandler(p)
+}
+
 func (c *Conn) readFrameHeader(ctx context.Context) (op Opcode, l int, fin bool, err error) {
 	if c.readerClosed {
 		return 0, 0, true, io.EOF
 	}
 
-	if c.more != 0 {
-		c.i += c.more
+	err = c.skipFrame(ctx)
+	if err != nil {
+		return 0, 0, false, err
 	}
 
 	c.st = c.i
@@ -172,10 +737,53 @@ func (c *Conn) readFrameHeader(ctx context.Context) (op Opcode, l int, fin bool,
 		//	log.Printf("rbuf\n%s", hex.Dump(c.rbuf[:c.end]))
 		if i > 0 {
 			c.header = h
+
+			if l < 0 {
+				return h.Opcode(), 0, h.Fin(), c.fail(lenStatus(c.rbuf, c.st+2))
+			}
+
 			c.start = i
 			c.more = l
 			c.i = i
 
+			if !h.Masked() {
+				c.key = [4]byte{}
+			}
+
+			c.adaptReadBuf(l)
+
+			c.stats.frame(h.Opcode(), h.Fin(), true)
+
+			if c.client != 0 && h.Masked() || c.client == 0 && !h.Masked() && !c.AllowUnmaskedFromClient {
+				return h.Opcode(), l, h.Fin(), c.fail(StatusProtocol)
+			}
+
+			if h.RSV()&^c.ReservedBits != 0 {
+				return h.Opcode(), l, h.Fin(), c.fail(StatusProtocol)
+			}
+
+			// compressed bit is only allowed on the first frame of a data message
+			if c.deflate != nil && h.RSV()&rsvDeflate != 0 && h.Opcode() != FrameText && h.Opcode() != FrameBinary {
+				return h.Opcode(), l, h.Fin(), c.fail(StatusProtocol)
+			}
+
+			if !h.IsDataFrame() && (!h.Fin() || l > maxLen7) {
+				return h.Opcode(), l, h.Fin(), c.fail(StatusProtocol)
+			}
+
+			if op := h.Opcode(); op == FrameContinue || op == FrameText || op == FrameBinary {
+				if (op == FrameContinue) != c.fragmented {
+					return op, l, h.Fin(), c.fail(StatusProtocol)
+				}
+
+				c.fragmented = !h.Fin()
+
+				if op != FrameContinue {
+					c.msgOp = op
+					c.text = utf8State{skip: c.deflate != nil && h.RSV()&rsvDeflate != 0}
+				}
+			}
+
 			return h.Opcode(), l, h.Fin(), nil
 		}
 
@@ -189,39 +797,85 @@ func (c *Conn) readFrameHeader(ctx context.Context) (op Opcode, l int, fin bool,
 	}
 }
 
+// skipFrame discards the rest of the current frame.
+func (c *Conn) skipFrame(ctx context.Context) error {
+	if c.more != 0 && c.header.IsDataFrame() {
+		c.text.skip = true
+	}
+
+	for c.more != 0 {
+		if c.i < c.end {
+			m := min(c.more, c.end-c.i)
+			c.i += m
+			c.more -= m
+
+			continue
+		}
+
+		n, err := c.read(ctx)
+		if n == 0 && err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read reads the frame payload. io.EOF is returned at the end of the frame,
+// possibly along with the last bytes. Empty frames return 0, io.EOF right away.
 func (f Frame) Read(p []byte) (n int, err error) {
-	//	defer f.c.rmu.Unlock()
-	//	f.c.rmu.Lock()
+	defer f.c.unlockRead()
+	f.c.rmu.Lock()
 
 	return f.c.readFrame(nil, p)
 }
 
+// ReadContext is the same as Read but interrupts the read if ctx is canceled.
+// The frame can be continued to be read after that.
 func (f Frame) ReadContext(ctx context.Context, p []byte) (n int, err error) {
-	//	defer f.c.rmu.Unlock()
-	//	f.c.rmu.Lock()
+	defer f.c.unlockRead()
+	f.c.rmu.Lock()
 
-	return f.c.readFrame(nil, p)
+	return f.c.readFrame(ctx, p)
 }
 
+// ReadAppendTo appends the rest of the frame payload to b.
 func (f Frame) ReadAppendTo(ctx context.Context, b []byte) ([]byte, error) {
-	//	defer f.c.rmu.Unlock()
-	//	f.c.rmu.Lock()
+	defer f.c.unlockRead()
+	f.c.rmu.Lock()
 
 	return f.c.appendFrame(ctx, b, f.c.more)
 }
 
+// ReadAppendToLimit is the same as ReadAppendTo but stops when len(b) reaches limit.
 func (f Frame) ReadAppendToLimit(ctx context.Context, b []byte, limit int) ([]byte, error) {
-	//	defer f.c.rmu.Unlock()
-	//	f.c.rmu.Lock()
+	return f.c.AppendReadFrameLimit(ctx, b, limit)
+}
+
+// AppendReadFrameLimit appends the current frame payload to b until len(b) reaches limit.
+// io.EOF is returned only when the frame is fully read,
+// so nil error with len(b) == limit means the frame has more data, see FrameRemaining.
+// b is returned as is with io.EOF if there is no frame being read.
+func (c *Conn) AppendReadFrameLimit(ctx context.Context, b []byte, limit int) ([]byte, error) {
+	defer c.unlockRead()
+	c.rmu.Lock()
 
-	return f.c.appendFrame(ctx, b, min(f.c.more, limit-len(b)))
+	return c.appendFrame(ctx, b, max(0, min(c.more, limit-len(b))))
 }
 
+// More returns the number of payload bytes left to read.
 func (f Frame) More() int {
-	//	defer f.c.rmu.Unlock()
-	//	f.c.rmu.Lock()
+	return f.c.FrameRemaining()
+}
+
+// FrameRemaining returns the number of payload bytes of the current frame left to read,
+// the same as Frame.More. It's zero between frames.
+// The payload of compressed frames is counted as is, not decompressed.
+func (c *Conn) FrameRemaining() int {
+	defer c.unlockRead()
+	c.rmu.Lock()
 
-	return f.c.more
+	return c.more
 }
 
 func (c *Conn) readFrame(ctx context.Context, p []byte) (int, error) {
@@ -229,6 +883,9 @@ func (c *Conn) readFrame(ctx context.Context, p []byte) (int, error) {
 	return len(res), err
 }
 
+// appendFrame appends up to more bytes of the current frame payload to p.
+// io.EOF is returned when the frame is fully read, which is immediately for empty frames.
+// It's the end of the frame, not of the message or the connection.
 func (c *Conn) appendFrame(ctx context.Context, p []byte, more int) (p0 []byte, err error) {
 	//	defer func(f dbgfn) {
 	//		f(len(p0), err)
@@ -238,6 +895,17 @@ func (c *Conn) appendFrame(ctx context.Context, p []byte, more int) (p0 []byte,
 		return p, io.EOF
 	}
 
+	defer func(st int) {
+		if !c.header.IsDataFrame() {
+			return
+		}
+
+		e := c.validateText(p0[st:])
+		if e != nil {
+			err = e
+		}
+	}(len(p))
+
 	n := len(p)
 	more = min(more, c.more)
 	p = slices.Grow(p, more)
@@ -252,9 +920,14 @@ func (c *Conn) appendFrame(ctx context.Context, p []byte, more int) (p0 []byte,
 			end := min(c.end, c.i+more)
 			m = copy(p[n:], c.rbuf[c.i:end])
 		case more >= len(c.rbuf)-0x10:
-			m, err = c.Conn.Read(p[n : n+more])
-			if err != nil && !errors.Is(err, io.EOF) {
-				return p[:n], err
+			m, err = c.readDirect(ctx, p[n:n+more])
+			if err != nil && (m == 0 || !errors.Is(err, io.EOF)) {
+				maskBuf(p[n:n+m], c.key, c.i-c.start)
+				n += m
+				c.i += m
+				c.more -= m
+
+				return p[:n], c.abnormal(err)
 			}
 		default:
 			nread, err := c.read(ctx)
@@ -275,15 +948,95 @@ func (c *Conn) appendFrame(ctx context.Context, p []byte, more int) (p0 []byte,
 	return p[:n], csel(c.more == 0, io.EOF, nil)
 }
 
+// validateText validates the next part of the data message payload just read
+// if it's a text message. The message end is detected by the frame state,
+// so it must be called after the part is consumed.
+// Compressed messages are validated after decompression, so they are skipped here,
+// as are messages with payload skipped by NextFrame.
+// The connection is failed with StatusFormat on invalid UTF-8.
+func (c *Conn) validateText(p []byte) error {
+	if c.msgOp != FrameText || c.text.skip {
+		return nil
+	}
+
+	final := c.more == 0 && c.header.Fin()
+
+	if !c.text.valid(p, final) {
+		return c.fail(StatusFormat)
+	}
+
+	return nil
+}
+
+// utf8State validates UTF-8 text split at arbitrary points,
+// so invalid text is detected as soon as the invalid bytes are read.
+type utf8State struct {
+	buf [utf8.UTFMax]byte // incomplete rune at the end of the previous part
+	n   int
+
+	skip bool // the payload is compressed and validated by inflate, or it's partly skipped
+}
+
+// valid reports whether the text is still valid after p.
+// final means p is the end of the text, so it must not end with an incomplete rune.
+func (s *utf8State) valid(p []byte, final bool) bool {
+	for s.n != 0 && len(p) != 0 {
+		s.buf[s.n] = p[0]
+		s.n++
+		p = p[1:]
+
+		if !utf8.FullRune(s.buf[:s.n]) {
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s.buf[:s.n])
+		if r == utf8.RuneError && size <= 1 {
+			return false
+		}
+
+		s.n = 0
+	}
+
+	if s.n != 0 {
+		return !final
+	}
+
+	i := len(p)
+
+	for j := len(p) - 1; j >= 0 && j >= len(p)-utf8.UTFMax+1; j-- {
+		if utf8.RuneStart(p[j]) {
+			if !utf8.FullRune(p[j:]) {
+				i = j
+			}
+
+			break
+		}
+	}
+
+	if !utf8.Valid(p[:i]) {
+		return false
+	}
+
+	s.n = copy(s.buf[:], p[i:])
+
+	return !final || s.n == 0
+}
+
 func (c *Conn) parseFrameHeader(b []byte, st int, key []byte) (h HeaderBits, l, i int) {
 	i = st
 	if i+2 > len(b) {
 		return h, 0, -1
 	}
 
-	i += copy(h[:], b[i:])
+	h = HeaderBits{b[i], b[i+1]}
+	i += 2
+
+	// fast path for small unmasked frames
+	if l = h.len7(); l <= maxLen7 && !h.Masked() {
+		return h, l, i
+	}
 
-	l, i = h.ParseLen(c.rbuf, i)
+	l, i = h.ParseLen(b, i)
 	if i < 0 {
 		return h, 0, -1
 	}
@@ -298,29 +1051,43 @@ func (c *Conn) parseFrameHeader(b []byte, st int, key []byte) (h HeaderBits, l,
 	return h, l, i
 }
 
+// processClose parses the close frame body (RFC 6455 section 5.5.1).
+//
+// Empty body is a normal close and io.EOF is returned.
+// 1-byte body can't hold a status code, so it's a protocol error.
+// Otherwise the status code is followed by an optional UTF-8 reason.
+// StatusOK without a reason is io.EOF, a Status or *StatusText is returned otherwise.
+// Invalid codes and reasons fail the connection.
 func (c *Conn) processClose(ctx context.Context) (err error) {
 	c.readerClosed = true
+	c.closeRecv = true
 
-	if c.more == 0 {
+	defer func() {
+		c.closeErr = err
+		c.readEnded(err)
+	}()
+
+	switch c.more {
+	case 0:
 		return io.EOF
+	case 1:
+		return c.fail(StatusProtocol)
 	}
 
-	if c.more == 1 {
-		return fmt.Errorf("wtf close data: %x", c.rbuf[c.i])
+	p, err := c.appendFrame(ctx, c.ctrl[:0], c.more)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
 	}
-
-	size := min(c.more, 128)
-
-	c.rbuf, err = c.appendFrame(ctx, c.rbuf[:c.end], size)
-	if errors.Is(err, io.EOF) {
-		err = nil
+	if len(p) < 2 {
+		return c.fail(StatusProtocol)
 	}
-	if err != nil {
-		return err
+
+	status := binary.BigEndian.Uint16(p)
+	if !Status(status).Valid() {
+		return c.fail(StatusProtocol)
 	}
 
-	status := binary.BigEndian.Uint16(c.rbuf[c.end:])
-	if len(c.rbuf[c.end:]) == 2 {
+	if len(p) == 2 {
 		if Status(status) == StatusOK {
 			return io.EOF
 		}
@@ -328,7 +1095,10 @@ func (c *Conn) processClose(ctx context.Context) (err error) {
 		return Status(status)
 	}
 
-	text := c.rbuf[c.end+2 : c.end+size]
+	text := p[2:]
+	if !utf8.Valid(text) {
+		return c.fail(StatusFormat)
+	}
 
 	return &StatusText{
 		Status: Status(status),
@@ -336,13 +1106,91 @@ func (c *Conn) processClose(ctx context.Context) (err error) {
 	}
 }
 
+// fail sends close frame with the status and stops reading.
+// The following reads return io.EOF without trying to parse the rest of the stream.
+func (c *Conn) fail(status Status) error {
+	c.readerClosed = true
+	c.closeErr = status
+	c.more = 0
+	c.inflating = false
+
+	c.queueControl(FrameClose, []byte{byte(status >> 8), byte(status)})
+
+	c.readEnded(status)
+
+	return status
+}
+
+// readEnded is called once no more frames can be read.
+// It cancels the Server.Handler context and fails outstanding pings with the read error.
+func (c *Conn) readEnded(err error) {
+	if c.cancel != nil {
+		c.cancel(err)
+	}
+
+	c.failPings(c.closedErr(err))
+}
+
+func (c *Conn) readBufSize() int {
+	return max(csel(c.ReadBufferSize != 0, c.ReadBufferSize, defaultReadBufSize), minReadBufSize)
+}
+
+// adaptReadBuf grows the read buffer up to MaxReadBufferSize
+// if frames of length l routinely don't fit into it.
+func (c *Conn) adaptReadBuf(l int) {
+	if len(c.rbuf) >= c.MaxReadBufferSize {
+		return
+	}
+
+	if l+maxHeaderSize <= len(c.rbuf) {
+		c.bigFrames = 0
+		return
+	}
+
+	c.bigFrames++
+	if c.bigFrames < growReadBufAfter {
+		return
+	}
+
+	c.bigFrames = 0
+
+	b := make([]byte, min(2*len(c.rbuf), c.MaxReadBufferSize))
+	copy(b, c.rbuf[:c.end])
+
+	if c.pool != nil {
+		c.pool.Put(c.rbuf)
+	}
+
+	c.rbuf = b
+}
+
+// readBuffered moves data read ahead by r during the handshake into rbuf.
+func (c *Conn) readBuffered(r *bufio.Reader) error {
+	n := r.Buffered()
+	if n == 0 {
+		return nil
+	}
+
+	c.allocReadBuf(max(n, c.readBufSize()))
+
+	m, err := io.ReadFull(r, c.rbuf[:n])
+	c.end = m
+	if err != nil {
+		c.discardReadBuf()
+
+		return fmt.Errorf("flush buffer: read %d of %d: %w", m, n, err)
+	}
+
+	return nil
+}
+
 func (c *Conn) read(ctx context.Context) (n int, err error) {
 	//	defer func(f dbgfn) {
 	//		f(n, err)
 	//	}(c.debug("read"))
 
 	if len(c.rbuf) < minReadBufSize {
-		c.rbuf = make([]byte, defaultReadBufSize)
+		c.allocReadBuf(c.readBufSize())
 	}
 
 	if c.i >= c.end/2 {
@@ -362,53 +1210,105 @@ func (c *Conn) read(ctx context.Context) (n int, err error) {
 		c.end = 0
 	}
 	if c.end >= len(c.rbuf) {
-		panic(c.end)
+		c.rbuf = grow(c.rbuf, 2*len(c.rbuf))
+	}
+
+	err = c.armIdle()
+	if err != nil {
+		return 0, err
 	}
 
-	if d, ok := c.Conn.(interface{ SetReadDeadline(time.Time) error }); ctx != nil && ok {
-		defer Stopper(ctx, d.SetReadDeadline)()
+	if ctx != nil {
+		defer Stopper(ctx, c.setReadDeadline)()
 	}
 
 	n, err = c.Conn.Read(c.rbuf[c.end:])
+	c.stats.read(n)
 	c.end += n
 	err = FixError(ctx, err)
 
+	if err != nil && n == 0 {
+		err = c.abnormal(err)
+	}
+
 	return n, err
 }
 
+// readDirect reads big frames payload into p bypassing the read buffer.
+// Deadlines and ctx are respected the same way as in read.
+func (c *Conn) readDirect(ctx context.Context, p []byte) (n int, err error) {
+	err = c.armIdle()
+	if err != nil {
+		return 0, err
+	}
+
+	if ctx != nil {
+		defer Stopper(ctx, c.setReadDeadline)()
+	}
+
+	n, err = c.Conn.Read(p)
+	c.stats.read(n)
+
+	return n, FixError(ctx, err)
+}
+
+// abnormal wraps transport errors into AbnormalCloseError.
+// EOF on a frame boundary, timeouts and context errors are returned as is
+// as they are not a connection failure.
+func (c *Conn) abnormal(err error) error {
+	switch {
+	case isTimeout(err), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	case errors.Is(err, io.EOF) && c.more == 0 && c.i >= c.end:
+		c.readEnded(err)
+
+		return err
+	case errors.Is(err, io.EOF):
+		err = io.ErrUnexpectedEOF
+	}
+
+	err = &AbnormalCloseError{Err: err}
+	c.readEnded(err)
+
+	return err
+}
+
+// Stopper interrupts blocking io when ctx is done by setting deadline in the past.
+// The returned func must be called when the io is finished.
+// It restores the deadline if it was changed.
+// No goroutine is started, so nothing leaks if ctx is never canceled.
+// nil ctx or ctx which can never be canceled are allowed.
 func Stopper(ctx context.Context, dead func(time.Time) error) func() {
-	donec := make(chan struct{})
+	if ctx == nil || ctx.Done() == nil {
+		return func() {}
+	}
 
 	var mu sync.Mutex
-	var killed bool
-
-	go func() {
-		select {
-		case <-ctx.Done():
-		case <-donec:
-			return
-		}
+	var done, killed bool
 
+	stop := context.AfterFunc(ctx, func() {
 		defer mu.Unlock()
 		mu.Lock()
 
-		select {
-		case <-donec:
+		if done {
 			return
-		default:
 		}
 
 		_ = dead(time.Unix(1, 0))
 
 		killed = true
-	}()
+	})
 
 	return func() {
-		close(donec)
+		if stop() {
+			return
+		}
 
 		defer mu.Unlock()
 		mu.Lock()
 
+		done = true
+
 		if killed {
 			_ = dead(time.Time{})
 		}
@@ -416,7 +1316,7 @@ func Stopper(ctx context.Context, dead func(time.Time) error) func() {
 }
 
 func FixError(ctx context.Context, err error) error {
-	if isTimeout(err) {
+	if ctx != nil && isTimeout(err) {
 		select {
 		case <-ctx.Done():
 			err = ctx.Err()
@@ -437,7 +1337,7 @@ func isTimeout(err error) bool {
 type dbgfn func(args ...any)
 
 func (c *Conn) debug(name string) dbgfn { //nolint:unused
-	log.Printf("%-14v >  st/i/end: %3x %3x %3x  rbuf %3x  start/more: %3x %3x", name, c.st, c.i, c.end, len(c.rbuf), c.start, c.more)
+	log.Printf("%-14v >  client %v  st/i/end: %3x %3x %3x  rbuf %3x  start/more: %3x %3x", name, c.client, c.st, c.i, c.end, len(c.rbuf), c.start, c.more)
 
 	return func(args ...any) {
 		log.Printf("%-14v <  st/i/end: %3x %3x %3x  rbuf %3x  start/more: %3x %3x  ret %v  from %v", name, c.st, c.i, c.end, len(c.rbuf), c.start, c.more, args, caller(2))
@@ -0,0 +1,3593 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReadDeadlineResume(t *testing.T) {
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	c := &Conn{Conn: p1}
+	frame := maskedFrameBytes(FrameText, []byte("hello, world"), true)
+
+	go func() {
+		_, _ = p0.Write(frame[:10])
+	}()
+
+	buf := make([]byte, 100)
+
+	n, err := c.Read(buf[:4])
+	if err != nil || n != 4 {
+		t.Fatalf("read: %v %v", n, err)
+	}
+
+	err = c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	m, err := c.Read(buf[n:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v %v", m, err)
+	}
+
+	n += m
+
+	_ = c.SetReadDeadline(time.Time{})
+
+	go func() {
+		_, _ = p0.Write(frame[10:])
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for n < 12 {
+		m, err = c.ReadContext(ctx, buf[n:])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		n += m
+	}
+
+	if string(buf[:n]) != "hello, world" {
+		t.Errorf("got %q", buf[:n])
+	}
+}
+
+// frameBytes encodes server frame.
+func frameBytes(op Opcode, p []byte, fin bool) []byte {
+	var f FakeConn
+
+	w := &Conn{Conn: &f}
+
+	_, _ = w.WriteFrame(p, op, fin)
+
+	return f.b
+}
+
+// maskedFrameBytes encodes client frame.
+func maskedFrameBytes(op Opcode, p []byte, fin bool) []byte {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+
+	_, _ = w.WriteFrame(p, op, fin)
+
+	return f.b
+}
+
+func TestJSON(t *testing.T) {
+	type msg struct {
+		A int    `json:"a"`
+		B string `json:"b"`
+	}
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f, MaxMessageSize: 100}
+
+	err := w.WriteJSON(msg{A: 1, B: "first"})
+	if err != nil {
+		t.Fatalf("write json: %v", err)
+	}
+
+	_, _ = w.WriteFrame([]byte(`{"a":2,`), FrameText, false)
+	_, _ = w.WriteFrame([]byte(`"b":"second"}`), FrameContinue, true)
+	_, _ = w.WriteFrame([]byte(`{}`), FrameBinary, true)
+	_, _ = w.WriteFrame(make([]byte, 101), FrameText, true)
+
+	for _, exp := range []msg{{1, "first"}, {2, "second"}} {
+		var m msg
+
+		err = r.ReadJSON(context.Background(), &m)
+		if err != nil || m != exp {
+			t.Errorf("read json: %v  %+v, expected %+v", err, m, exp)
+		}
+	}
+
+	var m msg
+
+	err = r.ReadJSON(context.Background(), &m)
+	if exp := UnexpectedOpcode(FrameBinary); !errors.Is(err, exp) {
+		t.Errorf("expected %v, got %v", exp, err)
+	}
+
+	err = r.ReadJSON(context.Background(), &m)
+	if !errors.Is(err, ErrTooBig) {
+		t.Errorf("expected %v, got %v", ErrTooBig, err)
+	}
+}
+
+func TestNextWriter(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	mw, err := w.NextWriter(FrameText)
+	if err != nil {
+		t.Fatalf("next writer: %v", err)
+	}
+
+	for _, p := range []string{"first", "", "second", "third"} {
+		_, err = mw.Write([]byte(p))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	err = mw.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	op, data, err := r.ReadMessage(context.Background())
+	if err != nil || op != FrameText || string(data) != "firstsecondthird" {
+		t.Errorf("read message: %v %q %v", op, data, err)
+	}
+}
+
+func TestInvalidControlFrames(t *testing.T) {
+	for _, frame := range [][]byte{
+		maskedFrameBytes(FramePing, make([]byte, 126), true),
+		maskedFrameBytes(FrameClose, []byte{0x3, 0xe8}, false),
+	} {
+		f := FakeConn{b: frame}
+		r := &Conn{Conn: &f}
+
+		_, err := r.Read(make([]byte, 10))
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected protocol error, got %v", err)
+		}
+
+		_, err = r.Read(make([]byte, 10))
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("expected EOF after protocol error, got %v", err)
+		}
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	for _, reply := range []bool{true, false} {
+		p0, p1 := newPipe()
+
+		c := &Conn{Conn: p0, client: 1}
+		s := &Conn{Conn: p1}
+
+		_, err := s.WriteFrame([]byte("in flight"), FrameText, true)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		go func() {
+			buf := make([]byte, 10)
+
+			for {
+				_, err := s.Read(buf)
+				if err != nil {
+					break
+				}
+			}
+
+			if reply {
+				_ = s.CloseWriter(StatusOK)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+		clean, err := c.CloseHandshake(ctx, StatusGoingAway, "bye")
+		if clean != reply || reply && err != nil {
+			t.Errorf("reply %v: clean %v, err %v", reply, clean, err)
+		}
+
+		cancel()
+		_ = p1.Close()
+	}
+}
+
+func TestCloseWriterText(t *testing.T) {
+	reason := strings.Repeat("a", 122) + "ж" // 124 bytes, rune crosses the limit
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	err := w.CloseWriterText(StatusGoingAway, "\xff")
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("expected invalid utf8 error, got %v", err)
+	}
+
+	err = w.CloseWriterText(StatusGoingAway, reason)
+	if err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	_, err = r.Read(make([]byte, 10))
+
+	var st *StatusText
+	if !errors.As(err, &st) || st.Status != StatusGoingAway || st.Text != reason[:122] {
+		t.Errorf("unexpected close error: %v", err)
+	}
+}
+
+func TestCloseStatusValidation(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+
+	err := w.CloseWriter(StatusAbnormal)
+	if !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("expected invalid status error, got %v", err)
+	}
+
+	_, _ = w.WriteFrame([]byte{0x3, 0xee}, FrameClose, true) // 1006
+
+	r := &Conn{Conn: &f}
+
+	_, err = r.Read(make([]byte, 10))
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected protocol error, got %v", err)
+	}
+}
+
+func BenchmarkConnChurn(b *testing.B) {
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			b.ReportAllocs()
+
+			var p BufferPool
+			if pool {
+				p = &SyncBufferPool{}
+			}
+
+			var f FakeConn
+			msg := []byte("message")
+			buf := make([]byte, 100)
+
+			for b.Loop() {
+				w := &Conn{Conn: &f, client: 1, pool: p}
+				r := &Conn{Conn: &f, pool: p}
+
+				_, _ = w.Write(msg)
+				_, _ = r.Read(buf)
+
+				_ = w.Close()
+				_ = r.Close()
+			}
+		})
+	}
+}
+
+// countPool is a BufferPool tracking buffers not returned yet.
+type countPool struct {
+	mu  sync.Mutex
+	out int
+}
+
+func (p *countPool) Get() []byte {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	p.out++
+
+	return make([]byte, defaultReadBufSize)
+}
+
+func (p *countPool) Put([]byte) {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	p.out--
+}
+
+func (p *countPool) Out() int {
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	return p.out
+}
+
+func TestCloseConcurrentRead(t *testing.T) {
+	ctx := context.Background()
+
+	var p countPool
+
+	cp, sp := newPipe()
+	defer cp.Close()
+
+	c := &Conn{Conn: sp, pool: &p}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		_, _, err := c.ReadMessage(ctx)
+		errc <- err
+	}()
+
+	// the reader is blocked in the middle of the frame using the read buffer
+	_, _ = cp.Write(maskedFrameBytes(FrameText, []byte("hello"), true)[:8])
+
+	time.Sleep(10 * time.Millisecond)
+
+	err := c.Close()
+	if err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	err = <-errc
+	if err == nil {
+		t.Errorf("expected read error after close")
+	}
+
+	if out := p.Out(); out != 0 {
+		t.Errorf("buffers not returned to the pool: %d", out)
+	}
+
+	// no reader, released by Close itself
+
+	c = &Conn{Conn: &FakeConn{b: maskedFrameBytes(FrameText, []byte("hello"), true)}, pool: &p}
+
+	_, data, err := c.ReadMessage(ctx)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read: %q %v", data, err)
+	}
+
+	_ = c.Close()
+
+	if out := p.Out(); out != 0 {
+		t.Errorf("buffers not returned to the pool: %d", out)
+	}
+}
+
+func TestPingPongHandlers(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	_ = w.WritePing([]byte("ping"))
+	_ = w.WritePong([]byte("pong"))
+	_, _ = w.WriteFrame([]byte("data"), FrameText, true)
+
+	var ping, pong string
+
+	r.SetPingHandler(func(p []byte) error {
+		ping = string(p)
+		return nil
+	})
+
+	r.SetPongHandler(func(p []byte) error {
+		pong = string(p)
+		return nil
+	})
+
+	buf := make([]byte, 10)
+
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Errorf("read: %q %v", buf[:n], err)
+	}
+
+	if ping != "ping" || pong != "pong" {
+		t.Errorf("handlers: ping %q, pong %q", ping, pong)
+	}
+}
+
+func TestWriteControl(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	var ping, pong string
+
+	r.SetPingHandler(func(p []byte) error {
+		ping = string(p)
+		return nil
+	})
+	r.SetPongHandler(func(p []byte) error {
+		pong = string(p)
+		return nil
+	})
+
+	for _, tc := range []struct {
+		op      Opcode
+		payload []byte
+		err     error
+	}{
+		{FrameText, nil, UnexpectedOpcode(FrameText)},
+		{FramePing, make([]byte, maxLen7+1), ErrControlTooBig},
+		{FrameClose, []byte{0x03}, ErrInvalidStatus},
+		{FrameClose, []byte{0x03, 0xe7}, ErrInvalidStatus},
+	} {
+		err := w.WriteControl(tc.op, tc.payload, time.Time{})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v % x: expected %v, got %v", tc.op, tc.payload, tc.err, err)
+		}
+	}
+
+	if len(f.b) != 0 {
+		t.Errorf("invalid frames written: % x", f.b)
+	}
+
+	var deadline time.Time // FakeConn has no deadlines
+
+	_ = w.WriteControl(FramePing, []byte("ping"), deadline)
+	_ = w.WriteControl(FramePong, []byte("pong"), deadline)
+
+	err := w.WriteControl(FrameClose, append([]byte{0x03, 0xe9}, "bye"...), deadline)
+	if err != nil {
+		t.Errorf("write close: %v", err)
+	}
+
+	err = w.WriteControl(FramePing, nil, deadline)
+	if !errors.Is(err, ErrWriteClosed) {
+		t.Errorf("expected write closed, got %v", err)
+	}
+
+	_, _, err = r.ReadMessage(ctx)
+
+	var st *StatusText
+	if !errors.As(err, &st) || st.Status != StatusGoingAway || st.Text != "bye" {
+		t.Errorf("expected close status with reason, got %v", err)
+	}
+
+	if ping != "ping" || pong != "pong" {
+		t.Errorf("handlers: ping %q, pong %q", ping, pong)
+	}
+}
+
+func TestWriteControlDeadline(t *testing.T) {
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	w := &Conn{Conn: p0}
+
+	// nobody reads, so the frame write itself times out
+	err := w.WriteControl(FramePing, nil, time.Now().Add(50*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// a data write holds the lock
+	go func() {
+		_, _ = w.Write(make([]byte, 100))
+	}()
+
+	for w.wmu.TryLock() {
+		w.wmu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+
+	err = w.WriteControl(FramePong, nil, time.Now().Add(50*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+		t.Errorf("waited for the lock for %v", d)
+	}
+
+	// the deadline is reset after the write
+	peer := &Conn{Conn: p1, client: 1}
+
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+
+	err = w.WriteControl(FramePing, []byte("after"), time.Time{})
+	if err != nil {
+		t.Errorf("write after deadline: %v", err)
+	}
+}
+
+func TestWriteLockUntil(t *testing.T) {
+	var l writeLock
+
+	l.Lock()
+
+	if l.LockUntil(time.Now().Add(10 * time.Millisecond)) {
+		t.Fatalf("locked twice")
+	}
+
+	released := make(chan time.Time, 1)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+
+		released <- time.Now()
+		l.Unlock()
+	}()
+
+	if !l.LockUntil(time.Now().Add(time.Minute)) {
+		t.Fatalf("lock is not taken after release")
+	}
+
+	if d := time.Since(<-released); d > 100*time.Millisecond {
+		t.Errorf("lock taken %v after release", d)
+	}
+
+	if l.TryLock() {
+		t.Errorf("try lock of locked")
+	}
+
+	l.Unlock()
+
+	if !l.TryLock() {
+		t.Errorf("try lock of unlocked")
+	}
+}
+
+func TestWriteControlTooBig(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+
+	for _, write := range []func([]byte) error{w.WritePing, w.WritePong} {
+		err := write(make([]byte, maxLen7))
+		if err != nil {
+			t.Errorf("max payload: %v", err)
+		}
+
+		err = write(make([]byte, maxLen7+1))
+		if !errors.Is(err, ErrControlTooBig) {
+			t.Errorf("expected %v, got %v", ErrControlTooBig, err)
+		}
+	}
+
+	r := &Conn{Conn: &f}
+
+	for _, op := range []Opcode{FramePing, FramePong} {
+		fr, err := r.NextRawFrame(context.Background())
+		if err != nil || fr.Opcode != op || fr.Length != maxLen7 || !fr.Final {
+			t.Errorf("frame: %+v %v", fr, err)
+		}
+	}
+
+	_, err := r.NextRawFrame(context.Background())
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("oversized frame was written: %v", err)
+	}
+}
+
+func TestAutoPongMasked(t *testing.T) {
+	var in, out FakeConn
+
+	w := &Conn{Conn: &in, client: 1}
+
+	_, _ = w.WriteFrame([]byte("ping!"), FramePing, true)
+	_, _ = w.WriteFrame([]byte("data"), FrameText, true)
+
+	r := &Conn{Conn: &splitConn{r: &in, w: &out}}
+
+	buf := make([]byte, 10)
+
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Errorf("read: %q %v", buf[:n], err)
+	}
+
+	pr := &Conn{Conn: &out, client: 1}
+
+	f, err := pr.NextRawFrame(context.Background())
+	if err != nil || f.Opcode != FramePong {
+		t.Fatalf("pong frame: %v %v", f.Opcode, err)
+	}
+
+	p, err := f.ReadAppendTo(context.Background(), nil)
+	if !errors.Is(err, io.EOF) || string(p) != "ping!" {
+		t.Errorf("pong payload: %q %v", p, err)
+	}
+}
+
+type splitConn struct {
+	r io.Reader
+	w io.Writer
+
+	net.Conn
+}
+
+func (c *splitConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *splitConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// pipeConn is a full duplex in-memory connection.
+// Unlike net.Pipe writes are buffered and never block,
+// so both ends can write at the same time, as in the close handshake, without extra goroutines.
+// Closing one end makes the peer read EOF after the buffered data.
+type pipeConn struct {
+	r, w *pipeBuf
+}
+
+// pipeBuf is one direction of the pipe.
+type pipeBuf struct {
+	mu   sync.Mutex
+	cond sync.Cond
+
+	b []byte
+
+	wclosed bool // the writer end is closed, the reader gets EOF
+	rclosed bool // the reader end is closed
+
+	rdead, wdead time.Time
+	timer        *time.Timer
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a, b := &pipeBuf{}, &pipeBuf{}
+	a.cond.L = &a.mu
+	b.cond.L = &b.mu
+
+	return &pipeConn{r: a, w: b}, &pipeConn{r: b, w: a}
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	r := c.r
+
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	for {
+		switch {
+		case r.rclosed:
+			return 0, io.ErrClosedPipe
+		case len(r.b) != 0:
+			n := copy(p, r.b)
+			r.b = r.b[n:]
+
+			return n, nil
+		case r.wclosed:
+			return 0, io.EOF
+		case !r.rdead.IsZero() && !time.Now().Before(r.rdead):
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		r.cond.Wait()
+	}
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	w := c.w
+
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	switch {
+	case w.wclosed, w.rclosed:
+		return 0, io.ErrClosedPipe
+	case !w.wdead.IsZero() && !time.Now().Before(w.wdead):
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	w.b = append(w.b, p...)
+	w.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (c *pipeConn) Close() error {
+	for _, b := range []*pipeBuf{c.r, c.w} {
+		b.mu.Lock()
+		b.rclosed = b.rclosed || b == c.r
+		b.wclosed = b.wclosed || b == c.w
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	r := c.r
+
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	r.rdead = t
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	if !t.IsZero() {
+		r.timer = time.AfterFunc(time.Until(t), func() {
+			defer r.mu.Unlock()
+			r.mu.Lock()
+
+			r.cond.Broadcast()
+		})
+	}
+
+	r.cond.Broadcast()
+
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	defer c.w.mu.Unlock()
+	c.w.mu.Lock()
+
+	c.w.wdead = t
+
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return streamAddr("pipe") }
+func (c *pipeConn) RemoteAddr() net.Addr { return streamAddr("pipe") }
+
+// pipeHandshake connects client and server Conns by the handshake over pipeConn.
+func pipeHandshake(t *testing.T, s *Server, cl *Client) (client, server *Conn) {
+	t.Helper()
+
+	cp, sp := newPipe()
+
+	type res struct {
+		c   *Conn
+		err error
+	}
+
+	resc := make(chan res, 1)
+
+	go func() {
+		c, err := s.Upgrade(sp, nil, nil)
+		resc <- res{c, err}
+	}()
+
+	cl.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return cp, nil
+	}
+
+	client, err := cl.DialContext(context.Background(), "ws://pipe/")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	r := <-resc
+	if r.err != nil {
+		t.Fatalf("upgrade: %v", r.err)
+	}
+
+	return client, r.c
+}
+
+func TestWriteMessage(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	err := w.WriteMessage(FramePing, nil)
+	if !errors.Is(err, UnexpectedOpcode(FramePing)) {
+		t.Errorf("expected unexpected opcode error, got %v", err)
+	}
+
+	for _, op := range []Opcode{FrameText, FrameBinary} {
+		err = w.WriteMessage(op, []byte(op.String()))
+		if err != nil {
+			t.Fatalf("write message: %v", err)
+		}
+
+		rop, data, err := r.ReadMessage(context.Background())
+		if err != nil || rop != op || string(data) != op.String() {
+			t.Errorf("read message: %v %q %v", rop, data, err)
+		}
+	}
+}
+
+func TestWriteContextCancel(t *testing.T) {
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	c := &Conn{Conn: p0}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	go func() {
+		_, _ = p1.Read(make([]byte, 100)) // read part of the frame
+	}()
+
+	_, err := c.WriteContext(ctx, make([]byte, 1<<20))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	_, err = c.Write([]byte("next"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected broken connection, got %v", err)
+	}
+}
+
+func TestWriteShort(t *testing.T) {
+	for _, msg := range [][]byte{
+		[]byte("short writes message"),
+		bytes.Repeat([]byte("large message "), writevMinSize/10),
+	} {
+		for _, client := range []byte{0, 1} {
+			var f FakeConn
+
+			w := &Conn{Conn: &shortConn{FakeConn: &f, max: 3}, client: client}
+			r := &Conn{Conn: &f, client: 1 - client}
+
+			n, err := w.Write(msg)
+			if err != nil || n != len(msg) {
+				t.Errorf("write: %v %v", n, err)
+			}
+
+			_, data, err := r.ReadMessage(context.Background())
+			if err != nil || !bytes.Equal(data, msg) {
+				t.Errorf("read: %d %v", len(data), err)
+			}
+
+			if st := w.Stats(); st.BytesWritten != int64(len(f.b)) {
+				t.Errorf("bytes written: %v, want %v", st.BytesWritten, len(f.b))
+			}
+		}
+	}
+}
+
+type shortConn struct {
+	*FakeConn
+	max int
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	return c.FakeConn.Write(p[:min(len(p), c.max)])
+}
+
+// limitConn accepts up to left bytes and fails after that.
+type limitConn struct {
+	FakeConn
+	left int
+}
+
+var errLimit = errors.New("write limit reached")
+
+func (c *limitConn) Write(p []byte) (int, error) {
+	n := min(len(p), c.left)
+	c.left -= n
+
+	_, _ = c.FakeConn.Write(p[:n])
+
+	if n < len(p) {
+		return n, errLimit
+	}
+
+	return n, nil
+}
+
+func TestWritePartialError(t *testing.T) {
+	for _, msg := range [][]byte{
+		[]byte("partially written message"),
+		bytes.Repeat([]byte("large message "), writevMinSize/10),
+	} {
+		for _, client := range []byte{0, 1} {
+			hdr := len(frameBytes(FrameBinary, msg, true)) - len(msg) + 4*int(client)
+
+			for _, tc := range []struct {
+				limit int
+				n     int
+			}{
+				{0, 0},
+				{1, 0},
+				{hdr, 0},
+				{hdr + 5, 5},
+			} {
+				f := &limitConn{left: tc.limit}
+				w := &Conn{Conn: f, client: client}
+
+				n, err := w.Write(msg)
+				if n != tc.n || !errors.Is(err, errLimit) {
+					t.Errorf("len %d client %v limit %d: write %v %v, expected %v", len(msg), client, tc.limit, n, err, tc.n)
+				}
+
+				// retry is only possible if nothing was written
+				f.left = len(msg) + hdr
+
+				n, err = w.Write(msg)
+				if tc.limit == 0 && (err != nil || n != len(msg)) || tc.limit != 0 && (n != 0 || !errors.Is(err, errLimit)) {
+					t.Errorf("len %d client %v limit %d: next write %v %v", len(msg), client, tc.limit, n, err)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteFragmented(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	err := w.WriteFragmented(FrameText, []byte("abc"), 0)
+	if err == nil {
+		t.Errorf("expected error on zero fragment size")
+	}
+
+	err = w.WriteFragmented(FrameText, []byte("abcdefgh"), 3)
+	if err != nil {
+		t.Fatalf("write fragmented: %v", err)
+	}
+
+	for i, exp := range []Frame{
+		{Opcode: FrameText, Length: 3},
+		{Opcode: FrameContinue, Length: 3},
+		{Opcode: FrameContinue, Length: 2, Final: true},
+	} {
+		fr, err := r.NextFrame(ctx)
+		if err != nil || fr.Opcode != exp.Opcode || fr.Length != exp.Length || fr.Final != exp.Final {
+			t.Errorf("frame %d: %+v %v, expected %+v", i, fr, err, exp)
+		}
+	}
+}
+
+func TestMaskKeyGolden(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{
+		Conn:    &f,
+		client:  1,
+		MaskKey: func() [4]byte { return [4]byte{1, 2, 3, 4} },
+	}
+
+	_, _ = w.WriteFrame([]byte("Hi!"), FrameText, true)
+
+	exp := []byte{0x81, 0x83, 1, 2, 3, 4, 'H' ^ 1, 'i' ^ 2, '!' ^ 3}
+	if !bytes.Equal(f.b, exp) {
+		t.Errorf("wire: % x, expected % x", f.b, exp)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	_, _ = w.WriteFrame([]byte("ab"), FrameText, false)
+	_, _ = w.WriteFrame([]byte("ping"), FramePing, true)
+	_, _ = w.WriteFrame([]byte("cd"), FrameContinue, true)
+
+	r.SetPingHandler(func([]byte) error { return nil })
+
+	_, _, err := r.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+
+	ws, rs := w.Stats(), r.Stats()
+
+	if ws.FramesWritten != 3 || ws.MessagesWritten != 1 || ws.PingsSent != 1 || ws.BytesWritten != 26 {
+		t.Errorf("writer stats: %+v", ws)
+	}
+
+	if rs.FramesRead != 3 || rs.MessagesRead != 1 || rs.PingsReceived != 1 || rs.BytesRead != 26 || rs.LastActivity.IsZero() {
+		t.Errorf("reader stats: %+v", rs)
+	}
+}
+
+func TestMaskingRole(t *testing.T) {
+	for _, tc := range []struct {
+		frame  []byte
+		client byte
+		allow  bool
+		err    error
+	}{
+		{frameBytes(FrameText, []byte("a"), true), 0, false, ErrProtocol},
+		{frameBytes(FrameText, []byte("a"), true), 0, true, nil},
+		{maskedFrameBytes(FrameText, []byte("a"), true), 0, false, nil},
+		{maskedFrameBytes(FrameText, []byte("a"), true), 1, false, ErrProtocol},
+		{frameBytes(FrameText, []byte("a"), true), 1, false, nil},
+	} {
+		r := &Conn{Conn: &FakeConn{b: tc.frame}, client: tc.client, AllowUnmaskedFromClient: tc.allow}
+
+		_, err := r.Read(make([]byte, 10))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("client %v allow %v: expected %v, got %v", tc.client, tc.allow, tc.err, err)
+		}
+	}
+}
+
+func TestReservedBits(t *testing.T) {
+	frame := frameBytes(FrameText, []byte("a"), true)
+	frame[0] |= 0x40
+
+	r := &Conn{Conn: &FakeConn{b: bytes.Clone(frame)}, client: 1}
+
+	_, err := r.Read(make([]byte, 10))
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected %v, got %v", ErrProtocol, err)
+	}
+
+	r = &Conn{Conn: &FakeConn{b: bytes.Clone(frame)}, client: 1, ReservedBits: 0x40}
+
+	n, err := r.Read(make([]byte, 10))
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 byte read, got %v %v", n, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, op := range []Opcode{FramePing, FramePong} {
+		s, c := net.Pipe()
+		defer s.Close()
+		defer c.Close()
+
+		go func() {
+			_, _ = io.Copy(io.Discard, c)
+		}()
+
+		r := &Conn{Conn: s}
+
+		err := r.SetIdleTimeout(100 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("set idle timeout: %v", err)
+		}
+
+		go func() {
+			time.Sleep(60 * time.Millisecond)
+
+			_, _ = c.Write(maskedFrameBytes(op, []byte("payload"), true))
+		}()
+
+		start := time.Now()
+
+		_, _, err = r.ReadMessage(context.Background())
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%v: expected deadline exceeded, got %v", op, err)
+		}
+
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Errorf("%v didn't reset idle timer: %v", op, d)
+		}
+
+		if st := r.Stats(); st.PingsReceived+st.PongsReceived != 1 {
+			t.Errorf("%v: pings received: %v, pongs received: %v", op, st.PingsReceived, st.PongsReceived)
+		}
+	}
+}
+
+func BenchmarkWriteLarge(b *testing.B) {
+	msg := make([]byte, 1<<20)
+
+	for _, client := range []byte{0, 1} {
+		b.Run(fmt.Sprintf("client=%v", client), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+
+			l, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				b.Fatalf("listen: %v", err)
+			}
+
+			defer l.Close()
+
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				defer c.Close()
+
+				_, _ = io.Copy(io.Discard, c)
+			}()
+
+			nc, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatalf("dial: %v", err)
+			}
+
+			w := &Conn{Conn: nc, client: client}
+			defer w.Close()
+
+			for b.Loop() {
+				_, err = w.Write(msg)
+				if err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+		})
+	}
+}
+
+type writeCounter struct {
+	FakeConn
+	writes int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes++
+
+	return c.FakeConn.Write(p)
+}
+
+func TestWriteBuffering(t *testing.T) {
+	ctx := context.Background()
+
+	var wc writeCounter
+
+	w := &Conn{Conn: &wc, client: 1, WriteBufferSize: 100}
+	r := &Conn{Conn: &wc.FakeConn}
+
+	w.SetWriteBuffering(true)
+
+	check := func(name string, writes, msgs int) {
+		t.Helper()
+
+		if wc.writes != writes {
+			t.Errorf("%s: writes %d, expected %d", name, wc.writes, writes)
+		}
+
+		for i := range msgs {
+			_, data, err := r.ReadMessage(ctx)
+			if err != nil || string(data) != fmt.Sprintf("msg %d", i) {
+				t.Errorf("%s: read %d: %q %v", name, i, data, err)
+			}
+		}
+	}
+
+	for i := range 5 {
+		_ = w.WriteMessage(FrameText, fmt.Appendf(nil, "msg %d", i))
+	}
+
+	check("buffered", 0, 0)
+
+	err := w.Flush()
+	if err != nil {
+		t.Errorf("flush: %v", err)
+	}
+
+	check("flush", 1, 5)
+
+	// buffer size reached by 11 bytes frames
+	for i := range 12 {
+		_ = w.WriteMessage(FrameText, fmt.Appendf(nil, "msg %d", i))
+	}
+
+	check("full buffer", 2, 0)
+
+	err = w.Flush()
+	if err != nil {
+		t.Errorf("flush: %v", err)
+	}
+
+	check("flush rest", 3, 12)
+
+	// control frames are not held
+	_ = w.WriteMessage(FrameText, []byte("msg 0"))
+	_, _ = w.WriteFrame([]byte("ping"), FramePing, true)
+
+	check("ping", 4, 1)
+
+	_ = w.WriteMessage(FrameText, []byte("msg 0"))
+
+	err = w.CloseWriter(StatusOK)
+	if err != nil {
+		t.Errorf("close writer: %v", err)
+	}
+
+	check("close", 5, 1)
+
+	_, _, err = r.ReadMessage(ctx)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func BenchmarkWriteSmallFrames(b *testing.B) {
+	msg := []byte("small frame data")
+
+	for _, buffered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("buffered=%v", buffered), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+
+			l, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				b.Fatalf("listen: %v", err)
+			}
+
+			defer l.Close()
+
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				defer c.Close()
+
+				_, _ = io.Copy(io.Discard, c)
+			}()
+
+			nc, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatalf("dial: %v", err)
+			}
+
+			w := &Conn{Conn: nc}
+			defer w.Close()
+
+			w.SetWriteBuffering(buffered)
+
+			for b.Loop() {
+				err = w.WriteMessage(FrameBinary, msg)
+				if err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+
+			err = w.Flush()
+			if err != nil {
+				b.Fatalf("flush: %v", err)
+			}
+		})
+	}
+}
+
+// TestReadNoAllocs makes sure the read path does no hidden work like logging per frame.
+func TestReadNoAllocs(t *testing.T) {
+	ctx := context.Background()
+	frame := maskedFrameBytes(FrameBinary, []byte("small frame data"), true)
+
+	r := &Conn{Conn: &loopConn{b: bytes.Repeat(frame, 64)}}
+	buf := make([]byte, 100)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		n, err := r.Read(buf)
+		if err != nil || n != 16 {
+			t.Fatalf("read: %v %v", n, err)
+		}
+
+		f, err := r.NextFrame(ctx)
+		if err != nil {
+			t.Fatalf("next frame: %v", err)
+		}
+
+		n, err = f.ReadContext(ctx, buf)
+		if !errors.Is(err, io.EOF) || n != 16 {
+			t.Fatalf("read frame: %v %v", n, err)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("allocs per read: %v", allocs)
+	}
+}
+
+func BenchmarkReadManySmallFrames(b *testing.B) {
+	for _, masked := range []bool{false, true} {
+		b.Run(fmt.Sprintf("masked=%v", masked), func(b *testing.B) {
+			b.ReportAllocs()
+
+			frame := frameBytes(FrameBinary, []byte("small frame data"), true)
+			if masked {
+				frame = maskedFrameBytes(FrameBinary, []byte("small frame data"), true)
+			}
+
+			lc := &loopConn{b: bytes.Repeat(frame, 64)}
+			r := &Conn{Conn: lc, client: csel[byte](masked, 0, 1)}
+			buf := make([]byte, 100)
+
+			b.SetBytes(int64(len(frame)))
+
+			for b.Loop() {
+				n, err := r.Read(buf)
+				if err != nil || n != 16 {
+					b.Fatalf("read: %v %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+// loopConn reads b over and over again.
+type loopConn struct {
+	b []byte
+	i int
+
+	net.Conn
+}
+
+func (c *loopConn) Read(p []byte) (n int, err error) {
+	n = copy(p, c.b[c.i:])
+	c.i = (c.i + n) % len(c.b)
+
+	return n, nil
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	var c Conn
+	var key [4]byte
+
+	for _, l := range []int{0, 10, maxLen7, maxLen7 + 1, maxLen16 + 1} {
+		for _, masked := range []bool{false, true} {
+			b := frameBytes(FrameBinary, make([]byte, l), true)
+			if masked {
+				b = maskedFrameBytes(FrameBinary, make([]byte, l), true)
+			}
+
+			h, pl, i := c.parseFrameHeader(b, 0, key[:])
+			if pl != l || i != len(b)-l || h.Opcode() != FrameBinary || h.Masked() != masked {
+				t.Errorf("len %d masked %v: got %v %v %v", l, masked, h, pl, i)
+			}
+
+			_, _, i = c.parseFrameHeader(b[:len(b)-l-1], 0, key[:])
+			if i != -1 {
+				t.Errorf("len %d masked %v: partial header parsed: %v", l, masked, i)
+			}
+		}
+	}
+}
+
+func TestReadProtocolViolations(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"unknown opcode", maskedFrameBytes(Opcode(3), []byte("a"), true), StatusProtocol},
+		{"1-byte close body", maskedFrameBytes(FrameClose, []byte{3}, true), StatusProtocol},
+		{"64-bit length msb", []byte{0x82, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4}, StatusProtocol},
+		{"64-bit length too big", []byte{0x82, 0xff, 0x40, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}, StatusTooBig},
+		{"invalid close reason", maskedFrameBytes(FrameClose, []byte{3, 0xe8, 0xff, 0xfe}, true), StatusFormat},
+		{"invalid text", maskedFrameBytes(FrameText, []byte{'a', 0xff}, true), StatusFormat},
+		{"binary is not checked", maskedFrameBytes(FrameBinary, []byte{'a', 0xff}, true), nil},
+	} {
+		var f FakeConn
+
+		r := &Conn{Conn: &splitConn{r: bytes.NewReader(tc.frame), w: &f}}
+
+		_, _, err := r.ReadMessage(context.Background())
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+
+		if tc.err == nil {
+			continue
+		}
+
+		var s Status
+
+		_, _, err = (&Conn{Conn: &f, client: 1}).ReadMessage(context.Background())
+		if !errors.As(err, &s) || s != tc.err {
+			t.Errorf("%s: expected close %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestReadTextValidation(t *testing.T) {
+	frames := func(ff ...[]byte) []byte { return bytes.Join(ff, nil) }
+
+	readers := map[string]func(c *Conn) error{
+		"ReadMessage": func(c *Conn) error {
+			_, _, err := c.ReadMessage(context.Background())
+			return err
+		},
+		"Read": func(c *Conn) (err error) {
+			var buf [1]byte
+
+			for err == nil {
+				_, err = c.Read(buf[:])
+			}
+
+			return err
+		},
+		"NextFrame": func(c *Conn) error {
+			for {
+				f, err := c.NextFrame(context.Background())
+				if err != nil {
+					return err
+				}
+
+				_, err = f.ReadAppendTo(context.Background(), nil)
+				if err != nil {
+					return err
+				}
+			}
+		},
+		"ReadTo": func(c *Conn) error {
+			_, _, err := c.ReadTo(context.Background(), io.Discard)
+			return err
+		},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		in      []byte
+		invalid bool
+	}{
+		{"rune split between frames", frames(
+			maskedFrameBytes(FrameText, []byte{'a', 0xd0}, false),
+			maskedFrameBytes(FrameContinue, []byte{0xb6, 'b'}, true),
+		), false},
+		{"invalid first fragment", maskedFrameBytes(FrameText, []byte{'a', 0xff}, false), true},
+		{"incomplete rune at the end", maskedFrameBytes(FrameText, []byte{'a', 0xd0}, true), true},
+		{"incomplete rune before the next message", frames(
+			maskedFrameBytes(FrameText, []byte{'a', 0xd0}, true),
+			maskedFrameBytes(FrameText, []byte{0xb6}, true),
+		), true},
+		{"surrogate", maskedFrameBytes(FrameText, []byte{0xed, 0xa0, 0x80}, true), true},
+		{"binary", maskedFrameBytes(FrameBinary, []byte{'a', 0xd0}, true), false},
+	} {
+		for name, read := range readers {
+			var f FakeConn
+
+			r := &Conn{Conn: &splitConn{r: bytes.NewReader(tc.in), w: &f}}
+
+			err := read(r)
+			if errors.Is(err, StatusFormat) != tc.invalid {
+				t.Errorf("%s: %s: invalid %v, got %v", tc.name, name, tc.invalid, err)
+			}
+		}
+	}
+}
+
+func TestInterleavedControlFrames(t *testing.T) {
+	ctx := context.Background()
+
+	var in []byte
+	in = append(in, maskedFrameBytes(FrameText, []byte("first "), false)...)
+	in = append(in, maskedFrameBytes(FramePing, []byte("ping"), true)...)
+	in = append(in, maskedFrameBytes(FrameContinue, []byte("second "), false)...)
+	in = append(in, maskedFrameBytes(FramePong, []byte("pong"), true)...)
+	in = append(in, maskedFrameBytes(FrameContinue, []byte("third"), true)...)
+	in = append(in, maskedFrameBytes(FrameText, []byte("next "), false)...)
+	in = append(in, maskedFrameBytes(FrameClose, []byte{0x03, 0xe8}, true)...)
+
+	var out FakeConn
+
+	r := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: &out}}
+
+	var pong string
+	r.SetPongHandler(func(p []byte) error {
+		pong = string(p)
+		return nil
+	})
+
+	op, data, err := r.ReadMessage(ctx)
+	if err != nil || op != FrameText || string(data) != "first second third" {
+		t.Errorf("read message: %v %q %v", op, data, err)
+	}
+
+	if pong != "pong" {
+		t.Errorf("pong handler: %q", pong)
+	}
+
+	if exp := frameBytes(FramePong, []byte("ping"), true); !bytes.Equal(out.b, exp) {
+		t.Errorf("auto pong: % x, expected % x", out.b, exp)
+	}
+
+	_, _, err = r.ReadMessage(ctx)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("close in the middle of a message: %v", err)
+	}
+}
+
+func TestUnsolicitedPong(t *testing.T) {
+	ctx := context.Background()
+
+	var in []byte
+	in = append(in, maskedFrameBytes(FrameText, []byte("first "), false)...)
+	in = append(in, maskedFrameBytes(FramePong, []byte("unsolicited pong"), true)...)
+	in = append(in, maskedFrameBytes(FrameContinue, []byte("second"), true)...)
+
+	// the payload is discarded without a handler
+	r := &Conn{Conn: &splitConn{r: iotest.OneByteReader(bytes.NewReader(in)), w: io.Discard}}
+
+	op, data, err := r.ReadMessage(ctx)
+	if err != nil || op != FrameText || string(data) != "first second" {
+		t.Errorf("read message: %v %q %v", op, data, err)
+	}
+
+	r = &Conn{Conn: &splitConn{r: iotest.OneByteReader(bytes.NewReader(in)), w: io.Discard}}
+
+	var b bytes.Buffer
+
+	_, _, err = r.ReadTo(ctx, &b)
+	if err != nil || b.String() != "first second" {
+		t.Errorf("read to: %q %v", b.Bytes(), err)
+	}
+
+	// the handler error is returned from the read
+	errUnexpected := errors.New("unexpected pong")
+
+	r = &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: io.Discard}}
+	r.SetPongHandler(func(p []byte) error {
+		return fmt.Errorf("%w: %q", errUnexpected, p)
+	})
+
+	_, _, err = r.ReadMessage(ctx)
+	if !errors.Is(err, errUnexpected) {
+		t.Errorf("expected handler error, got %v", err)
+	}
+
+	// the rest of the message is still in sync
+	buf := make([]byte, 10)
+
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "second" {
+		t.Errorf("read after handler error: %q %v", buf[:n], err)
+	}
+}
+
+func TestCloseFrameSplit(t *testing.T) {
+	in := maskedFrameBytes(FrameText, []byte("frag"), false)
+	in = append(in, maskedFrameBytes(FrameClose, append([]byte{0x0f, 0xa0}, "some close reason"...), true)...)
+
+	var out FakeConn
+
+	r := &Conn{Conn: &splitConn{r: iotest.OneByteReader(bytes.NewReader(in)), w: &out}}
+
+	_, _, err := r.ReadMessage(context.Background())
+
+	var st *StatusText
+	if !errors.As(err, &st) || st.Status != 4000 || st.Text != "some close reason" {
+		t.Errorf("expected close status 4000 with reason, got %v", err)
+	}
+}
+
+func TestCloseBody(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		body  []byte
+		err   error
+		reply Status // close status sent back on failure
+	}{
+		{name: "empty", body: nil, err: io.EOF},
+		{name: "1 byte", body: []byte{0x03}, err: StatusProtocol, reply: StatusProtocol},
+		{name: "normal", body: []byte{0x03, 0xe8}, err: io.EOF},
+		{name: "going away", body: []byte{0x03, 0xe9}, err: StatusGoingAway},
+		{name: "reason", body: append([]byte{0x03, 0xe9}, "bye"...), err: &StatusText{Status: StatusGoingAway, Text: "bye"}},
+		{name: "invalid code", body: []byte{0x03, 0xed}, err: StatusProtocol, reply: StatusProtocol},
+		{name: "invalid reason", body: []byte{0x03, 0xe8, 0xc3}, err: StatusFormat, reply: StatusFormat},
+	} {
+		var out FakeConn
+
+		in := maskedFrameBytes(FrameClose, tc.body, true)
+		r := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: &out}}
+
+		_, _, err := r.ReadMessage(context.Background())
+
+		var st *StatusText
+		if exp, ok := tc.err.(*StatusText); ok {
+			if !errors.As(err, &st) || *st != *exp {
+				t.Errorf("%s: expected %v, got %v", tc.name, exp, err)
+			}
+		} else if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+
+		var exp []byte
+		if tc.reply != 0 {
+			exp = frameBytes(FrameClose, []byte{byte(tc.reply >> 8), byte(tc.reply)}, true)
+		}
+
+		if !bytes.Equal(out.b, exp) {
+			t.Errorf("%s: reply % x, expected % x", tc.name, out.b, exp)
+		}
+
+		_, _, err = r.ReadMessage(context.Background())
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("%s: expected EOF after close, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestEmptyFrames(t *testing.T) {
+	ctx := context.Background()
+
+	if b := frameBytes(FrameText, nil, true); !bytes.Equal(b, []byte{0x81, 0x00}) {
+		t.Errorf("empty text frame: % x", b)
+	}
+
+	if b := maskedFrameBytes(FrameText, nil, true); len(b) != 6 || b[0] != 0x81 || b[1] != 0x80 {
+		t.Errorf("empty masked text frame: % x", b)
+	}
+
+	var in []byte
+	in = append(in, maskedFrameBytes(FrameText, nil, true)...)
+	in = append(in, maskedFrameBytes(FrameBinary, []byte("ab"), false)...)
+	in = append(in, maskedFrameBytes(FrameContinue, nil, true)...)
+	in = append(in, maskedFrameBytes(FrameText, nil, false)...)
+	in = append(in, maskedFrameBytes(FrameContinue, []byte("cd"), true)...)
+	in = append(in, maskedFrameBytes(FrameBinary, nil, false)...)
+	in = append(in, maskedFrameBytes(FrameContinue, nil, true)...)
+
+	r := &Conn{Conn: &splitConn{r: iotest.OneByteReader(bytes.NewReader(in)), w: io.Discard}}
+
+	for i, exp := range []struct {
+		op   Opcode
+		data string
+	}{
+		{FrameText, ""},
+		{FrameBinary, "ab"},
+		{FrameText, "cd"},
+		{FrameBinary, ""},
+	} {
+		op, data, err := r.ReadMessage(ctx)
+		if err != nil || op != exp.op || string(data) != exp.data {
+			t.Errorf("message %d: %v %q %v, expected %v %q", i, op, data, err, exp.op, exp.data)
+		}
+	}
+
+	_, _, err := r.ReadMessage(ctx)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF after the last message, got %v", err)
+	}
+
+	// frame api
+	r = &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: io.Discard}}
+
+	f, err := r.NextFrame(ctx)
+	if err != nil || f.Opcode != FrameText || f.Length != 0 || !f.Final {
+		t.Fatalf("empty frame: %+v %v", f, err)
+	}
+
+	n, err := f.Read(make([]byte, 10))
+	if n != 0 || !errors.Is(err, io.EOF) {
+		t.Errorf("empty frame read: %v %v", n, err)
+	}
+
+	f, err = r.NextFrame(ctx)
+	if err != nil || f.Opcode != FrameBinary || f.Length != 2 {
+		t.Fatalf("second frame: %+v %v", f, err)
+	}
+
+	// Conn.Read returns data of the following frames and 0 bytes for empty ones
+	var got []byte
+	var reads int
+
+	buf := make([]byte, 10)
+
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		reads++
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if reads > 10 {
+			t.Fatalf("too many reads")
+		}
+	}
+
+	if string(got) != "abcd" || reads != 7 {
+		t.Errorf("read %q in %d reads", got, reads)
+	}
+
+	// writer side
+	for _, client := range []byte{0, 1} {
+		var c FakeConn
+
+		w := &Conn{Conn: &c, client: client}
+		r := &Conn{Conn: &c, client: 1 - client}
+
+		err := w.WriteMessage(FrameText, nil)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		_, err = w.WriteFrame([]byte("ef"), FrameBinary, false)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		_, err = w.WriteFrame(nil, FrameContinue, true)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		op, data, err := r.ReadMessage(ctx)
+		if err != nil || op != FrameText || len(data) != 0 {
+			t.Errorf("client %d: empty message: %v %q %v", client, op, data, err)
+		}
+
+		op, data, err = r.ReadMessage(ctx)
+		if err != nil || op != FrameBinary || string(data) != "ef" {
+			t.Errorf("client %d: empty final fragment: %v %q %v", client, op, data, err)
+		}
+	}
+}
+
+func TestFragmentationViolations(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"continuation without start", [][]byte{
+			maskedFrameBytes(FrameContinue, []byte("a"), true),
+		}},
+		{"new message in progress", [][]byte{
+			maskedFrameBytes(FrameText, []byte("a"), false),
+			maskedFrameBytes(FrameBinary, []byte("b"), true),
+		}},
+		{"new message after ping", [][]byte{
+			maskedFrameBytes(FrameText, []byte("a"), false),
+			maskedFrameBytes(FramePing, nil, true),
+			maskedFrameBytes(FrameText, []byte("b"), true),
+		}},
+		{"continuation after final", [][]byte{
+			maskedFrameBytes(FrameText, []byte("a"), true),
+			maskedFrameBytes(FrameContinue, []byte("b"), true),
+		}},
+	} {
+		var in []byte
+
+		for _, fr := range tc.frames {
+			in = append(in, fr...)
+		}
+
+		for _, frames := range []bool{false, true} {
+			var out FakeConn
+
+			r := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: &out}}
+			r.SetPingHandler(func([]byte) error { return nil })
+
+			var err error
+			for err == nil {
+				if frames {
+					_, err = r.NextFrame(context.Background())
+				} else {
+					_, _, err = r.ReadMessage(context.Background())
+				}
+			}
+
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("%s: frames %v: expected %v, got %v", tc.name, frames, ErrProtocol, err)
+			}
+
+			if exp := frameBytes(FrameClose, []byte{0x03, 0xea}, true); !bytes.Equal(out.b, exp) {
+				t.Errorf("%s: frames %v: reply % x, expected % x", tc.name, frames, out.b, exp)
+			}
+		}
+	}
+}
+
+func TestReadSmallBuffer(t *testing.T) {
+	msg := make([]byte, 3*defaultReadBufSize)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	for _, size := range []int{1, 7, defaultReadBufSize - 1} {
+		var f FakeConn
+
+		w := &Conn{Conn: &f, client: 1}
+		r := &Conn{Conn: &f}
+
+		_, _ = w.Write(msg)
+		_, _ = w.Write([]byte("next"))
+
+		var got []byte
+		p := make([]byte, size)
+
+		for len(got) < len(msg)+4 {
+			n, err := r.Read(p)
+			got = append(got, p[:n]...)
+			if err != nil {
+				t.Fatalf("size %d: read at %d: %v", size, len(got), err)
+			}
+		}
+
+		if !bytes.Equal(got, append(msg, "next"...)) {
+			t.Errorf("size %d: data mismatch", size)
+		}
+	}
+}
+
+func TestFrameStreaming(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	_, _ = w.WriteFrame([]byte("first frame"), FrameText, false)
+	_, _ = w.WriteFrame([]byte("skipped"), FrameContinue, true)
+	_, _ = w.WriteFrame([]byte("third"), FrameBinary, true)
+
+	fr, err := r.NextFrame(ctx)
+	if err != nil || fr.Opcode != FrameText || fr.Length != 11 || fr.Final {
+		t.Fatalf("first frame: %+v %v", fr, err)
+	}
+
+	var got []byte
+	buf := make([]byte, 4)
+
+	for fr.More() != 0 {
+		n, err := fr.ReadContext(ctx, buf)
+		got = append(got, buf[:n]...)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatalf("read: %v", err)
+		}
+	}
+
+	if string(got) != "first frame" {
+		t.Errorf("first frame payload: %q", got)
+	}
+
+	fr, err = r.NextFrame(ctx)
+	if err != nil || fr.Opcode != FrameContinue || !fr.Final {
+		t.Fatalf("second frame: %+v %v", fr, err)
+	}
+
+	// the rest of the second frame is skipped by NextFrame
+
+	fr, err = r.NextFrame(ctx)
+	if err != nil || fr.Opcode != FrameBinary {
+		t.Fatalf("third frame: %+v %v", fr, err)
+	}
+
+	got, err = fr.ReadAppendTo(ctx, nil)
+	if string(got) != "third" || !errors.Is(err, io.EOF) {
+		t.Errorf("third frame payload: %q %v", got, err)
+	}
+}
+
+func TestFrameRemaining(t *testing.T) {
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	_, _ = w.WriteFrame([]byte("0123456789"), FrameText, false)
+	_, _ = w.WriteFrame([]byte("abc"), FrameContinue, true)
+
+	if n := r.FrameRemaining(); n != 0 {
+		t.Errorf("remaining before reading: %d", n)
+	}
+
+	buf := make([]byte, 4)
+
+	var got []byte
+
+	for _, exp := range []int{6, 2, 0, 0} {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+
+		if err != nil || r.FrameRemaining() != exp {
+			t.Errorf("read %q: remaining %d, expected %d: %v", buf[:n], r.FrameRemaining(), exp, err)
+		}
+	}
+
+	if string(got) != "0123456789abc" {
+		t.Errorf("read: %q", got)
+	}
+}
+
+func TestAppendReadFrameLimit(t *testing.T) {
+	ctx := context.Background()
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f}
+
+	_, _ = w.WriteFrame([]byte("0123456789"), FrameBinary, true)
+
+	b, err := r.AppendReadFrameLimit(ctx, nil, 4)
+	if err != io.EOF || len(b) != 0 { //nolint:errorlint
+		t.Errorf("no frame: %q %v", b, err)
+	}
+
+	_, err = r.NextFrame(ctx)
+	if err != nil {
+		t.Fatalf("next frame: %v", err)
+	}
+
+	for _, tc := range []struct {
+		limit int
+		exp   string
+		err   error
+	}{
+		{4, "0123", nil},
+		{4, "0123", nil}, // full buffer
+		{2, "0123", nil}, // limit below len(b)
+		{9, "012345678", nil},
+		{10, "0123456789", io.EOF}, // the frame ends exactly at the limit
+		{20, "0123456789", io.EOF},
+	} {
+		b, err = r.AppendReadFrameLimit(ctx, b, tc.limit)
+		if err != tc.err || string(b) != tc.exp { //nolint:errorlint
+			t.Errorf("limit %d: %q %v, expected %q %v", tc.limit, b, err, tc.exp, tc.err)
+		}
+	}
+}
+
+func TestFrameReadContextDeadline(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	go func() {
+		_, _ = c.Write(maskedFrameBytes(FrameText, []byte("0123456789"), true)[:10])
+	}()
+
+	r := &Conn{Conn: s}
+
+	fr, err := r.NextFrame(context.Background())
+	if err != nil {
+		t.Fatalf("next frame: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	buf := make([]byte, 10)
+	var n int
+
+	for err == nil {
+		var m int
+
+		m, err = fr.ReadContext(ctx, buf[n:])
+		n += m
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if n != 4 || fr.More() != 6 {
+		t.Errorf("read %d bytes, %d more", n, fr.More())
+	}
+}
+
+func TestReadContextBigFrame(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	msg := bytes.Repeat([]byte("0123456789"), 0x1000)
+	frame := maskedFrameBytes(FrameBinary, msg, true)
+	hdr := len(frame) - len(msg)
+
+	go func() {
+		_, _ = c.Write(frame[:hdr+10])
+	}()
+
+	r := &Conn{Conn: s}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	buf := make([]byte, len(msg))
+
+	// the frame is bigger than the read buffer, so it's read directly into buf
+	n, err := r.ReadContext(ctx, buf)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if n != 10 {
+		t.Errorf("read %d bytes", n)
+	}
+
+	go func() {
+		_, _ = c.Write(frame[hdr+10:])
+	}()
+
+	for err = nil; err == nil && n < len(msg); {
+		var m int
+
+		m, err = r.ReadContext(context.Background(), buf[n:])
+		n += m
+	}
+
+	if err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Errorf("read the rest: %d %v", n, err)
+	}
+}
+
+func TestReadTo(t *testing.T) {
+	ctx := context.Background()
+
+	msg := make([]byte, 3*defaultReadBufSize+5)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+	r := &Conn{Conn: &f, AllowUnmaskedFromClient: true}
+
+	_ = w.WriteFragmented(FrameBinary, msg, 1000)
+	_, _ = w.WriteFrame([]byte("ping"), FramePing, true)
+	_ = w.WriteMessage(FrameText, []byte("masked"))
+
+	f.b = append(f.b, frameBytes(FrameText, []byte("unmasked"), true)...)
+
+	var buf bytes.Buffer
+
+	n, op, err := r.ReadTo(ctx, &buf)
+	if err != nil || op != FrameBinary || n != int64(len(msg)) || !bytes.Equal(buf.Bytes(), msg) {
+		t.Errorf("read to: %v %v %v, data equal %v", n, op, err, bytes.Equal(buf.Bytes(), msg))
+	}
+
+	for _, exp := range []string{"masked", "unmasked"} {
+		buf.Reset()
+
+		_, op, err = r.ReadTo(ctx, &buf)
+		if err != nil || op != FrameText || buf.String() != exp {
+			t.Errorf("read to: %v %q %v, expected %q", op, buf.Bytes(), err, exp)
+		}
+	}
+}
+
+func TestWriteFrom(t *testing.T) {
+	ctx := context.Background()
+
+	msg := make([]byte, 2*writeFromSize+100)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	for _, tc := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{"reader", bytes.NewReader(msg)},
+		{"one byte", iotest.OneByteReader(bytes.NewReader(msg[:10]))},
+		{"data with eof", iotest.DataErrReader(bytes.NewReader(msg))},
+		{"empty", bytes.NewReader(nil)},
+	} {
+		var f FakeConn
+
+		w := &Conn{Conn: &f, client: 1}
+		r := &Conn{Conn: &f}
+
+		n, err := w.WriteFrom(FrameBinary, tc.r)
+		if err != nil {
+			t.Errorf("%s: write from: %v", tc.name, err)
+		}
+
+		op, data, err := r.ReadMessage(ctx)
+		if err != nil || op != FrameBinary || int64(len(data)) != n || !bytes.Equal(data, msg[:n]) {
+			t.Errorf("%s: read message: %v %v %v, written %v", tc.name, op, len(data), err, n)
+		}
+	}
+
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1}
+
+	_, err := w.WriteFrom(FrameBinary, iotest.ErrReader(io.ErrClosedPipe))
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected reader error, got %v", err)
+	}
+
+	reads := 0
+
+	_, err = w.WriteFrom(FrameBinary, readerFunc(func([]byte) (int, error) {
+		reads++
+		return 0, nil
+	}))
+	if !errors.Is(err, io.ErrNoProgress) || reads != maxConsecutiveEmptyReads {
+		t.Errorf("expected no progress error, got %v after %d reads", err, reads)
+	}
+}
+
+func TestWriteFromPool(t *testing.T) {
+	ctx := context.Background()
+
+	var p countPool
+	var f FakeConn
+
+	w := &Conn{Conn: &f, client: 1, pool: &p}
+	r := &Conn{Conn: &f}
+
+	msg := bytes.Repeat([]byte("data"), defaultReadBufSize)
+
+	n, err := w.WriteFrom(FrameBinary, bytes.NewReader(msg))
+	if err != nil || n != int64(len(msg)) {
+		t.Fatalf("write from: %v %v", n, err)
+	}
+
+	// the write buffer is kept until Close, the WriteFrom one is returned
+	if out := p.Out(); out > 1 {
+		t.Errorf("buffers not returned: %d", out)
+	}
+
+	_, data, err := r.ReadMessage(ctx)
+	if err != nil || !bytes.Equal(data, msg) {
+		t.Errorf("read message: %v %v", len(data), err)
+	}
+
+	// frames are limited by the pool buffer size
+	if frames := r.Stats().FramesRead; frames < int64(len(msg)/defaultReadBufSize) {
+		t.Errorf("frames read: %d", frames)
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		size, max int
+		exp       int
+	}{
+		{0, 0, defaultReadBufSize},
+		{1, 0, minReadBufSize},
+		{256, 0, 256},
+		{256, 0x1000, 0x800}, // grows until frames fit
+		{256, 600, 600},
+	} {
+		var f FakeConn
+
+		w := &Conn{Conn: &f, client: 1, WriteBufferSize: 0x2000}
+		r := &Conn{Conn: &f, ReadBufferSize: tc.size, MaxReadBufferSize: tc.max}
+
+		msg := make([]byte, 1500)
+
+		for i := range 2 * growReadBufAfter * 3 {
+			msg[0] = byte(i)
+
+			_ = w.WriteMessage(FrameBinary, msg)
+
+			_, data, err := r.ReadMessage(ctx)
+			if err != nil || !bytes.Equal(data, msg) {
+				t.Fatalf("size %d max %d: read message %d: %v", tc.size, tc.max, i, err)
+			}
+		}
+
+		if len(r.rbuf) != tc.exp {
+			t.Errorf("size %d max %d: read buffer %d, expected %d", tc.size, tc.max, len(r.rbuf), tc.exp)
+		}
+
+		if cap(w.wbuf) < 0x2000 {
+			t.Errorf("write buffer capacity %d", cap(w.wbuf))
+		}
+	}
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	frame := frameBytes(FrameBinary, make([]byte, 0x3000), true)
+
+	for _, tc := range []struct {
+		size, max int
+	}{
+		{0x200, 0},
+		{0x1000, 0},
+		{0x10000, 0},
+		{0x200, 0x10000},
+	} {
+		b.Run(fmt.Sprintf("size=%x/max=%x", tc.size, tc.max), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+
+			lc := &loopConn{b: bytes.Repeat(frame, 4)}
+			r := &Conn{Conn: lc, client: 1, ReadBufferSize: tc.size, MaxReadBufferSize: tc.max}
+
+			var buf []byte
+
+			for b.Loop() {
+				var err error
+
+				_, buf, err = r.appendMessage(context.Background(), buf[:0])
+				if err != nil {
+					b.Fatalf("read: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAbnormalClose(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		buf  int
+	}{
+		{"payload", maskedFrameBytes(FrameBinary, make([]byte, 10), true)[:10], 100},
+		{"direct payload", maskedFrameBytes(FrameBinary, make([]byte, 0x3000), true)[:0x2000], 0x3000},
+		{"header", maskedFrameBytes(FrameBinary, make([]byte, 0x3000), true)[:3], 100},
+	} {
+		r := &Conn{Conn: &FakeConn{b: tc.data}}
+
+		var err error
+		for err == nil {
+			_, err = r.Read(make([]byte, tc.buf))
+		}
+
+		if !errors.Is(err, StatusAbnormal) || !errors.Is(err, io.ErrUnexpectedEOF) || CloseStatus(err) != 0 {
+			t.Errorf("%s: expected abnormal closure, got %v", tc.name, err)
+		}
+	}
+
+	r := &Conn{Conn: &FakeConn{b: maskedFrameBytes(FrameBinary, []byte("data"), true)}}
+
+	_, _, err := r.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+
+	_, _, err = r.ReadMessage(ctx)
+	if err != io.EOF {
+		t.Errorf("expected EOF on a frame boundary, got %v", err)
+	}
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	ctx := context.Background()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	defer l.Close()
+
+	p1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	p2, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	a := &Conn{Conn: p1, client: 1}
+	b := &Conn{Conn: p2}
+
+	const n = 200
+
+	var wg sync.WaitGroup
+
+	for _, c := range []*Conn{a, b} {
+		wg.Add(2)
+
+		go func() { // writer
+			defer wg.Done()
+
+			for i := range n {
+				err := c.WriteMessage(FrameText, fmt.Appendf(nil, "message %d", i))
+				if err != nil {
+					t.Errorf("write: %v", err)
+					return
+				}
+
+				if i%10 == 0 {
+					_, err = c.WriteFrame([]byte("ping"), FramePing, true)
+					if err != nil {
+						t.Errorf("ping: %v", err)
+						return
+					}
+				}
+			}
+
+			_ = c.CloseWriter(StatusOK)
+		}()
+
+		go func() { // reader
+			defer wg.Done()
+
+			for i := 0; ; i++ {
+				_, data, err := c.ReadMessage(ctx)
+				if errors.Is(err, io.EOF) {
+					if i != n {
+						t.Errorf("read %d messages, expected %d", i, n)
+					}
+
+					return
+				}
+				if err != nil {
+					t.Errorf("read: %v", err)
+					return
+				}
+
+				if exp := fmt.Sprintf("message %d", i); string(data) != exp {
+					t.Errorf("read %q, expected %q", data, exp)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	_ = a.Close()
+	_ = b.Close()
+
+	for _, c := range []*Conn{a, b} {
+		if st := c.Stats(); st.PingsReceived != n/10 {
+			t.Errorf("pings received: %v, expected %v", st.PingsReceived, n/10)
+		}
+	}
+}
+
+func TestPongSlowWriter(t *testing.T) {
+	ctx := context.Background()
+
+	var in []byte
+
+	for i := range 3 {
+		in = append(in, maskedFrameBytes(FramePing, fmt.Appendf(nil, "ping %d", i), true)...)
+	}
+
+	in = append(in, maskedFrameBytes(FrameText, []byte("data"), true)...)
+
+	pr, pw := io.Pipe()
+
+	c := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: pw}}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- c.WriteMessage(FrameBinary, []byte("blocked"))
+	}()
+
+	// wait for the writer to block in the pipe holding the lock
+	out := make([]byte, 2)
+
+	_, err := io.ReadFull(pr, out)
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		op, p, err := c.ReadMessage(ctx)
+		if err != nil || op != FrameText || string(p) != "data" {
+			t.Errorf("read message: %v %q %v", op, p, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("reader is blocked by the writer")
+	}
+
+	rest := make([]byte, len("blocked"))
+
+	_, err = io.ReadFull(pr, rest)
+	if err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+
+	exp := frameBytes(FramePong, []byte("ping 2"), true)
+	pong := make([]byte, len(exp))
+
+	_, err = io.ReadFull(pr, pong)
+	if err != nil {
+		t.Fatalf("read pong: %v", err)
+	}
+
+	if !bytes.Equal(pong, exp) {
+		t.Errorf("pong: %q, expected %q", pong, exp)
+	}
+
+	err = <-errc
+	if err != nil {
+		t.Errorf("write: %v", err)
+	}
+
+	if st := c.Stats(); st.PingsReceived != 3 {
+		t.Errorf("pings received: %v", st.PingsReceived)
+	}
+}
+
+func TestMaxMessageSizeFragmented(t *testing.T) {
+	ctx := context.Background()
+
+	var in []byte
+
+	in = append(in, maskedFrameBytes(FrameText, []byte("first "), false)...)
+	in = append(in, maskedFrameBytes(FrameContinue, []byte("second "), false)...)
+	in = append(in, maskedFrameBytes(FrameContinue, []byte("third"), true)...)
+	in = append(in, maskedFrameBytes(FrameText, []byte("next"), true)...)
+
+	var out bytes.Buffer
+
+	c := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: &out}, MaxMessageSize: 10}
+
+	_, _, err := c.ReadMessage(ctx)
+	if !errors.Is(err, ErrTooBig) {
+		t.Errorf("expected %v, got %v", ErrTooBig, err)
+	}
+
+	if exp := frameBytes(FrameClose, []byte{0x03, 0xf1}, true); !bytes.Equal(out.Bytes(), exp) {
+		t.Errorf("close frame: % x, expected % x", out.Bytes(), exp)
+	}
+
+	// the rest of the message is not parsed as frames
+	for range 2 {
+		_, p, err := c.ReadMessage(ctx)
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("read after failure: %q %v", p, err)
+		}
+	}
+
+	_, err = c.Read(make([]byte, 10))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("read after failure: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+
+	p0, p1 := newPipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	a := &Conn{Conn: p0, client: 1}
+	b := &Conn{Conn: p1}
+
+	got := make(chan struct{}, 10)
+	reply := make(chan bool, 10)
+
+	// the peer replies or drops pings as told, it replies only to the latest one
+	b.SetPingHandler(func(p []byte) error {
+		got <- struct{}{}
+
+		if !<-reply {
+			return nil
+		}
+
+		_, err := b.WriteFrame(p, FramePong, true)
+
+		return err
+	})
+
+	for _, c := range []*Conn{a, b} {
+		go func() {
+			for {
+				_, _, err := c.ReadMessage(ctx)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	reply <- true
+
+	rtt, err := a.Ping(ctx)
+	if err != nil || rtt <= 0 {
+		t.Errorf("ping: %v %v", rtt, err)
+	}
+
+	<-got
+
+	// no reply
+	reply <- false
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err = a.Ping(tctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	<-got
+
+	// outstanding pings are completed by the pong to the latest one
+	reply <- false
+	reply <- true
+
+	errc := make(chan error, 1)
+
+	go func() {
+		_, err := a.Ping(ctx)
+		errc <- err
+	}()
+
+	<-got
+
+	_, err = a.Ping(ctx)
+	if err != nil {
+		t.Errorf("ping: %v", err)
+	}
+
+	if err := <-errc; err != nil {
+		t.Errorf("outstanding ping: %v", err)
+	}
+
+	<-got
+
+	a.pmu.Lock()
+	n := len(a.pings)
+	a.pmu.Unlock()
+
+	if n != 0 {
+		t.Errorf("waiting pings left: %v", n)
+	}
+
+	// unsolicited pong doesn't complete a ping
+	reply <- false
+
+	tctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err = b.WriteFrame([]byte("\x00\x00\x00\x00\x00\x00\x00\x10"), FramePong, true)
+	if err != nil {
+		t.Fatalf("write pong: %v", err)
+	}
+
+	_, err = a.Ping(tctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	ctx := context.Background()
+
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	c := &Conn{Conn: p0, client: 1}
+	peer := &Conn{Conn: p1}
+
+	s := c.StreamConn()
+
+	if _, ok := s.(*Conn); ok {
+		t.Errorf("stream conn exposes Conn")
+	}
+
+	go func() {
+		_, _ = s.Write([]byte("request"))
+	}()
+
+	op, data, err := peer.ReadMessage(ctx)
+	if err != nil || op != FrameBinary || string(data) != "request" {
+		t.Errorf("peer read: %v %q %v", op, data, err)
+	}
+
+	go func() {
+		_ = peer.WriteFragmented(FrameText, []byte("hello"), 3)
+		_ = peer.WriteMessage(FrameBinary, nil)
+		_, _ = peer.WriteFrame([]byte(", "), FrameBinary, false)
+		_, _ = peer.WriteFrame(nil, FrameContinue, false)
+		_, _ = peer.WriteFrame([]byte("world"), FrameContinue, true)
+		_ = peer.CloseWriter(StatusOK)
+	}()
+
+	var got []byte
+	buf := make([]byte, 4)
+
+	for {
+		n, err := s.Read(buf)
+		got = append(got, buf[:n]...)
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil || n == 0 {
+			t.Fatalf("read stream: %v %v", n, err)
+		}
+	}
+
+	if string(got) != "hello, world" {
+		t.Errorf("read stream: %q", got)
+	}
+}
+
+func TestMessageConn(t *testing.T) {
+	var f FakeConn
+
+	for _, op := range []Opcode{FrameContinue, FramePing, FramePong, FrameClose, 3} {
+		m, err := (&Conn{Conn: &f}).MessageConn(op)
+		if m != nil || err != UnexpectedOpcode(op) {
+			t.Errorf("message conn %v: expected unexpected opcode error, got %v %v", op, m, err)
+		}
+	}
+
+	w, err := (&Conn{Conn: &f, client: 1}).MessageConn(FrameText)
+	if err != nil {
+		t.Fatalf("message conn: %v", err)
+	}
+
+	r, err := (&Conn{Conn: &f}).MessageConn(FrameBinary)
+	if err != nil {
+		t.Fatalf("message conn: %v", err)
+	}
+
+	if r.Opcode() != 0 {
+		t.Errorf("opcode before reading: %v", r.Opcode())
+	}
+
+	_, _ = w.Write([]byte("text by default"))
+	_, _ = w.WriteBinary([]byte("binary"))
+	_, _ = w.WriteText([]byte("text"))
+	_, _ = w.WriteText(nil)
+
+	// fragmented message keeps the first frame opcode
+	_, _ = w.c.WriteFrame([]byte("frag"), FrameBinary, false)
+	_, _ = w.c.WriteFrame([]byte("mented"), FrameContinue, true)
+
+	for i, exp := range []struct {
+		op   Opcode
+		data string
+	}{
+		{FrameText, "text by default"},
+		{FrameBinary, "binary"},
+		{FrameText, "text"},
+		{FrameText, ""},
+		{FrameBinary, "frag"},
+		{FrameBinary, "mented"},
+	} {
+		buf := make([]byte, 100)
+
+		n, err := r.Read(buf)
+		if err != nil || r.Opcode() != exp.op || string(buf[:n]) != exp.data {
+			t.Errorf("read %d: %v %q %v, expected %v %q", i, r.Opcode(), buf[:n], err, exp.op, exp.data)
+		}
+	}
+
+	// reply with the same opcode
+	_, _ = r.Write([]byte("binary by default"))
+
+	buf := make([]byte, 100)
+
+	n, err := w.Read(buf)
+	if err != nil || w.Opcode() != FrameBinary || string(buf[:n]) != "binary by default" {
+		t.Errorf("read reply: %v %q %v", w.Opcode(), buf[:n], err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	_, err = r.Read(buf)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF after close, got %v", err)
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	ctx := context.Background()
+
+	stream := func(masked bool, msgs ...string) *FakeConn {
+		var f FakeConn
+
+		w := &Conn{Conn: &f, client: csel[byte](masked, 1, 0)}
+
+		for _, m := range msgs {
+			_ = w.WriteMessage(FrameText, []byte(m))
+		}
+
+		_ = w.CloseWriter(StatusOK)
+
+		return &f
+	}
+
+	c := &Conn{Conn: stream(true, "first", "second")}
+
+	var rbuf *byte
+
+	for i, tc := range []struct {
+		f      *FakeConn
+		client bool
+		msgs   []string
+	}{
+		{c.Conn.(*FakeConn), false, []string{"first", "second"}},
+		{stream(true, "third"), false, []string{"third"}},
+		{stream(false, "fourth", "fifth"), true, []string{"fourth", "fifth"}},
+	} {
+		if i != 0 {
+			c.Reset(tc.f, tc.client)
+		}
+
+		for _, m := range tc.msgs {
+			_, data, err := c.ReadMessage(ctx)
+			if err != nil || string(data) != m {
+				t.Fatalf("stream %d: read: %q %v", i, data, err)
+			}
+		}
+
+		_, _, err := c.ReadMessage(ctx)
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("stream %d: expected EOF, got %v", i, err)
+		}
+
+		err = c.WriteMessage(FrameBinary, []byte("reply"))
+		if err != nil {
+			t.Errorf("stream %d: write: %v", i, err)
+		}
+
+		err = c.CloseWriter(StatusOK)
+		if err != nil {
+			t.Errorf("stream %d: close writer: %v", i, err)
+		}
+
+		if st := c.Stats(); st.MessagesRead != int64(len(tc.msgs)) || st.Client != tc.client {
+			t.Errorf("stream %d: stats: %+v", i, st)
+		}
+
+		if i == 0 {
+			rbuf = &c.rbuf[0]
+		} else if &c.rbuf[0] != rbuf {
+			t.Errorf("stream %d: read buffer reallocated", i)
+		}
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	ctx := context.Background()
+
+	for _, closeFn := range []func(c *Conn) error{
+		func(c *Conn) error { return c.CloseWriter(StatusOK) },
+		func(c *Conn) error { return c.CloseWriterText(StatusGoingAway, "bye") },
+		(*Conn).Close,
+	} {
+		var f FakeConn
+
+		w := &Conn{Conn: &f, client: 1}
+
+		err := closeFn(w)
+		if err != nil {
+			t.Fatalf("close: %v", err)
+		}
+
+		size := len(f.b)
+
+		for _, write := range []func() error{
+			func() error { return w.WriteMessage(FrameText, []byte("data")) },
+			func() error { return w.WritePing(nil) },
+			func() error { _, err := w.Write([]byte("data")); return err },
+			func() error { _, err := w.Ping(ctx); return err },
+		} {
+			err = write()
+			if !errors.Is(err, ErrWriteClosed) {
+				t.Errorf("expected %v, got %v", ErrWriteClosed, err)
+			}
+		}
+
+		if len(f.b) != size {
+			t.Errorf("written after close: % x", f.b[size:])
+		}
+
+		// the stream ends with the close frame
+		r := &Conn{Conn: &f}
+
+		_, _, err = r.ReadMessage(ctx)
+		if err == nil || errors.Is(err, ErrProtocol) {
+			t.Errorf("read: %v", err)
+		}
+	}
+}
+
+func TestPingMatching(t *testing.T) {
+	ctx := context.Background()
+
+	p0, p1 := newPipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	a := &Conn{Conn: p0, client: 1}
+	b := &Conn{Conn: p1}
+
+	pongs := make(chan []byte, 10)
+	a.SetPongHandler(func(p []byte) error {
+		pongs <- bytes.Clone(p)
+		return nil
+	})
+
+	// the peer replies manually
+	pings := make(chan []byte, 10)
+	b.SetPingHandler(func(p []byte) error {
+		pings <- bytes.Clone(p)
+		return nil
+	})
+
+	for _, c := range []*Conn{a, b} {
+		go func() {
+			for {
+				_, _, err := c.ReadMessage(ctx)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		_, err := a.Ping(ctx)
+		errc <- err
+	}()
+
+	ping := <-pings
+	if len(ping) != pingPayloadSize {
+		t.Fatalf("ping payload: % x", ping)
+	}
+
+	// peer pings are replied automatically and don't interfere
+	err := b.WritePing(ping)
+	if err != nil {
+		t.Fatalf("peer ping: %v", err)
+	}
+
+	wrongTag := bytes.Clone(ping)
+	wrongTag[0]++
+
+	wrongID := bytes.Clone(ping)
+	wrongID[len(wrongID)-1]++
+
+	for _, p := range [][]byte{wrongTag, wrongID, ping[:8], []byte("unsolicited")} {
+		err = b.WritePong(p)
+		if err != nil {
+			t.Fatalf("write pong: %v", err)
+		}
+
+		if got := <-pongs; !bytes.Equal(got, p) {
+			t.Errorf("pong handler got % x, expected % x", got, p)
+		}
+
+		a.pmu.Lock()
+		n := len(a.pings)
+		a.pmu.Unlock()
+
+		if n != 1 {
+			t.Errorf("pong % x completed the ping", p)
+		}
+	}
+
+	err = b.WritePong(ping)
+	if err != nil {
+		t.Fatalf("write pong: %v", err)
+	}
+
+	if err := <-errc; err != nil {
+		t.Errorf("ping: %v", err)
+	}
+
+	if got := <-pongs; !bytes.Equal(got, ping) {
+		t.Errorf("matched pong is not passed to the handler: % x", got)
+	}
+}
+
+func TestPingClosed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		close func(a, b *Conn, p1 net.Conn)
+		err   error
+	}{
+		{"close frame", func(a, b *Conn, p1 net.Conn) { _ = b.CloseWriter(StatusGoingAway) }, ErrClosed},
+		{"connection lost", func(a, b *Conn, p1 net.Conn) { _ = p1.Close() }, io.EOF},
+		{"conn closed", func(a, b *Conn, p1 net.Conn) { _ = a.Close() }, net.ErrClosed},
+	} {
+		p0, p1 := newPipe()
+
+		a := &Conn{Conn: p0, client: 1}
+		b := &Conn{Conn: p1}
+
+		go func() {
+			for {
+				_, _, err := a.ReadMessage(context.Background())
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		errc := make(chan error, 1)
+
+		go func() {
+			_, err := a.Ping(nil) //nolint:staticcheck
+			errc <- err
+		}()
+
+		for {
+			a.pmu.Lock()
+			n := len(a.pings)
+			a.pmu.Unlock()
+
+			if n != 0 {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+
+		tc.close(a, b, p1)
+
+		select {
+		case err := <-errc:
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: ping is not released", tc.name)
+		}
+
+		// fails right away either on write or on wait
+		_, err := a.Ping(nil) //nolint:staticcheck
+		if err == nil {
+			t.Errorf("%s: ping after close succeeded", tc.name)
+		}
+
+		_ = p0.Close()
+		_ = p1.Close()
+	}
+}
+
+func TestStopperNoLeak(t *testing.T) {
+	var c FakeConn
+
+	w := &Conn{
+		Conn:   &c,
+		client: 1,
+	}
+
+	r := &Conn{
+		Conn: &c,
+		rbuf: make([]byte, 16),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := runtime.NumGoroutine()
+
+	for i := range 1000 {
+		_, err := w.Write([]byte("message"))
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+
+		var buf [8]byte
+
+		for _, ctx := range []context.Context{nil, context.Background(), ctx} {
+			_, err = r.ReadContext(ctx, buf[:2])
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatalf("read %d: %v", i, err)
+			}
+		}
+
+		_, err = r.ReadContext(ctx, buf[:])
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: %d -> %d", before, after)
+	}
+}
+
+func TestStopper(t *testing.T) {
+	var mu sync.Mutex
+	var deads []time.Time
+
+	killed := make(chan struct{}, 10)
+
+	dead := func(d time.Time) error {
+		defer mu.Unlock()
+		mu.Lock()
+
+		deads = append(deads, d)
+
+		if !d.IsZero() {
+			killed <- struct{}{}
+		}
+
+		return nil
+	}
+
+	Stopper(nil, dead)() //nolint:staticcheck
+	Stopper(context.Background(), dead)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	Stopper(ctx, dead)()
+
+	if len(deads) != 0 {
+		t.Fatalf("deadline changed: %v", deads)
+	}
+
+	stop := Stopper(ctx, dead)
+	cancel()
+	<-killed
+	stop()
+
+	if len(deads) != 2 || !deads[0].Before(time.Now()) || !deads[1].IsZero() {
+		t.Errorf("deadlines: %v", deads)
+	}
+
+	deads = nil
+
+	stop = Stopper(ctx, dead)
+	<-killed
+	stop()
+
+	if len(deads) != 2 || !deads[1].IsZero() {
+		t.Errorf("deadlines after cancel: %v", deads)
+	}
+}
+
+func TestNilContextTimeouts(t *testing.T) {
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	c := &Conn{Conn: p1}
+	past := time.Now().Add(-time.Second)
+
+	check := func(name string, err error) {
+		t.Helper()
+
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s: expected deadline exceeded, got %v", name, err)
+		}
+	}
+
+	_ = c.SetReadDeadline(past)
+
+	_, err := c.Read(make([]byte, 10))
+	check("read", err)
+
+	_, err = c.ReadContext(nil, make([]byte, 10)) //nolint:staticcheck
+	check("read context", err)
+
+	_, err = c.NextFrame(nil) //nolint:staticcheck
+	check("next frame", err)
+
+	_, _, err = c.ReadMessage(nil) //nolint:staticcheck
+	check("read message", err)
+
+	_ = c.SetReadDeadline(time.Time{})
+
+	go func() {
+		_, _ = p0.Write(maskedFrameBytes(FrameBinary, []byte("hello, world"), true)[:6])
+	}()
+
+	f, err := c.NextFrame(nil) //nolint:staticcheck
+	if err != nil {
+		t.Fatalf("next frame: %v", err)
+	}
+
+	_ = c.SetReadDeadline(past)
+
+	_, err = f.Read(make([]byte, 20))
+	check("frame read", err)
+
+	_ = c.SetWriteDeadline(past)
+
+	_, err = c.Write([]byte("data"))
+	check("write", err)
+
+	_, err = c.WriteFrame([]byte("data"), FrameText, true)
+	check("write frame", err)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	p0, p1 := net.Pipe()
+	defer p0.Close()
+	defer p1.Close()
+
+	c := &Conn{Conn: p0, WriteTimeout: 10 * time.Millisecond}
+
+	for _, tc := range []struct {
+		name  string
+		write func() error
+	}{
+		{"write", func() error { _, err := c.Write([]byte("data")); return err }},
+		{"write message", func() error { return c.WriteMessage(FrameText, []byte("data")) }},
+		{"write ping", func() error { return c.WritePing(nil) }},
+		{"write control", func() error { return c.WriteControl(FramePing, nil, time.Now().Add(time.Hour)) }},
+		{"flush", func() error {
+			c.SetWriteBuffering(true)
+			defer c.SetWriteBuffering(false)
+
+			_, _ = c.Write([]byte("data"))
+
+			return c.Flush()
+		}},
+	} {
+		start := time.Now()
+
+		err := tc.write()
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s: expected deadline exceeded, got %v", tc.name, err)
+		}
+
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: took too long: %v", tc.name, d)
+		}
+	}
+
+	// the timeout is counted from the write start, not from setting it
+
+	time.Sleep(20 * time.Millisecond)
+
+	go func() {
+		_, _ = io.Copy(io.Discard, p1)
+	}()
+
+	err := c.WriteMessage(FrameText, []byte("data"))
+	if err != nil {
+		t.Errorf("write with reader: %v", err)
+	}
+
+	// the earlier of deadline and timeout is used
+
+	_ = c.SetWriteDeadline(time.Now().Add(-time.Second))
+
+	err = c.WriteMessage(FrameText, []byte("data"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestWriteTimeoutQueuedReply(t *testing.T) {
+	ctx := context.Background()
+
+	cp, sp := newPipe()
+	defer cp.Close()
+
+	s := &Conn{Conn: sp, WriteTimeout: 50 * time.Millisecond}
+	c := &Conn{Conn: cp, client: 1}
+
+	err := s.WriteMessage(FrameText, []byte("first"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// the deadline armed by the write has passed by the time the pong is sent
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, _ = cp.Write(maskedFrameBytes(FramePing, []byte("ping"), true))
+	_, _ = cp.Write(maskedFrameBytes(FrameText, []byte("data"), true))
+
+	_, data, err := s.ReadMessage(ctx)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("read: %q %v", data, err)
+	}
+
+	for _, exp := range []struct {
+		op Opcode
+		p  string
+	}{{FrameText, "first"}, {FramePong, "ping"}} {
+		f, err := c.NextRawFrame(ctx)
+		if err != nil {
+			t.Fatalf("client read: %v", err)
+		}
+
+		p, err := f.ReadAppendTo(ctx, nil)
+		if !errors.Is(err, io.EOF) || f.Opcode != exp.op || string(p) != exp.p {
+			t.Errorf("client read: %v %q %v, expected %v %q", f.Opcode, p, err, exp.op, exp.p)
+		}
+	}
+
+	// a failed reply is reported to the writer, not to the reader
+
+	_ = s.SetWriteDeadline(time.Now().Add(-time.Second))
+
+	_, _ = cp.Write(maskedFrameBytes(FramePing, []byte("ping"), true))
+	_, _ = cp.Write(maskedFrameBytes(FrameText, []byte("data"), true))
+
+	_, data, err = s.ReadMessage(ctx)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("read after failed reply: %q %v", data, err)
+	}
+
+	_ = s.SetWriteDeadline(time.Time{})
+
+	err = s.WriteMessage(FrameText, []byte("data"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the reply error on write, got %v", err)
+	}
+
+	err = s.Close()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the reply error on close, got %v", err)
+	}
+}
+
+func TestReadMessageInterrupted(t *testing.T) {
+	cp, sp := newPipe()
+	defer cp.Close()
+
+	w := &Conn{Conn: cp, client: 1}
+	r := &Conn{Conn: sp}
+
+	timeout := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 50*time.Millisecond)
+	}
+
+	// nothing is read yet, the read can be retried
+
+	ctx, cancel := timeout()
+	defer cancel()
+
+	_, _, err := r.ReadMessage(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	_ = w.WriteMessage(FrameText, []byte("first"))
+
+	op, data, err := r.ReadMessage(context.Background())
+	if err != nil || op != FrameText || string(data) != "first" {
+		t.Fatalf("read after retry: %v %q %v", op, data, err)
+	}
+
+	// the deadline fires between fragments
+
+	_, _ = w.WriteFrame(make([]byte, 5000), FrameBinary, false)
+
+	ctx, cancel = timeout()
+	defer cancel()
+
+	_, _, err = r.ReadMessage(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	_, _ = w.WriteFrame(make([]byte, 8000), FrameContinue, true)
+	_ = w.WriteMessage(FrameText, []byte("next"))
+
+	for range 2 {
+		op, data, err = r.ReadMessage(context.Background())
+		if !errors.Is(err, ErrReadInterrupted) || errors.Is(err, context.DeadlineExceeded) || len(data) != 0 {
+			t.Errorf("read after interrupted message: %v %d bytes %v", op, len(data), err)
+		}
+	}
+
+	_, _, err = r.ReadTo(context.Background(), io.Discard)
+	if !errors.Is(err, ErrReadInterrupted) {
+		t.Errorf("read to after interrupted message: %v", err)
+	}
+
+	// frames are still in sync
+
+	buf := make([]byte, 10000)
+
+	n, err := r.Read(buf)
+	if err != nil || n != 8000 || r.MessageOpcode() != FrameBinary {
+		t.Errorf("read the rest: %d %v %v", n, r.MessageOpcode(), err)
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	ctx := context.Background()
+
+	c, s := pipeHandshake(t, &Server{Subprotocols: []string{"proto"}}, &Client{Subprotocols: []string{"proto"}})
+
+	if c.Subprotocol() != "proto" || s.Subprotocol() != "proto" {
+		t.Errorf("subprotocol: client %q server %q", c.Subprotocol(), s.Subprotocol())
+	}
+
+	// both sides write first
+	for i, w := range []*Conn{c, s} {
+		err := w.WriteMessage(FrameText, fmt.Appendf(nil, "message %d", i))
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	for i, r := range []*Conn{s, c} {
+		_, data, err := r.ReadMessage(ctx)
+		if exp := fmt.Sprintf("message %d", i); err != nil || string(data) != exp {
+			t.Errorf("read %d: %q %v, expected %q", i, data, err, exp)
+		}
+	}
+
+	// ping is replied by the server reader
+	msgs := make(chan string, 1)
+
+	go func() {
+		defer close(msgs)
+
+		for {
+			_, data, err := s.ReadMessage(ctx)
+			if err != nil {
+				return
+			}
+
+			msgs <- string(data)
+		}
+	}()
+
+	cerr := make(chan error, 1)
+
+	go func() {
+		for {
+			_, _, err := c.ReadMessage(ctx)
+			if err != nil {
+				cerr <- err
+				return
+			}
+		}
+	}()
+
+	_, err := c.Ping(ctx)
+	if err != nil {
+		t.Errorf("ping: %v", err)
+	}
+
+	err = c.WriteMessage(FrameText, []byte("after ping"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if m := <-msgs; m != "after ping" {
+		t.Errorf("read after ping: %q", m)
+	}
+
+	// close handshake: the server reader sees the close frame and the server replies
+	err = c.CloseWriter(StatusOK)
+	if err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	if m, ok := <-msgs; ok {
+		t.Errorf("unexpected message: %q", m)
+	}
+
+	err = s.CloseWriter(StatusOK)
+	if err != nil {
+		t.Fatalf("server close writer: %v", err)
+	}
+
+	if err := <-cerr; !errors.Is(err, io.EOF) {
+		t.Errorf("client read: %v", err)
+	}
+
+	if st := s.Stats(); st.PingsReceived != 1 {
+		t.Errorf("server pings received: %v", st.PingsReceived)
+	}
+
+	_ = c.Close()
+	_ = s.Close()
+}
+
+func TestMessageOpcode(t *testing.T) {
+	ctx := context.Background()
+
+	var in []byte
+
+	for _, f := range []struct {
+		op    Opcode
+		data  string
+		final bool
+	}{
+		{FrameText, "first ", false},
+		{FrameContinue, "text ", false},
+		{FramePing, "ping", true},
+		{FrameContinue, "message", true},
+		{FrameBinary, "bin", false},
+		{FrameContinue, "ary", true},
+	} {
+		in = append(in, maskedFrameBytes(f.op, []byte(f.data), f.final)...)
+	}
+
+	in = append(in, maskedFrameBytes(FrameBinary, []byte("whole"), true)...)
+
+	c := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: io.Discard}}
+
+	if op := c.MessageOpcode(); op != 0 {
+		t.Errorf("message opcode before the first message: %v", op)
+	}
+
+	for _, exp := range []struct {
+		op, msg Opcode
+	}{
+		{FrameText, FrameText},
+		{FrameContinue, FrameText},
+		{FramePing, FrameText},
+		{FrameContinue, FrameText},
+		{FrameBinary, FrameBinary},
+		{FrameContinue, FrameBinary},
+	} {
+		f, err := c.NextRawFrame(ctx)
+		if err != nil {
+			t.Fatalf("next frame: %v", err)
+		}
+
+		if f.Opcode != exp.op || c.MessageOpcode() != exp.msg {
+			t.Errorf("frame %v message %v, expected %v %v", f.Opcode, c.MessageOpcode(), exp.op, exp.msg)
+		}
+	}
+
+	op, data, err := c.ReadMessage(ctx)
+	if err != nil || op != FrameBinary || string(data) != "whole" || c.MessageOpcode() != FrameBinary {
+		t.Errorf("read message: %v %q %v, message opcode %v", op, data, err, c.MessageOpcode())
+	}
+}
+
+func TestReadMessageClosed(t *testing.T) {
+	ctx := context.Background()
+
+	closeFrame := func(s Status, reason string) []byte {
+		return maskedFrameBytes(FrameClose, append(binary.BigEndian.AppendUint16(nil, uint16(s)), reason...), true)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		end    []byte
+		closed bool
+		eof    bool
+		status Status
+	}{
+		{"clean close", closeFrame(StatusOK, ""), true, true, StatusOK},
+		{"empty close", maskedFrameBytes(FrameClose, nil, true), true, true, StatusOK},
+		{"going away", closeFrame(StatusGoingAway, "bye"), true, false, StatusGoingAway},
+		{"protocol violation", maskedFrameBytes(FrameContinue, []byte("x"), true), true, false, StatusProtocol},
+		{"transport eof", nil, false, true, 0},
+	} {
+		var in []byte
+
+		in = append(in, maskedFrameBytes(FrameText, []byte("first"), true)...)
+		in = append(in, maskedFrameBytes(FrameBinary, []byte("second"), true)...)
+		in = append(in, tc.end...)
+
+		c := &Conn{Conn: &splitConn{r: bytes.NewReader(in), w: io.Discard}}
+
+		for _, exp := range []string{"first", "second"} {
+			_, data, err := c.ReadMessage(ctx)
+			if err != nil || string(data) != exp {
+				t.Errorf("%s: read message: %q %v, expected %q", tc.name, data, err, exp)
+			}
+		}
+
+		for range 2 {
+			_, data, err := c.ReadMessage(ctx)
+			if err == nil || len(data) != 0 {
+				t.Errorf("%s: expected error, got %q %v", tc.name, data, err)
+			}
+
+			if errors.Is(err, ErrClosed) != tc.closed || errors.Is(err, io.EOF) != tc.eof || CloseStatus(err) != tc.status {
+				t.Errorf("%s: unexpected error: %v (closed %v, eof %v, status %v)",
+					tc.name, err, errors.Is(err, ErrClosed), errors.Is(err, io.EOF), CloseStatus(err))
+			}
+
+			if !tc.closed {
+				break
+			}
+
+			tc.eof = true // the following reads wrap io.EOF as Read returns it
+		}
+	}
+
+	c := &Conn{Conn: &splitConn{r: bytes.NewReader(closeFrame(StatusGoingAway, "bye")), w: io.Discard}}
+
+	var v any
+
+	err := c.ReadJSON(ctx, &v)
+	if !errors.Is(err, ErrClosed) || CloseStatus(err) != StatusGoingAway {
+		t.Errorf("read json: %v", err)
+	}
+}
+
+func TestClientCloseMasked(t *testing.T) {
+	ctx := context.Background()
+
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+
+	for _, tc := range []struct {
+		name   string
+		close  func(c *Conn) error
+		status Status
+		reason string
+	}{
+		{"close writer text", func(c *Conn) error { return c.CloseWriterText(StatusGoingAway, "bye") }, StatusGoingAway, "bye"},
+		{"close writer body", func(c *Conn) error { return c.CloseWriterBody(4000, []byte("reason")) }, 4000, "reason"},
+		{"write control", func(c *Conn) error {
+			return c.WriteControl(FrameClose, append([]byte{0x03, 0xe8}, "done"...), time.Time{})
+		}, StatusOK, "done"},
+		{"close", func(c *Conn) error { return c.Close() }, 0, ""},
+		{"protocol failure", func(c *Conn) error {
+			_, _, err := c.ReadMessage(ctx)
+			if CloseStatus(err) != StatusProtocol {
+				return fmt.Errorf("expected protocol error, got %w", err)
+			}
+
+			return nil
+		}, StatusProtocol, ""},
+	} {
+		cp, sp := newPipe()
+
+		_, _ = sp.Write(frameBytes(FrameContinue, []byte("unexpected"), true)) // only read by the protocol failure case
+
+		c := &Conn{Conn: cp, client: 1, MaskKey: func() [4]byte { return key }}
+
+		err := tc.close(c)
+		if err != nil {
+			t.Errorf("%s: close: %v", tc.name, err)
+			continue
+		}
+
+		cp.w.mu.Lock()
+		b := bytes.Clone(cp.w.b)
+		cp.w.mu.Unlock()
+
+		if len(b) < 6 || Opcode(b[0]&0xf) != FrameClose || b[1]&masked == 0 || [4]byte(b[2:6]) != key {
+			t.Errorf("%s: close frame is not masked: % x", tc.name, b)
+			continue
+		}
+
+		var plain []byte
+		if tc.status != 0 {
+			plain = append(binary.BigEndian.AppendUint16(nil, uint16(tc.status)), tc.reason...)
+		}
+
+		if len(plain) != 0 && bytes.Equal(b[6:], plain) {
+			t.Errorf("%s: close payload is sent in plain: % x", tc.name, b)
+		}
+
+		// strict server
+		s := &Conn{Conn: &FakeConn{b: b}}
+
+		_, _, err = s.ReadMessage(ctx)
+		if !errors.Is(err, ErrClosed) || CloseStatus(err) != csel(tc.status != 0, tc.status, StatusOK) {
+			t.Errorf("%s: server read: %v", tc.name, err)
+		}
+
+		if _, reason, _ := IsCloseError(err); reason != tc.reason {
+			t.Errorf("%s: reason %q, expected %q", tc.name, reason, tc.reason)
+		}
+	}
+}
@@ -1,77 +1,621 @@
 package websocket
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
+// SetWriteDeadline sets the write deadline of the underlying connection.
+// See SetReadDeadline for details.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wdead.Store(t)
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+type messageWriter struct {
+	c      *Conn
+	op     Opcode
+	closed bool
+}
+
+// NextWriter returns a writer streaming a single message.
+// The first frame is sent with op, subsequent ones are continuation frames.
+// The final frame is sent on Close.
+//
+// Each Write is sent as a separate frame taking the write lock only for the frame,
+// so control frames can be sent in between.
+// No other data frames must be written until the writer is closed.
+func (c *Conn) NextWriter(op Opcode) (io.WriteCloser, error) {
+	if op != FrameText && op != FrameBinary {
+		return nil, UnexpectedOpcode(op)
+	}
+
+	return &messageWriter{c: c, op: op}, nil
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := w.c.WriteFrame(p, w.op, false)
+	w.op = FrameContinue
+
+	return n, err
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	_, err := w.c.WriteFrame(nil, w.op, true)
+
+	return err
+}
+
+func (c *Conn) setWriteDeadline(t time.Time) error {
+	if t.IsZero() {
+		t = c.writeDeadline()
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// armWrite moves the write deadline forward according to WriteTimeout before writing.
+// It must be called with wmu held.
+func (c *Conn) armWrite() error {
+	if c.WriteTimeout == 0 {
+		return nil
+	}
+
+	err := c.setWriteDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("set write timeout: %w", err)
+	}
+
+	return nil
+}
+
+// writeDeadline returns the user write deadline limited by WriteTimeout.
+func (c *Conn) writeDeadline() time.Time {
+	t := c.wdead.Load()
+
+	if c.WriteTimeout == 0 {
+		return t
+	}
+
+	wt := time.Now().Add(c.WriteTimeout)
+
+	if t.IsZero() || wt.Before(t) {
+		return wt
+	}
+
+	return t
+}
+
 func (c *Conn) Write(p []byte) (int, error) {
-	return c.WriteFrame(p, FrameBinary, true)
+	return c.WriteContext(nil, p)
+}
+
+func (c *Conn) WriteContext(ctx context.Context, p []byte) (int, error) {
+	return c.WriteFrameContext(ctx, p, FrameBinary, true)
 }
 
 func (c *Conn) WriteFrame(p []byte, op Opcode, final bool) (int, error) {
-	defer c.wmu.Unlock()
+	return c.WriteFrameContext(nil, p, op, final)
+}
+
+// WriteFrameContext writes the frame interrupting the write if ctx is canceled.
+// The connection becomes unusable for writing after that
+// as the frame may have been written partially.
+// nil ctx is never canceled.
+func (c *Conn) WriteFrameContext(ctx context.Context, p []byte, op Opcode, final bool) (int, error) {
+	defer c.unlockWrite()
 	c.wmu.Lock()
 
-	return c.writeFrame(p, op, final)
+	err := c.armWrite()
+	if err != nil {
+		return 0, err
+	}
+
+	if ctx == nil {
+		return c.writeDataFrame(p, op, final)
+	}
+
+	defer Stopper(ctx, c.setWriteDeadline)()
+
+	n, err := c.writeDataFrame(p, op, final)
+	err = FixError(ctx, err)
+	if err != nil && ctx.Err() != nil {
+		c.werr = err
+	}
+
+	return n, err
 }
 
-func (c *Conn) writeFrame(p []byte, op Opcode, final bool) (int, error) {
-	b := c.wbuf
-	finb := csel[Opcode](final, finbit, 0)
+// WriteMessage writes the whole message as a single frame.
+// op must be FrameText or FrameBinary, use CloseWriter to send close frame.
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	if op != FrameText && op != FrameBinary {
+		return UnexpectedOpcode(op)
+	}
 
-	var l7 byte
+	_, err := c.WriteFrame(data, op, true)
+
+	return err
+}
+
+// WritePing sends a ping frame with the payload of at most 125 bytes.
+// See Ping to wait for the reply.
+func (c *Conn) WritePing(payload []byte) error {
+	return c.writeControl(FramePing, payload)
+}
 
+// WritePong sends a pong frame with the payload of at most 125 bytes.
+// Unsolicited pongs serve as a unidirectional heartbeat.
+func (c *Conn) WritePong(payload []byte) error {
+	return c.writeControl(FramePong, payload)
+}
+
+func (c *Conn) writeControl(op Opcode, p []byte) error {
+	if len(p) > maxLen7 {
+		return fmt.Errorf("%w: %d bytes", ErrControlTooBig, len(p))
+	}
+
+	_, err := c.WriteFrame(p, op, true)
+
+	return err
+}
+
+// WriteControl writes ping, pong, or close frame with the payload of at most 125 bytes.
+// Close payload must be empty or start with a valid status code,
+// the writer is closed after that like with CloseWriterBody.
+// It's similar to gorilla/websocket Conn.WriteControl to ease migration.
+//
+// Unlike other writes it doesn't wait for the write lock forever.
+// If a data write holds the lock, it waits for the lock to be released until the deadline,
+// and an error wrapping os.ErrDeadlineExceeded is returned if it's not released by then.
+// The deadline also limits the frame write itself if it's earlier than the write deadline.
+// Zero deadline means no timeout.
+func (c *Conn) WriteControl(op Opcode, payload []byte, deadline time.Time) (err error) {
 	switch {
-	case len(p) <= maxLen7:
-		l7 = byte(len(p))
-	case len(p) <= maxLen16:
-		l7 = len16
-	case len(p) <= maxLen64:
-		l7 = len64
+	case op != FramePing && op != FramePong && op != FrameClose:
+		return UnexpectedOpcode(op)
+	case len(payload) > maxLen7:
+		return fmt.Errorf("%w: %d bytes", ErrControlTooBig, len(payload))
+	case op == FrameClose && len(payload) == 1:
+		return fmt.Errorf("%w: 1 byte payload", ErrInvalidStatus)
+	}
+
+	if !c.wmu.LockUntil(deadline) {
+		return fmt.Errorf("write lock: %w", os.ErrDeadlineExceeded)
+	}
+
+	defer c.unlockWrite()
+
+	if wd := c.writeDeadline(); !deadline.IsZero() && (wd.IsZero() || deadline.Before(wd)) {
+		err = c.Conn.SetWriteDeadline(deadline)
+		if err != nil {
+			return fmt.Errorf("set write deadline: %w", err)
+		}
+
+		defer func() {
+			e := c.setWriteDeadline(time.Time{})
+			if err == nil && e != nil {
+				err = fmt.Errorf("reset write deadline: %w", e)
+			}
+		}()
+	} else {
+		err = c.armWrite()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case op != FrameClose:
+		_, err = c.writeDataFrame(payload, op, true)
+	case len(payload) == 0:
+		if c.writerClosed {
+			return nil
+		}
+
+		c.writerClosed = true
+
+		_, err = c.writeFrame(nil, FrameClose, true)
 	default:
-		panic(len(p))
+		err = c.closeWriter(Status(binary.BigEndian.Uint16(payload)), payload[2:])
 	}
 
-	b = append(b, byte(op&opcodeMask|finb), c.client*masked|l7)
+	return err
+}
 
-	switch l7 {
-	case len16:
-		b = binary.BigEndian.AppendUint16(b, uint16(len(p))) //nolint:gosec
-	case len64:
-		b = binary.BigEndian.AppendUint64(b, uint64(len(p)))
+// writeLock is a mutex which can be waited for until a deadline.
+// Waiters are woken up on each Unlock and race for the lock again.
+// The zero value is unlocked.
+type writeLock struct {
+	mu     sync.Mutex
+	locked bool
+	wake   chan struct{} // closed on Unlock, created by the first waiter
+}
+
+func (l *writeLock) Lock() {
+	l.LockUntil(time.Time{})
+}
+
+// LockUntil takes the lock waiting for it until the deadline.
+// It waits with no limit if the deadline is zero.
+// It reports whether the lock is taken.
+func (l *writeLock) LockUntil(deadline time.Time) bool {
+	var timeout <-chan time.Time
+
+	for {
+		l.mu.Lock()
+
+		if !l.locked {
+			l.locked = true
+			l.mu.Unlock()
+
+			return true
+		}
+
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+
+		wake := l.wake
+
+		l.mu.Unlock()
+
+		if timeout == nil && !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+
+			timeout = t.C
+		}
+
+		select {
+		case <-wake:
+		case <-timeout:
+			return l.TryLock()
+		}
+	}
+}
+
+func (l *writeLock) TryLock() bool {
+	defer l.mu.Unlock()
+	l.mu.Lock()
+
+	if l.locked {
+		return false
+	}
+
+	l.locked = true
+
+	return true
+}
+
+func (l *writeLock) Unlock() {
+	defer l.mu.Unlock()
+	l.mu.Lock()
+
+	if !l.locked {
+		panic("websocket: unlock of unlocked write lock")
+	}
+
+	l.locked = false
+
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
 	}
+}
+
+// WriteFragmented writes the message split into frames of at most fragSize payload bytes.
+// Like NextWriter it takes the write lock for each frame separately.
+func (c *Conn) WriteFragmented(op Opcode, data []byte, fragSize int) error {
+	if op != FrameText && op != FrameBinary {
+		return UnexpectedOpcode(op)
+	}
+	if fragSize < 1 {
+		return fmt.Errorf("invalid fragment size: %d", fragSize)
+	}
+
+	for {
+		n := min(fragSize, len(data))
+
+		_, err := c.WriteFrame(data[:n], op, n == len(data))
+		if err != nil {
+			return err
+		}
+
+		data = data[n:]
+		op = FrameContinue
+
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// WriteFrom writes the message read from r until io.EOF.
+// Each Read result is sent as a separate frame, so data is forwarded without waiting for the buffer to fill.
+// The buffer is taken from the BufferPool if set, or it's writeFromSize bytes otherwise.
+// The final frame is sent with the data returned along with io.EOF, it may be empty.
+// io.ErrNoProgress is returned if r returns no data and no error many times in a row.
+// Like NextWriter it takes the write lock for each frame separately.
+// The message is left incomplete if r fails, the connection should be closed in that case.
+// It returns the number of payload bytes written.
+func (c *Conn) WriteFrom(op Opcode, r io.Reader) (n int64, err error) {
+	if op != FrameText && op != FrameBinary {
+		return 0, UnexpectedOpcode(op)
+	}
+
+	buf := c.getBuf(writeFromSize)
+	defer c.putBuf(buf)
+
+	empty := 0
+
+	for {
+		m, rerr := r.Read(buf)
+		final := errors.Is(rerr, io.EOF)
+
+		if rerr != nil && !final {
+			return n, fmt.Errorf("read: %w", rerr)
+		}
+		if m == 0 && !final {
+			empty++
+
+			if empty == maxConsecutiveEmptyReads {
+				return n, fmt.Errorf("read: %w", io.ErrNoProgress)
+			}
+
+			continue
+		}
+
+		empty = 0
+
+		m, err = c.WriteFrame(buf[:m], op, final)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+
+		if final {
+			return n, nil
+		}
+
+		op = FrameContinue
+	}
+}
+
+// writeDataFrame writes the user frame, which is not allowed after the close frame.
+// It compresses whole messages if permessage-deflate is negotiated.
+// Fragmented messages and messages shorter than CompressionThreshold are sent uncompressed.
+func (c *Conn) writeDataFrame(p []byte, op Opcode, final bool) (int, error) {
+	if c.writerClosed {
+		return 0, ErrWriteClosed
+	}
+
+	if c.deflate != nil && final && (op == FrameText || op == FrameBinary) && len(p) >= c.CompressionThreshold {
+		return c.writeCompressed(p, op)
+	}
+
+	return c.writeFrame(p, op, final)
+}
+
+func (c *Conn) writeFrame(p []byte, op Opcode, final bool) (int, error) {
+	return c.writeFrameRSV(p, op, final, 0)
+}
+
+func (c *Conn) writeFrameRSV(p []byte, op Opcode, final bool, rsv byte) (int, error) {
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	if len(p) > maxLen64 {
+		return 0, fmt.Errorf("frame too big: %d", len(p))
+	}
+
+	c.allocWriteBuf()
+
+	b := appendFrameHeader(c.wbuf, op, len(p), final, c.client != 0)
+	b[0] |= rsv
 
 	if c.client != 0 {
-		b = append(b, 0, 0, 0, 0)
-		_, _ = rand.Read(b[len(b)-4:])
+		key := c.maskKey()
+		b = append(b, key[:]...)
+	}
+
+	payload := len(b) // offset, b may also have buffered frames before the header
+
+	if c.client == 0 && len(p) >= writevMinSize {
+		c.wbuf = b[:0]
+
+		c.stats.frame(op, final, false)
+
+		n, err := c.writeBuffers(b, p)
+
+		return c.payloadWritten(n, payload, payload+len(p), err)
 	}
 
-	payload := len(b)
 	b = append(b, p...)
 
 	if c.client != 0 {
 		maskBuf(b[payload:], [4]byte(b[payload-4:payload]), 0)
 	}
 
+	c.stats.frame(op, final, false)
+
+	if c.wbuffered && op < FrameClose && len(b) < c.writeBufSize() {
+		c.wbuf = b
+
+		return len(p), nil
+	}
+
 	c.wbuf = b[:0]
 
-	n, err := c.Conn.Write(b)
-	n -= payload
+	n, err := c.writeAll(b)
+
+	return c.payloadWritten(n, payload, len(b), err)
+}
+
+// payloadWritten converts the number of bytes written to the connection
+// to the number of payload bytes starting at off written.
+// Nothing is reported written until the header is done.
+// Partially written frame breaks the stream, so the following writes fail.
+// Nothing written on error is fine, the write can be retried.
+func (c *Conn) payloadWritten(n, off, size int, err error) (int, error) {
+	if err != nil && n != 0 && n < size {
+		c.werr = fmt.Errorf("frame partially written: %w", err)
+	}
+
+	return max(n-off, 0), err
+}
+
+// SetWriteBuffering enables or disables write buffering.
+//
+// Buffered data frames are accumulated in the write buffer and sent by a single write
+// when Flush is called or when WriteBufferSize is reached.
+// This trades latency for throughput for senders of many small frames.
+// Write errors are reported by the call that actually writes to the connection.
+//
+// Control frames are never held: they are written right away along with
+// the buffered frames, so pongs are not delayed and Close and CloseWriter flush the buffer.
+// Frames buffered when buffering is disabled are sent with the next write.
+func (c *Conn) SetWriteBuffering(on bool) {
+	defer c.unlockWrite()
+	c.wmu.Lock()
+
+	c.wbuffered = on
+}
+
+// Flush writes the frames buffered by SetWriteBuffering.
+func (c *Conn) Flush() error {
+	defer c.unlockWrite()
+	c.wmu.Lock()
+
+	err := c.armWrite()
 	if err != nil {
-		if n < 0 {
-			n = 0
+		return err
+	}
+
+	return c.flush()
+}
+
+func (c *Conn) flush() error {
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+
+	if c.werr != nil {
+		return c.werr
+	}
+
+	n, err := c.writeAll(c.wbuf)
+	_, err = c.payloadWritten(n, 0, len(c.wbuf), err)
+	c.wbuf = c.wbuf[:0]
+
+	return err
+}
+
+func (c *Conn) writeBufSize() int {
+	return csel(c.WriteBufferSize != 0, c.WriteBufferSize, defaultWriteBufSize)
+}
+
+// writeAll retries short writes until all of b is written or an error occurs.
+func (c *Conn) writeAll(b []byte) (n int, err error) {
+	for n < len(b) {
+		m, err := c.Conn.Write(b[n:])
+		c.stats.written(m)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
 		}
+	}
+
+	return n, nil
+}
 
+// appendFrameHeader encodes the frame header except for the masking key.
+// The length must be checked by the caller.
+func appendFrameHeader(b []byte, op Opcode, l int, final, mask bool) []byte {
+	finb := csel[Opcode](final, finbit, 0)
+	maskb := csel[byte](mask, masked, 0)
+
+	var l7 byte
+
+	switch {
+	case l <= maxLen7:
+		l7 = byte(l)
+	case l <= maxLen16:
+		l7 = len16
+	case l <= maxLen64:
+		l7 = len64
+	default:
+		panic(l)
+	}
+
+	b = append(b, byte(op&opcodeMask|finb), maskb|l7)
+
+	switch l7 {
+	case len16:
+		b = binary.BigEndian.AppendUint16(b, uint16(l)) //nolint:gosec
+	case len64:
+		b = binary.BigEndian.AppendUint64(b, uint64(l)) //nolint:gosec
+	}
+
+	return b
+}
+
+// writeBuffers writes the header and the payload without copying the payload.
+// Connections known to retry short vectored writes use writev,
+// others get two separate writes.
+func (c *Conn) writeBuffers(hdr, p []byte) (n int, err error) {
+	switch c.Conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers{hdr, p}
+
+		m, err := bufs.WriteTo(c.Conn)
+		c.stats.written(int(m))
+
+		return int(m), err
+	}
+
+	n, err = c.writeAll(hdr)
+	if err != nil {
 		return n, err
 	}
 
-	return n, nil
+	m, err := c.writeAll(p)
+
+	return n + m, err
 }
 
+// Close sends close frame if not sent yet and closes the underlying connection.
+// Buffers are returned to the BufferPool if set.
+// The read buffer is returned by the concurrent reader when it's done if there is one.
 func (c *Conn) Close() (err error) {
-	defer c.wmu.Unlock()
+	defer c.unlockWrite()
 	c.wmu.Lock()
 
 	defer func() {
@@ -79,6 +623,9 @@ func (c *Conn) Close() (err error) {
 		if err == nil && e != nil {
 			err = e
 		}
+
+		c.failPings(net.ErrClosed)
+		c.releaseBuffers()
 	}()
 
 	if c.writerClosed {
@@ -87,9 +634,12 @@ func (c *Conn) Close() (err error) {
 
 	c.writerClosed = true
 
-	c.wbuf = append(c.wbuf, byte(FrameClose|finbit), c.client*masked)
+	err = c.armWrite()
+	if err != nil {
+		return err
+	}
 
-	_, err = c.Conn.Write(c.wbuf[:2])
+	_, err = c.writeFrame(nil, FrameClose, true)
 	if err != nil {
 		return fmt.Errorf("write close frame: %w", err)
 	}
@@ -97,31 +647,102 @@ func (c *Conn) Close() (err error) {
 	return nil
 }
 
+// CloseHandshake sends close frame and waits for the peer to reply with its close frame.
+// Data frames received meanwhile are discarded.
+// The underlying connection is closed at the end in any case.
+// It reports whether the peer close frame was received before ctx expired.
+func (c *Conn) CloseHandshake(ctx context.Context, status Status, reason string) (clean bool, err error) {
+	defer closer(c, &err, "close conn")
+
+	err = c.CloseWriterText(status, reason)
+	if err != nil {
+		return false, fmt.Errorf("close writer: %w", err)
+	}
+
+	defer c.unlockRead()
+	c.rmu.Lock()
+
+	for {
+		_, _, _, err = c.readDataFrameHeader(ctx)
+		if c.closeRecv {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// CloseWriter sends close frame with the status leaving the reading side open.
+// Data and control frames written after that fail with ErrWriteClosed.
 func (c *Conn) CloseWriter(status Status) (err error) {
-	defer c.wmu.Unlock()
+	defer c.unlockWrite()
 	c.wmu.Lock()
 
+	err = c.armWrite()
+	if err != nil {
+		return err
+	}
+
 	return c.closeWriter(status, nil)
 }
 
 func (c *Conn) CloseWriterBody(status Status, body []byte) (err error) {
-	defer c.wmu.Unlock()
+	defer c.unlockWrite()
 	c.wmu.Lock()
 
+	err = c.armWrite()
+	if err != nil {
+		return err
+	}
+
 	return c.closeWriter(status, body)
 }
 
+// CloseWriterText sends close frame with the reason.
+// The reason must be valid UTF-8, it's truncated to fit into a control frame
+// on a rune boundary.
+func (c *Conn) CloseWriterText(status Status, reason string) (err error) {
+	if !utf8.ValidString(reason) {
+		return ErrInvalidUTF8
+	}
+
+	if len(reason) > maxLen7-2 {
+		i := maxLen7 - 2
+
+		for i > 0 && !utf8.RuneStart(reason[i]) {
+			i--
+		}
+
+		reason = reason[:i]
+	}
+
+	defer c.unlockWrite()
+	c.wmu.Lock()
+
+	err = c.armWrite()
+	if err != nil {
+		return err
+	}
+
+	return c.closeWriter(status, []byte(reason))
+}
+
 func (c *Conn) closeWriter(status Status, msg []byte) (err error) {
 	if c.writerClosed {
 		return nil
 	}
 
-	c.writerClosed = true
-
 	if status == 0 {
-		status = 1000
+		status = StatusOK
+	}
+
+	if !status.Valid() {
+		return fmt.Errorf("%w: %d", ErrInvalidStatus, int(status))
 	}
 
+	c.writerClosed = true
+
 	body := append([]byte{byte(status >> 8), byte(status)}, msg...)
 
 	//	log.Printf("close writer %x (%[1]d)  % x", int(status), body)
@@ -131,15 +752,209 @@ func (c *Conn) closeWriter(status Status, msg []byte) (err error) {
 	return err
 }
 
-func (c *Conn) processPing() error {
-	defer c.wmu.Unlock()
-	c.wmu.Lock()
+func (c *Conn) maskKey() (key [4]byte) {
+	if c.MaskKey != nil {
+		return c.MaskKey()
+	}
 
-	c.rbuf[c.st] = c.rbuf[c.st]&^opcodeMask | byte(FramePong)
+	_, _ = rand.Read(key[:])
 
-	_, err := c.Conn.Write(c.rbuf[c.st : c.i+c.more])
+	return key
+}
 
-	return err
+// Ping sends a ping and waits for the matching pong returning the round trip time.
+// Pongs are processed by the reader, so some goroutine must be reading the Conn.
+//
+// The ping payload is a random per connection tag followed by a sequence number,
+// and only pongs echoing it are matched. Other pongs, unsolicited or replies
+// to pings sent by WritePing, are passed to the pong handler only.
+// Matched pongs are passed to the handler as well.
+// The peer may reply only to the most recent of several outstanding pings,
+// so a pong completes all the pings sent before the matching one.
+// The peer may never reply, ctx is the way to stop waiting.
+// Pings are failed with the read error when the reading side ends or the Conn is closed.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	ch := make(chan error, 1)
+
+	c.pmu.Lock()
+
+	if c.pingID == 0 {
+		_, _ = rand.Read(c.pingTag[:])
+	}
+
+	c.pingID++
+	id := c.pingID
+
+	if c.pingErr != nil {
+		ch <- c.pingErr
+	} else {
+		c.pings = append(c.pings, pingWaiter{id: id, ch: ch})
+	}
+
+	var p [pingPayloadSize]byte
+	copy(p[:], c.pingTag[:])
+	binary.BigEndian.PutUint64(p[8:], id)
+
+	c.pmu.Unlock()
+
+	defer c.cancelPing(id)
+
+	start := time.Now()
+
+	_, err := c.WriteFrameContext(ctx, p[:], FramePing, true)
+	if err != nil {
+		return 0, fmt.Errorf("write ping: %w", err)
+	}
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+
+	select {
+	case err = <-ch:
+		if err != nil {
+			return 0, fmt.Errorf("wait pong: %w", err)
+		}
+
+		return time.Since(start), nil
+	case <-done:
+		return 0, ctx.Err()
+	}
+}
+
+// completePings wakes up Ping calls up to the one the pong payload p is the reply to.
+// Pongs not matching our tag or outstanding ids are ignored.
+func (c *Conn) completePings(p []byte) {
+	defer c.pmu.Unlock()
+	c.pmu.Lock()
+
+	if len(c.pings) == 0 || [8]byte(p[:8]) != c.pingTag {
+		return
+	}
+
+	id := binary.BigEndian.Uint64(p[8:])
+
+	i := slices.IndexFunc(c.pings, func(w pingWaiter) bool { return w.id == id })
+	if i < 0 {
+		return
+	}
+
+	for _, w := range c.pings[:i+1] {
+		w.ch <- nil
+	}
+
+	c.pings = slices.Delete(c.pings, 0, i+1)
+}
+
+// failPings fails all the outstanding and future Ping calls with err.
+func (c *Conn) failPings(err error) {
+	defer c.pmu.Unlock()
+	c.pmu.Lock()
+
+	if c.pingErr == nil {
+		c.pingErr = err
+	}
+
+	for _, w := range c.pings {
+		w.ch <- c.pingErr
+	}
+
+	c.pings = c.pings[:0]
+}
+
+// cancelPing removes the Ping call if it's still waiting.
+func (c *Conn) cancelPing(id uint64) {
+	defer c.pmu.Unlock()
+	c.pmu.Lock()
+
+	c.pings = slices.DeleteFunc(c.pings, func(w pingWaiter) bool { return w.id == id })
+}
+
+// autoPong is the default ping handler.
+func (c *Conn) autoPong(p []byte) error {
+	c.queueControl(FramePong, p)
+
+	return nil
+}
+
+// queueControl sends control frame from the reader without waiting for the write lock.
+//
+// The frame is put to a single slot queue. It's written right away if the lock is free,
+// or by the lock holder when it's done with its frame otherwise.
+// If the slot is busy, a newer pong replaces the older one,
+// which is allowed by RFC 6455 section 5.5.3.
+// Close frame replaces a pong and is never replaced itself.
+// So a reader is never blocked by a slow writer, but only the latest pong is sent
+// when the writer catches up.
+// Write errors are not returned to the reader, see flushQueued.
+func (c *Conn) queueControl(op Opcode, p []byte) {
+	c.qmu.Lock()
+
+	if !c.queued.Load() || c.qop != FrameClose {
+		c.qop = op
+		c.qlen = copy(c.qbuf[:], p)
+		c.queued.Store(true)
+	}
+
+	c.qmu.Unlock()
+
+	if !c.wmu.TryLock() {
+		return
+	}
+
+	c.unlockWrite()
+}
+
+// unlockWrite releases the write lock writing the queued control frame first.
+func (c *Conn) unlockWrite() {
+	for {
+		c.flushQueued()
+		c.wmu.Unlock()
+
+		// The frame queued after the flush and before the Unlock
+		// failed to TryLock, so it's on us to write it.
+		if !c.queued.Load() || !c.wmu.TryLock() {
+			return
+		}
+	}
+}
+
+// flushQueued writes the queued control frame if any.
+// It must be called with wmu held.
+//
+// The reply is written on behalf of the reader, so the write error
+// is not the reader's business. It breaks the connection for writing instead,
+// and the following writes and Close report it.
+func (c *Conn) flushQueued() {
+	if !c.queued.Load() {
+		return
+	}
+
+	var buf [maxLen7]byte
+
+	c.qmu.Lock()
+	op := c.qop
+	p := buf[:copy(buf[:], c.qbuf[:c.qlen])]
+	c.queued.Store(false)
+	c.qmu.Unlock()
+
+	if c.writerClosed {
+		return
+	}
+
+	if op == FrameClose {
+		c.writerClosed = true
+	}
+
+	err := c.armWrite()
+	if err == nil {
+		_, err = c.writeFrame(p, op, true)
+	}
+
+	if err != nil && c.werr == nil {
+		c.werr = fmt.Errorf("write %v reply: %w", op, err)
+	}
 }
 
 func csel[T any](c bool, x, y T) T {
@@ -0,0 +1,212 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+type (
+	// FrameReader parses frames from any io.Reader, like a captured stream.
+	// It reads no more than the frame needs, so the reader can be shared with other parsers.
+	// Unlike Conn it doesn't check roles, control frame rules and doesn't reply to control frames.
+	FrameReader struct {
+		r io.Reader
+
+		hdr [maxHeaderSize]byte
+
+		header HeaderBits
+		key    [4]byte
+
+		off  int // payload offset for masking
+		more int // more payload bytes to read
+	}
+
+	// FrameWriter encodes frames to any io.Writer.
+	// Each frame is a WriteHeader call followed by Write calls with exactly length payload bytes in total.
+	// Like FrameReader it doesn't enforce protocol rules.
+	FrameWriter struct {
+		// MaskKey generates masking keys for masked frames.
+		// crypto/rand is used if nil.
+		MaskKey func() [4]byte
+
+		w io.Writer
+
+		buf []byte
+
+		mask bool
+		key  [4]byte
+
+		off  int // payload offset for masking
+		more int // more payload bytes to write
+	}
+)
+
+const maxHeaderSize = 2 + 8 + 4
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+// ReadHeader reads the next frame header skipping the rest of the previous frame payload.
+// io.EOF is returned if the stream ended on a frame boundary.
+func (r *FrameReader) ReadHeader() (h HeaderBits, length int, err error) {
+	if r.more != 0 {
+		_, err = io.CopyN(io.Discard, r.r, int64(r.more))
+		if err != nil {
+			return h, 0, unexpectedEOF(err)
+		}
+
+		r.more = 0
+	}
+
+	_, err = io.ReadFull(r.r, r.hdr[:2])
+	if err != nil {
+		return h, 0, err
+	}
+
+	h = HeaderBits{r.hdr[0], r.hdr[1]}
+	n := 2
+
+	switch h.len7() {
+	case len16:
+		n += 2
+	case len64:
+		n += 8
+	}
+
+	if h.Masked() {
+		n += 4
+	}
+
+	_, err = io.ReadFull(r.r, r.hdr[2:n])
+	if err != nil {
+		return h, 0, unexpectedEOF(err)
+	}
+
+	length, i := h.ParseLen(r.hdr[:n], 2)
+	if length < 0 {
+		return h, 0, lenStatus(r.hdr[:n], 2)
+	}
+
+	if h.Masked() {
+		h.ReadMaskingKey(r.hdr[:n], i, r.key[:])
+	}
+
+	r.header = h
+	r.off = 0
+	r.more = length
+
+	return h, length, nil
+}
+
+// ReadPayload reads the current frame payload unmasking it if needed.
+// io.EOF is returned at the end of the payload, possibly along with the last bytes.
+func (r *FrameReader) ReadPayload(p []byte) (n int, err error) {
+	if r.more == 0 {
+		return 0, io.EOF
+	}
+
+	n, err = r.r.Read(p[:min(len(p), r.more)])
+
+	if r.header.Masked() {
+		maskBuf(p[:n], r.key, r.off)
+	}
+
+	r.off += n
+	r.more -= n
+
+	if r.more != 0 {
+		return n, unexpectedEOF(err)
+	}
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Header returns the current frame header.
+func (r *FrameReader) Header() HeaderBits {
+	return r.header
+}
+
+// More returns the number of payload bytes left to read.
+func (r *FrameReader) More() int {
+	return r.more
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteHeader writes the frame header.
+// Payload of the previous frame must be written completely.
+func (w *FrameWriter) WriteHeader(op Opcode, length int, final, mask bool) error {
+	if w.more != 0 {
+		return fmt.Errorf("previous frame payload is incomplete: %d bytes left", w.more)
+	}
+
+	if length < 0 || length > maxLen64 {
+		return fmt.Errorf("invalid frame length: %d", length)
+	}
+
+	b := appendFrameHeader(w.buf[:0], op, length, final, mask)
+
+	if mask {
+		if w.MaskKey != nil {
+			w.key = w.MaskKey()
+		} else {
+			_, _ = rand.Read(w.key[:])
+		}
+
+		b = append(b, w.key[:]...)
+	}
+
+	w.buf = b
+	w.mask = mask
+	w.off = 0
+	w.more = length
+
+	_, err := w.w.Write(b)
+
+	return err
+}
+
+// Write writes the frame payload masking it if needed.
+// It fails if p exceeds the frame length declared in WriteHeader.
+func (w *FrameWriter) Write(p []byte) (n int, err error) {
+	if len(p) > w.more {
+		return 0, fmt.Errorf("payload exceeds frame length: %d bytes left", w.more)
+	}
+
+	if !w.mask {
+		n, err = w.w.Write(p)
+		w.more -= n
+
+		return n, err
+	}
+
+	w.buf = append(w.buf[:0], p...)
+	maskBuf(w.buf, w.key, w.off)
+
+	n, err = w.w.Write(w.buf)
+	w.off += n
+	w.more -= n
+
+	return n, err
+}
+
+// More returns the number of payload bytes left to write.
+func (w *FrameWriter) More() int {
+	return w.more
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// frameDump is the stream of RFC 6455 Section 5.7 examples.
+// The last header is followed by 256 bytes of binary payload added in the test.
+const frameDump = `
+810548656c6c6f
+818537fa213d7f9f4d5158
+010348656c
+80026c6f
+890548656c6c6f
+8a8537fa213d7f9f4d5158
+827e0100`
+
+func TestFrameReaderDump(t *testing.T) {
+	dump, err := hex.DecodeString(strings.ReplaceAll(frameDump, "\n", ""))
+	if err != nil {
+		t.Fatalf("decode dump: %v", err)
+	}
+
+	dump = append(dump, bytes.Repeat([]byte{0xaa}, 256)...)
+
+	type frame struct {
+		op      Opcode
+		fin     bool
+		masked  bool
+		payload string
+	}
+
+	exp := []frame{
+		{FrameText, true, false, "Hello"},
+		{FrameText, true, true, "Hello"},
+		{FrameText, false, false, "Hel"},
+		{FrameContinue, true, false, "lo"},
+		{FramePing, true, false, "Hello"},
+		{FramePong, true, true, "Hello"},
+		{FrameBinary, true, false, strings.Repeat("\xaa", 256)},
+	}
+
+	for _, oneByte := range []bool{false, true} {
+		var rd io.Reader = bytes.NewReader(dump)
+		if oneByte {
+			rd = iotest.OneByteReader(rd)
+		}
+
+		r := NewFrameReader(rd)
+
+		for i, e := range exp {
+			h, l, err := r.ReadHeader()
+			if err != nil {
+				t.Fatalf("frame %d: read header: %v", i, err)
+			}
+
+			if h.Opcode() != e.op || h.Fin() != e.fin || h.Masked() != e.masked || l != len(e.payload) {
+				t.Errorf("frame %d: header %v %v %v %v, expected %+v", i, h.Opcode(), h.Fin(), h.Masked(), l, e)
+			}
+
+			p, err := io.ReadAll(readerFunc(r.ReadPayload))
+			if err != nil || string(p) != e.payload {
+				t.Errorf("frame %d: payload %q %v, expected %q", i, p, err, e.payload)
+			}
+		}
+
+		_, _, err = r.ReadHeader()
+		if err != io.EOF {
+			t.Errorf("expected EOF, got %v", err)
+		}
+	}
+}
+
+func TestFrameReaderSkipPayload(t *testing.T) {
+	var b []byte
+	b = append(b, frameBytes(FrameBinary, make([]byte, 1000), true)...)
+	b = append(b, maskedFrameBytes(FrameText, []byte("second"), true)...)
+	b = append(b, frameBytes(FrameText, []byte("truncated"), true)[:5]...)
+
+	r := NewFrameReader(bytes.NewReader(b))
+
+	_, l, err := r.ReadHeader()
+	if err != nil || l != 1000 {
+		t.Fatalf("read header: %v %v", l, err)
+	}
+
+	h, l, err := r.ReadHeader()
+	if err != nil || h.Opcode() != FrameText || l != 6 {
+		t.Fatalf("read second header: %v %v %v", h.Opcode(), l, err)
+	}
+
+	buf := make([]byte, 10)
+
+	n, err := r.ReadPayload(buf)
+	if string(buf[:n]) != "second" || err != io.EOF {
+		t.Errorf("read payload: %q %v", buf[:n], err)
+	}
+
+	_, _, err = r.ReadHeader()
+	if err != nil {
+		t.Fatalf("read truncated header: %v", err)
+	}
+
+	_, err = io.ReadAll(readerFunc(r.ReadPayload))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestFrameReaderInvalidLength(t *testing.T) {
+	for _, tc := range []struct {
+		hdr []byte
+		err error
+	}{
+		{[]byte{0x82, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, ErrProtocol},
+		{[]byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}, ErrProtocol},
+		{[]byte{0x82, 0x7f, 0x40, 0, 0, 0, 0, 0, 0, 0}, ErrTooBig},
+	} {
+		r := NewFrameReader(bytes.NewReader(tc.hdr))
+
+		_, _, err := r.ReadHeader()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("% x: expected %v, got %v", tc.hdr, tc.err, err)
+		}
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestFrameWriterLengths(t *testing.T) {
+	for _, tc := range []struct {
+		l   int
+		hdr int
+	}{
+		{0, 2},
+		{maxLen7, 2},
+		{maxLen7 + 1, 4},
+		{maxLen16, 4},
+		{maxLen16 + 1, 10},
+	} {
+		for _, mask := range []bool{false, true} {
+			var buf bytes.Buffer
+
+			w := NewFrameWriter(&buf)
+			w.MaskKey = func() [4]byte { return [4]byte{1, 2, 3, 4} }
+
+			payload := bytes.Repeat([]byte("0123456789"), tc.l/10+1)[:tc.l]
+
+			err := w.WriteHeader(FrameBinary, tc.l, true, mask)
+			if err != nil {
+				t.Fatalf("write header: %v", err)
+			}
+
+			hdr := tc.hdr + csel(mask, 4, 0)
+			if buf.Len() != hdr {
+				t.Errorf("len %d mask %v: header size %d, expected %d", tc.l, mask, buf.Len(), hdr)
+			}
+
+			// write in two parts to check masking offset
+			_, err = w.Write(payload[:tc.l/3])
+			if err == nil {
+				_, err = w.Write(payload[tc.l/3:])
+			}
+			if err != nil || w.More() != 0 {
+				t.Fatalf("write payload: %v, more %d", err, w.More())
+			}
+
+			r := NewFrameReader(&buf)
+
+			h, l, err := r.ReadHeader()
+			if err != nil || l != tc.l || h.Masked() != mask || h.Opcode() != FrameBinary || !h.Fin() {
+				t.Errorf("len %d mask %v: read header %v %v %v", tc.l, mask, h, l, err)
+			}
+
+			p, err := io.ReadAll(readerFunc(r.ReadPayload))
+			if err != nil || !bytes.Equal(p, payload) {
+				t.Errorf("len %d mask %v: payload mismatch %v", tc.l, mask, err)
+			}
+		}
+	}
+}
+
+func TestFrameWriterLimits(t *testing.T) {
+	w := NewFrameWriter(io.Discard)
+
+	err := w.WriteHeader(FrameText, 3, true, false)
+	if err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+
+	_, err = w.Write([]byte("four"))
+	if err == nil {
+		t.Errorf("expected error on payload overflow")
+	}
+
+	_, _ = w.Write([]byte("ab"))
+
+	err = w.WriteHeader(FrameText, 0, true, false)
+	if err == nil {
+		t.Errorf("expected error on incomplete payload")
+	}
+
+	w = NewFrameWriter(io.Discard)
+
+	for _, l := range []int{-1, maxLen64 + 1} {
+		err = w.WriteHeader(FrameBinary, l, true, false)
+		if err == nil {
+			t.Errorf("expected error on length %d", l)
+		}
+	}
+}
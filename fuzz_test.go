@@ -18,9 +18,12 @@ type FakeConn struct {
 func FuzzWriteRead(f *testing.F) { //nolint:gocognit
 	f.Add(32, 1, []byte("first."), []byte("second_second."), []byte("third_third_third"))
 	f.Add(32, 256, []byte("first."), []byte("second_second_second_second."), make([]byte, 128))
+	f.Add(1, 1, make([]byte, 0x2000), []byte("second."), []byte{})
+	f.Add(32, 16, []byte{}, []byte{}, []byte{})
+	f.Add(32, 1, []byte{}, []byte("second."), []byte{})
 
 	f.Fuzz(func(t *testing.T, cbuf, rbuf int, m0, m1, m2 []byte) {
-		if cbuf < minReadBufSize || cbuf > 0x1000 {
+		if cbuf < 1 || cbuf > 0x1000 {
 			return
 		}
 		if rbuf < 1 || rbuf > 0x1000 {
@@ -36,7 +39,8 @@ func FuzzWriteRead(f *testing.F) { //nolint:gocognit
 		var c FakeConn
 
 		w := &Conn{
-			Conn: &c,
+			Conn:   &c,
+			client: 1,
 		}
 
 		r := &Conn{
@@ -104,6 +108,83 @@ func FuzzWriteRead(f *testing.F) { //nolint:gocognit
 	})
 }
 
+// chunkConn returns at most n bytes per Read
+// to make frames span several read buffer refills.
+type chunkConn struct {
+	n int
+
+	net.Conn
+}
+
+func FuzzReadMaskedFrame(f *testing.F) {
+	f.Add(0x20, 1, 7, make([]byte, 0x100))
+	f.Add(0x20, 13, 5, []byte("masked frame bigger than the read buffer, split at arbitrary points"))
+	f.Add(0x40, 0x21, 0x1000, make([]byte, 0x3000))
+	f.Add(0x100, 0x7f, 0x33, make([]byte, 0x801))
+	f.Add(0x20, 1, 1, []byte{})
+	f.Add(0x20, 1, 1, []byte{'a'})
+
+	f.Fuzz(func(t *testing.T, cbuf, chunk, rbuf int, payload []byte) {
+		if cbuf < 1 || cbuf > 0x1000 || chunk < 1 || rbuf < 1 || rbuf > 0x10000 {
+			return
+		}
+		if len(payload) > 0x10000 {
+			return
+		}
+
+		for i := range payload {
+			payload[i] ^= byte(i)
+		}
+
+		var c FakeConn
+
+		w := &Conn{
+			Conn:   &c,
+			client: 1,
+		}
+
+		// second fragment makes the offset carry over a frame boundary
+		half := len(payload) / 2
+
+		_, err := w.WriteFrame(payload[:half], FrameBinary, false)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		_, err = w.WriteFrame(payload[half:], FrameContinue, true)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		r := &Conn{
+			Conn: &chunkConn{n: chunk, Conn: &c},
+			rbuf: make([]byte, cbuf),
+		}
+
+		var to []byte
+		buf := make([]byte, rbuf)
+
+		for range 0x100000 {
+			n, err := r.Read(buf)
+			to = append(to, buf[:n]...)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+		}
+
+		if !bytes.Equal(payload, to) {
+			t.Errorf("payload mismatch  conn buffer %x  chunk %x  read buffer %x\ngot  %q\nwant %q", cbuf, chunk, rbuf, to, payload)
+		}
+	})
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	return c.Conn.Read(p[:min(len(p), c.n)])
+}
+
 func (c *FakeConn) Read(p []byte) (n int, err error) {
 	n = copy(p, c.b[c.r:])
 	c.r += n
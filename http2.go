@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// streamConn is a net.Conn over HTTP/2 stream bootstrapped with extended CONNECT (RFC 8441).
+	streamConn struct {
+		r io.ReadCloser
+		w io.Writer
+
+		flush func() error // nil if w doesn't buffer
+		close func() error
+
+		// nil if not supported
+		readDeadline  func(time.Time) error
+		writeDeadline func(time.Time) error
+
+		laddr, raddr net.Addr
+	}
+
+	// streamAddr is the stream end address, which is the authority.
+	streamAddr string
+)
+
+// handshakeHTTP2 is the client side of RFC 8441 handshake.
+func (cl *Client) handshakeHTTP2(ctx context.Context, req *http.Request) (conn *Conn, resp *http.Response, err error) {
+	if cl.Transport == nil {
+		return nil, nil, errors.New("http2 handshake requires Transport supporting extended CONNECT")
+	}
+
+	// the stream outlives the handshake ctx, it's closed by Conn.Close
+	sctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+
+	pr, pw := io.Pipe()
+
+	closeStream := func() error {
+		cancel()
+
+		return pw.Close()
+	}
+
+	defer func() {
+		if err != nil && conn == nil {
+			_ = closeStream()
+		}
+	}()
+
+	hreq := req.Clone(sctx)
+	hreq.Method = http.MethodConnect
+	hreq.Body = pr
+	hreq.ContentLength = -1
+
+	h := hreq.Header
+	h.Set(":protocol", "websocket")
+	h.Del("Connection")
+	h.Del("Upgrade")
+	h.Del("Sec-WebSocket-Key")
+
+	resp, err = cl.Transport.RoundTrip(hreq)
+	if !stop() {
+		err = FixError(ctx, err)
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+
+		return nil, nil, fmt.Errorf("round trip: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+
+		return nil, resp, &HandshakeError{Response: resp, Err: fmt.Errorf("%w: %v", ErrBadStatus, resp.Status)}
+	}
+
+	// the response body is the stream owned by the Conn
+	body := resp.Body
+	resp.Body = http.NoBody
+
+	sc := &streamConn{
+		r: body,
+		w: pw,
+		close: func() error {
+			_ = body.Close()
+
+			return closeStream()
+		},
+		laddr: streamAddr(""),
+		raddr: streamAddr(req.URL.Host),
+	}
+
+	conn = &Conn{
+		Conn: sc,
+
+		ReadBufferSize:  cl.ReadBufferSize,
+		WriteBufferSize: cl.WriteBufferSize,
+
+		client: 1,
+		pool:   cl.BufferPool,
+
+		subprotocol: resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions:  headerTokens(resp.Header, "Sec-WebSocket-Extensions"),
+	}
+
+	comp, err := checkNegotiated(req, resp.Header)
+	if err != nil {
+		err = &HandshakeError{Response: resp, Err: err}
+	}
+
+	if err != nil && !cl.KeepConnOnError {
+		return nil, resp, err
+	}
+
+	conn.setCompression(comp)
+
+	return conn, resp, err
+}
+
+// handshakeHTTP2 is the server side of RFC 8441 handshake.
+func (s *Server) handshakeHTTP2(w http.ResponseWriter, req *http.Request) (_ *Conn, written bool, err error) {
+	proto, exts, comp, err := s.checkRequest(req, w.Header())
+	if err != nil {
+		return nil, false, err
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+
+	err = rc.Flush()
+	if err != nil {
+		return nil, true, fmt.Errorf("flush response: %w", err)
+	}
+
+	laddr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	sc := &streamConn{
+		r:     req.Body,
+		w:     w,
+		flush: rc.Flush,
+		close: req.Body.Close,
+
+		readDeadline:  rc.SetReadDeadline,
+		writeDeadline: rc.SetWriteDeadline,
+
+		laddr: csel[net.Addr](laddr != nil, laddr, streamAddr(req.Host)),
+		raddr: streamAddr(req.RemoteAddr),
+	}
+
+	wc := &Conn{
+		Conn: sc,
+		pool: s.BufferPool,
+
+		MaxMessageSize:  s.ReadLimit,
+		ReadBufferSize:  s.ReadBufferSize,
+		WriteBufferSize: s.WriteBufferSize,
+		WriteTimeout:    s.WriteTimeout,
+
+		subprotocol: proto,
+		extensions:  exts,
+		req:         handshakeRequest(req),
+	}
+
+	wc.setCompression(comp)
+
+	return wc, true, nil
+}
+
+// isExtendedConnect reports whether req is RFC 8441 websocket request.
+func isExtendedConnect(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect && strings.EqualFold(req.Header.Get(":protocol"), "websocket")
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	if err != nil || c.flush == nil {
+		return n, err
+	}
+
+	return n, c.flush()
+}
+
+func (c *streamConn) Close() error {
+	return c.close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if c.readDeadline == nil {
+		return os.ErrNoDeadline
+	}
+
+	return c.readDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if c.writeDeadline == nil {
+		return os.ErrNoDeadline
+	}
+
+	return c.writeDeadline(t)
+}
+
+func (a streamAddr) Network() string { return "http2" }
+func (a streamAddr) String() string  { return string(a) }
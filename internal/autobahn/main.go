@@ -0,0 +1,249 @@
+// Autobahn is a harness for the Autobahn Test Suite (https://github.com/crossbario/autobahn-testsuite).
+//
+// Client mode runs all the cases against fuzzingserver:
+//
+//	docker run -it --rm -v ${PWD}/internal/autobahn:/config -v ${PWD}/reports:/reports -p 9001:9001 \
+//		crossbario/autobahn-testsuite wstest -m fuzzingserver -s /config/fuzzingserver.json
+//	go run ./internal/autobahn -mode client -url ws://localhost:9001
+//
+// Server mode runs an echo server for fuzzingclient:
+//
+//	go run ./internal/autobahn -mode server -listen :9002
+//	docker run -it --rm --net host -v ${PWD}/internal/autobahn:/config -v ${PWD}/reports:/reports \
+//		crossbario/autobahn-testsuite wstest -m fuzzingclient -s /config/fuzzingclient.json
+//
+// Check mode compares the report with the expected behaviors:
+//
+//	go run ./internal/autobahn -mode check -report reports/clients/index.json
+//
+// The check fails if any case behaves differently from the expectations,
+// including cases missing from either the report or the expectations.
+// Run check with -update to record the current results as expected
+// after reviewing them in the report.
+// Compression cases (12.*, 13.*) are excluded in the configs,
+// run with -compress and remove the exclusion to check permessage-deflate.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+
+	"nikand.dev/go/websocket"
+)
+
+var (
+	mode   = flag.String("mode", "client", "client|server|check")
+	addr   = flag.String("url", "ws://localhost:9001", "fuzzingserver url for client mode")
+	listen = flag.String("listen", ":9002", "listen address for server mode")
+	agent  = flag.String("agent", "nikand.dev/go/websocket", "agent name for client mode")
+	report = flag.String("report", "reports/clients/index.json", "report index for check mode")
+	expect = flag.String("expect", "internal/autobahn/expectations.json", "expectations file for check mode")
+	update = flag.Bool("update", false, "update expectations file in check mode")
+
+	compress = flag.Bool("compress", false, "negotiate permessage-deflate")
+)
+
+func main() {
+	flag.Parse()
+
+	err := run(context.Background())
+	if err != nil {
+		log.Fatalf("autobahn: %v", err)
+	}
+}
+
+func run(ctx context.Context) error {
+	switch *mode {
+	case "client":
+		return client(ctx)
+	case "server":
+		return server()
+	case "check":
+		return check()
+	default:
+		return fmt.Errorf("unsupported mode: %v", *mode)
+	}
+}
+
+func client(ctx context.Context) error {
+	var cl websocket.Client
+
+	if *compress {
+		cl.Compression = &websocket.CompressionParams{}
+	}
+
+	c, err := cl.DialContext(ctx, *addr+"/getCaseCount")
+	if err != nil {
+		return fmt.Errorf("get case count: %w", err)
+	}
+
+	_, data, err := c.ReadMessage(ctx)
+	_ = c.Close()
+	if err != nil {
+		return fmt.Errorf("read case count: %w", err)
+	}
+
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return fmt.Errorf("parse case count: %w", err)
+	}
+
+	for i := 1; i <= n; i++ {
+		u := fmt.Sprintf("%s/runCase?case=%d&agent=%s", *addr, i, url.QueryEscape(*agent))
+
+		c, err := cl.DialContext(ctx, u)
+		if err != nil {
+			log.Printf("case %d: dial: %v", i, err)
+			continue
+		}
+
+		err = echo(ctx, c)
+		if err != nil {
+			log.Printf("case %d: %v", i, err)
+		}
+	}
+
+	c, err = cl.DialContext(ctx, *addr+"/updateReports?agent="+url.QueryEscape(*agent))
+	if err != nil {
+		return fmt.Errorf("update reports: %w", err)
+	}
+
+	_, _, _ = c.ReadMessage(ctx)
+
+	return c.Close()
+}
+
+func server() error {
+	s := &websocket.Server{
+		Handler: echo,
+	}
+
+	if *compress {
+		s.Compression = &websocket.CompressionParams{}
+	}
+
+	log.Printf("listening %v", *listen)
+
+	return http.ListenAndServe(*listen, s)
+}
+
+// echo sends every message back until the connection is closed.
+// The connection is closed at the end.
+func echo(ctx context.Context, c *websocket.Conn) (err error) {
+	defer func() {
+		e := c.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	for {
+		op, data, err := c.ReadMessage(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+
+		err = c.WriteMessage(op, data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+}
+
+type result struct {
+	Behavior      string `json:"behavior"`
+	BehaviorClose string `json:"behaviorClose"`
+}
+
+func check() error {
+	var rep map[string]map[string]result
+
+	err := readJSON(*report, &rep)
+	if err != nil {
+		return fmt.Errorf("read report: %w", err)
+	}
+
+	got := map[string]result{}
+
+	for _, cases := range rep {
+		maps.Copy(got, cases)
+	}
+
+	if *update {
+		return writeJSON(*expect, got)
+	}
+
+	var exp map[string]result
+
+	err = readJSON(*expect, &exp)
+	if err != nil {
+		return fmt.Errorf("read expectations: %w", err)
+	}
+
+	if len(exp) == 0 {
+		return fmt.Errorf("no expectations in %v, record a reviewed run with -update", *expect)
+	}
+
+	var failed int
+
+	for _, id := range slices.Sorted(maps.Keys(got)) {
+		r := got[id]
+		e, ok := exp[id]
+
+		switch {
+		case !ok:
+			log.Printf("case %-8v  %v / %v (not in expectations)", id, r.Behavior, r.BehaviorClose)
+			failed++
+		case r != e:
+			log.Printf("case %-8v  %v / %v, expected %v / %v", id, r.Behavior, r.BehaviorClose, e.Behavior, e.BehaviorClose)
+			failed++
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(exp)) {
+		if _, ok := got[id]; !ok {
+			log.Printf("case %-8v  missing in the report", id)
+			failed++
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d cases differ from the expectations", failed)
+	}
+
+	log.Printf("%d cases checked", len(got))
+
+	return nil
+}
+
+func readJSON(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
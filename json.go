@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// WriteJSON encodes v and writes it as a single text message.
+func (c *Conn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	return c.WriteMessage(FrameText, data)
+}
+
+// ReadJSON reads the whole text message and decodes it into v.
+// MaxMessageSize is respected.
+// UnexpectedOpcode is returned for binary messages.
+func (c *Conn) ReadJSON(ctx context.Context, v any) error {
+	c.rmu.Lock()
+	op, data, err := c.appendMessage(ctx, nil)
+	err = c.closedErr(err)
+	c.unlockRead()
+	if err != nil {
+		return err
+	}
+
+	if op != FrameText {
+		return UnexpectedOpcode(op)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return nil
+}
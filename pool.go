@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"net"
+	"sync"
+)
+
+type (
+	// BufferPool is used by Conn to get read and write buffers.
+	// Buffers are returned to the pool on Conn.Close,
+	// so the Conn must not be used after that until Reset.
+	// Slices returned to the user are never backed by pool buffers.
+	BufferPool interface {
+		Get() []byte
+		Put([]byte)
+	}
+
+	// SyncBufferPool is a BufferPool based on sync.Pool.
+	SyncBufferPool struct {
+		Size int // size of new buffers, defaultReadBufSize if zero
+
+		p sync.Pool
+	}
+)
+
+func (p *SyncBufferPool) Get() []byte {
+	if b, ok := p.p.Get().(*[]byte); ok {
+		return *b
+	}
+
+	return make([]byte, p.size())
+}
+
+func (p *SyncBufferPool) Put(b []byte) {
+	if cap(b) < p.size() {
+		return
+	}
+
+	b = b[:cap(b)]
+	p.p.Put(&b)
+}
+
+func (p *SyncBufferPool) size() int {
+	return csel(p.Size != 0, p.Size, defaultReadBufSize)
+}
+
+func (c *Conn) allocReadBuf(size int) {
+	if c.pool != nil && c.rbuf == nil {
+		c.rbuf = c.pool.Get()
+	}
+
+	c.rbuf = grow(c.rbuf, size)
+}
+
+// getBuf returns a temporary buffer from the pool, or allocates one of size bytes.
+func (c *Conn) getBuf(size int) []byte {
+	if c.pool != nil {
+		return c.pool.Get()
+	}
+
+	return make([]byte, size)
+}
+
+func (c *Conn) putBuf(b []byte) {
+	if c.pool != nil {
+		c.pool.Put(b)
+	}
+}
+
+// allocWriteBuf must be called with wmu held.
+func (c *Conn) allocWriteBuf() {
+	if c.wbuf != nil {
+		return
+	}
+
+	switch {
+	case c.pool != nil:
+		c.wbuf = c.pool.Get()[:0]
+	case c.WriteBufferSize != 0:
+		c.wbuf = make([]byte, 0, c.WriteBufferSize)
+	}
+}
+
+// releaseBuffers must be called with wmu held.
+// The read buffer may still be in use by a reader,
+// so it's released by the reader when it's done if rmu is busy.
+func (c *Conn) releaseBuffers() {
+	if c.pool == nil {
+		return
+	}
+
+	if c.wbuf != nil {
+		c.pool.Put(c.wbuf)
+	}
+
+	c.wbuf = nil
+
+	c.rrelease.Store(true)
+
+	if c.rmu.TryLock() {
+		c.releaseReadBuf()
+		c.rmu.Unlock()
+	}
+}
+
+// unlockRead releases the read lock releasing the read buffer first if Close asked for it.
+func (c *Conn) unlockRead() {
+	c.releaseReadBuf()
+	c.rmu.Unlock()
+
+	// Close failed to TryLock after setting the flag
+	// while we were past the release, so it's on us.
+	if c.rrelease.Load() && c.rmu.TryLock() {
+		c.releaseReadBuf()
+		c.rmu.Unlock()
+	}
+}
+
+// releaseReadBuf must be called with rmu held.
+func (c *Conn) releaseReadBuf() {
+	if !c.rrelease.Load() || !c.rrelease.Swap(false) {
+		return
+	}
+
+	if c.rbuf != nil {
+		c.pool.Put(c.rbuf)
+	}
+
+	c.rbuf = nil
+	c.st, c.i, c.end = 0, 0, 0
+	c.start, c.more = 0, 0
+}
+
+// discardReadBuf returns the read buffer to the pool
+// if the handshake fails after the Conn is created.
+// The Conn is not shared yet, so no locking is needed.
+func (c *Conn) discardReadBuf() {
+	if c.pool != nil && c.rbuf != nil {
+		c.pool.Put(c.rbuf)
+	}
+
+	c.rbuf = nil
+	c.st, c.i, c.end = 0, 0, 0
+}
+
+// Reset makes the Conn reusable over a new connection, as if it was created with conn,
+// keeping the buffers allocated.
+// Exported fields, BufferPool, and ping and pong handlers are kept.
+// Everything else is reset: parsing state, closed flags, deadlines, idle timeout,
+// write buffering, negotiated subprotocol, extensions, and compression, and Stats.
+// The previous connection is not closed.
+//
+// It must not be called concurrently with any other method,
+// and all the I/O including Frames returned by NextFrame must be done by then.
+func (c *Conn) Reset(conn net.Conn, client bool) {
+	if c.deflate != nil {
+		c.ReservedBits &^= rsvDeflate
+	}
+
+	*c = Conn{
+		Conn: conn,
+
+		MaxMessageSize:          c.MaxMessageSize,
+		AllowUnmaskedFromClient: c.AllowUnmaskedFromClient,
+		ReservedBits:            c.ReservedBits,
+		ReadBufferSize:          c.ReadBufferSize,
+		MaxReadBufferSize:       c.MaxReadBufferSize,
+		WriteBufferSize:         c.WriteBufferSize,
+		CompressionThreshold:    c.CompressionThreshold,
+		WriteTimeout:            c.WriteTimeout,
+		MaskKey:                 c.MaskKey,
+
+		client: csel[byte](client, 1, 0),
+
+		wbuf: c.wbuf[:0],
+		rbuf: c.rbuf,
+		pool: c.pool,
+
+		pingHandler: c.pingHandler,
+		pongHandler: c.pongHandler,
+	}
+}
@@ -0,0 +1,262 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func (cl *Client) dialProxy(ctx context.Context, proxy *url.URL, addr string) (c net.Conn, err error) {
+	paddr := hostPort(proxy)
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %v", proxy.Scheme)
+	}
+
+	c, err = cl.netDial(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if proxy.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: proxy.Hostname()})
+
+		err = tc.HandshakeContext(ctx)
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+
+		c = tc
+	}
+
+	defer closerOnErr(c, &err)
+	defer Stopper(ctx, c.SetDeadline)()
+
+	switch proxy.Scheme {
+	case "socks5":
+		addr, err = cl.resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		fallthrough
+	case "socks5h":
+		err = socks5Connect(c, proxy, addr)
+	default:
+		err = httpConnect(c, proxy, addr)
+	}
+
+	err = FixError(ctx, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// resolve replaces the host name in addr with its first IP address.
+func (cl *Client) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	r := cl.Dialer.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("resolve: %w", err)
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+func httpConnect(c net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		req.SetBasicAuth(u.Username(), pass)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+
+	err := req.Write(c)
+	if err != nil {
+		return fmt.Errorf("write connect: %w", err)
+	}
+
+	r := bufio.NewReader(c)
+
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return fmt.Errorf("read connect response: %w", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connect: %v", resp.Status)
+	}
+
+	if r.Buffered() != 0 {
+		return ErrTrailingData
+	}
+
+	return nil
+}
+
+func socks5Connect(c net.Conn, proxy *url.URL, addr string) error {
+	const (
+		ver      = 5
+		noAuth   = 0
+		userPass = 2
+		connect  = 1
+
+		atypIPv4   = 1
+		atypDomain = 3
+		atypIPv6   = 4
+	)
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	portn, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("parse port: %w", err)
+	}
+
+	b := []byte{ver, 1, noAuth}
+	if proxy.User != nil {
+		b = []byte{ver, 2, noAuth, userPass}
+	}
+
+	_, err = c.Write(b)
+	if err != nil {
+		return fmt.Errorf("write methods: %w", err)
+	}
+
+	var resp [4]byte
+
+	_, err = io.ReadFull(c, resp[:2])
+	if err != nil {
+		return fmt.Errorf("read method: %w", err)
+	}
+
+	switch {
+	case resp[0] != ver:
+		return fmt.Errorf("unexpected socks version: %d", resp[0])
+	case resp[1] == noAuth:
+	case resp[1] == userPass && proxy.User != nil:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("too long username or password")
+		}
+
+		b = append(b[:0], 1, byte(len(user)))
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		b = append(b, pass...)
+
+		_, err = c.Write(b)
+		if err != nil {
+			return fmt.Errorf("write auth: %w", err)
+		}
+
+		_, err = io.ReadFull(c, resp[:2])
+		if err != nil {
+			return fmt.Errorf("read auth: %w", err)
+		}
+
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable auth method")
+	}
+
+	b = append(b[:0], ver, connect, 0)
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("too long host name")
+		}
+
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, atypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, atypIPv6)
+		b = append(b, ip.To16()...)
+	}
+
+	b = binary.BigEndian.AppendUint16(b, uint16(portn))
+
+	_, err = c.Write(b)
+	if err != nil {
+		return fmt.Errorf("write connect: %w", err)
+	}
+
+	_, err = io.ReadFull(c, resp[:4])
+	if err != nil {
+		return fmt.Errorf("read connect reply: %w", err)
+	}
+
+	if resp[1] != 0 {
+		return fmt.Errorf("connect failed: socks reply %d", resp[1])
+	}
+
+	var skip int
+
+	switch resp[3] {
+	case atypIPv4:
+		skip = 4
+	case atypIPv6:
+		skip = 16
+	case atypDomain:
+		_, err = io.ReadFull(c, resp[:1])
+		if err != nil {
+			return fmt.Errorf("read connect reply: %w", err)
+		}
+
+		skip = int(resp[0])
+	default:
+		return fmt.Errorf("unexpected address type: %d", resp[3])
+	}
+
+	_, err = io.CopyN(io.Discard, c, int64(skip)+2)
+	if err != nil {
+		return fmt.Errorf("read connect reply: %w", err)
+	}
+
+	return nil
+}
@@ -1,38 +1,183 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 )
 
 type (
 	Server struct {
 		Handler Handler
+
+		// Subprotocols supported by the server in preference order.
+		// The first one offered by the client is selected.
+		Subprotocols []string
+
+		// SubprotocolRequired makes Handshake fail if no subprotocol was agreed on.
+		SubprotocolRequired bool
+
+		// NegotiateExtensions is called with the extensions offered by the client
+		// and returns the accepted ones which are sent back as is.
+		// No extensions are accepted if nil.
+		// See Conn.ReservedBits for extensions using RSV bits.
+		NegotiateExtensions func(offered []string) (accepted []string)
+
+		// Compression accepts permessage-deflate extension if offered by the client.
+		// Params set here are added to the ones requested by the client.
+		// permessage-deflate offers are not passed to NegotiateExtensions if set.
+		Compression *CompressionParams
+
+		// CheckOrigin rejects the request with ErrForbidden if returned false.
+		// All origins are allowed if nil. See SameOriginChecker.
+		CheckOrigin func(req *http.Request) bool
+
+		// ResponseHeader is added to the 101 response, e.g. for Set-Cookie.
+		// Handshake headers take precedence.
+		// Per request headers can be set on w.Header() before calling Handshake.
+		ResponseHeader http.Header
+
+		// ReadBufferSize and WriteBufferSize are set to all the connections accepted.
+		// See Conn fields with the same names.
+		ReadBufferSize  int
+		WriteBufferSize int
+
+		// ReadLimit is set as MaxMessageSize to all the connections accepted,
+		// so handlers of untrusted clients get the limit without configuring each Conn.
+		// Messages exceeding it fail the connection with StatusTooBig.
+		// Streaming reads, like Read and NextFrame, only use the read buffer and are not limited.
+		// Zero means no limit.
+		ReadLimit int
+
+		// WriteTimeout is set to all the connections accepted, see Conn.WriteTimeout.
+		// It's not applied to the handshake, see HandshakeTimeout.
+		WriteTimeout time.Duration
+
+		// BufferPool is set to all the connections accepted.
+		BufferPool BufferPool
+
+		// HandshakeTimeout bounds the part of the handshake done on the raw connection:
+		// flushing the response after the hijack in Handshake,
+		// and reading the request and writing the response in Upgrade.
+		// The deadline is cleared when the handshake is done.
+		//
+		// Reading the request headers in Handshake is covered by http.Server.ReadHeaderTimeout.
+		// The hijacked connection may have deadlines set by http.Server,
+		// they are left as is if HandshakeTimeout is zero.
+		// HTTP/2 handshake relies on the http.Server timeouts.
+		HandshakeTimeout time.Duration
+
+		// EnableHTTP2 accepts HTTP/2 extended CONNECT requests (RFC 8441).
+		// Such connections use the http.ResponseWriter and the request Body as the stream
+		// instead of hijacking, so they last until the http handler returns.
+		// net/http server must enable extended CONNECT too.
+		EnableHTTP2 bool
 	}
 
+	// Handler serves the websocket connection.
+	// ctx is canceled when the handler returns, the request context is done,
+	// or the connection reading side ends: a close frame is received, the peer violates the protocol,
+	// or the connection is lost. context.Cause returns the error the read returned.
+	// The close is only noticed by reads, so handlers only writing
+	// should keep reading in the background, for example with io.Copy(io.Discard, c).
 	Handler = func(ctx context.Context, c *Conn) error
+
+	// UpgradeOption configures Upgrade.
+	UpgradeOption func(*Server)
 )
 
+// Upgrade performs the handshake inside a http handler using Server configured with opts.
+// The error response is sent to the client if the request is rejected.
+// The Conn must be closed by the caller.
+//
+//	func handler(w http.ResponseWriter, req *http.Request) {
+//		c, err := websocket.Upgrade(w, req, websocket.UpgradeSubprotocols("v2", "v1"))
+//		if err != nil {
+//			return
+//		}
+//
+//		defer c.Close()
+//		// ...
+//	}
+func Upgrade(w http.ResponseWriter, req *http.Request, opts ...UpgradeOption) (*Conn, error) {
+	var s Server
+
+	for _, o := range opts {
+		o(&s)
+	}
+
+	c, written, err := s.handshake(req.Context(), w, req)
+	if err != nil {
+		if !written {
+			http.Error(w, err.Error(), errorStatus(err))
+		}
+
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	return c, nil
+}
+
+// UpgradeSubprotocols sets the subprotocols supported in preference order, see Server.Subprotocols.
+func UpgradeSubprotocols(protos ...string) UpgradeOption {
+	return func(s *Server) {
+		s.Subprotocols = protos
+	}
+}
+
+// UpgradeCheckOrigin sets the origin check, see Server.CheckOrigin and SameOriginChecker.
+func UpgradeCheckOrigin(f func(req *http.Request) bool) UpgradeOption {
+	return func(s *Server) {
+		s.CheckOrigin = f
+	}
+}
+
+// UpgradeResponseHeader adds the header to the 101 response.
+func UpgradeResponseHeader(key, value string) UpgradeOption {
+	return func(s *Server) {
+		if s.ResponseHeader == nil {
+			s.ResponseHeader = make(http.Header)
+		}
+
+		s.ResponseHeader.Add(key, value)
+	}
+}
+
+// WithServer configures the Server used by Upgrade with anything not covered by the other options.
+func WithServer(f func(s *Server)) UpgradeOption {
+	return f
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	hs, err := s.ServeHandler(w, req, s.Handler)
 	if !hs && err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 }
 
+// ServeHandler performs the handshake and calls h with the Conn closing it after that.
+// handshake reports whether the response was sent, so the caller must not write
+// the error response if it's true. The connection is hijacked by then
+// even if the handshake failed after that.
 func (s *Server) ServeHandler(w http.ResponseWriter, req *http.Request, h Handler) (handshake bool, err error) {
-	ctx := req.Context()
+	ctx, cancel := context.WithCancelCause(req.Context())
+	defer cancel(nil)
 
-	c, err := s.Handshake(ctx, w, req)
+	c, handshake, err := s.handshake(ctx, w, req)
 	if err != nil {
-		return false, fmt.Errorf("handshake: %w", err)
+		return handshake, fmt.Errorf("handshake: %w", err)
 	}
 
-	handshake = true
+	c.cancel = cancel
 
 	defer func() {
 		if err == nil {
@@ -51,49 +196,336 @@ func (s *Server) ServeHandler(w http.ResponseWriter, req *http.Request, h Handle
 }
 
 func (s *Server) Handshake(ctx context.Context, w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	c, _, err := s.handshake(ctx, w, req)
+
+	return c, err
+}
+
+// handshake is Handshake also reporting whether the response was written,
+// so it's too late to write the error response.
+func (s *Server) handshake(ctx context.Context, w http.ResponseWriter, req *http.Request) (wc *Conn, written bool, err error) {
+	if isExtendedConnect(req) {
+		if !s.EnableHTTP2 {
+			return nil, false, ErrNotWebsocket
+		}
+
+		return s.handshakeHTTP2(w, req)
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		return nil, ErrNotHijacker
+		return nil, false, ErrNotHijacker
+	}
+
+	proto, exts, comp, err := s.checkRequest(req, w.Header())
+	if err != nil {
+		return nil, false, err
+	}
+
+	w.WriteHeader(http.StatusSwitchingProtocols)
+
+	c, buf, err := hj.Hijack()
+	if err != nil {
+		return nil, true, fmt.Errorf("hijack: %w", err)
+	}
+
+	defer closerOnErr(c, &err)
+
+	err = s.handshakeDeadline(c, true)
+	if err != nil {
+		return nil, true, err
+	}
+
+	defer s.clearHandshakeDeadline(c, &wc, &err)
+
+	err = buf.Writer.Flush()
+	if err != nil {
+		return nil, true, fmt.Errorf("flush response: %w", err)
+	}
+
+	wc = &Conn{
+		Conn: c,
+		pool: s.BufferPool,
+
+		MaxMessageSize:  s.ReadLimit,
+		ReadBufferSize:  s.ReadBufferSize,
+		WriteBufferSize: s.WriteBufferSize,
+		WriteTimeout:    s.WriteTimeout,
+
+		subprotocol: proto,
+		extensions:  exts,
+		req:         handshakeRequest(req),
+
+		laddr: c.LocalAddr(),
+		raddr: c.RemoteAddr(),
+	}
+
+	wc.setCompression(comp)
+
+	// the client may pipeline the first frames right after the request
+	err = wc.readBuffered(buf.Reader)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return wc, true, nil
+}
+
+// Upgrade performs the server side of the handshake directly over the conn,
+// which is useful for connections accepted outside of net/http.
+// r is the reader the request was read with, the bytes it has buffered
+// beyond the request are the first frames, which the client may pipeline.
+// It's created if nil. If req is nil it's read from r.
+// The error response is written to the conn if the request is rejected,
+// but the conn is not closed in any case.
+func (s *Server) Upgrade(conn net.Conn, r *bufio.Reader, req *http.Request) (c *Conn, err error) {
+	err = s.handshakeDeadline(conn, true)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.clearHandshakeDeadline(conn, &c, &err)
+
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+
+	if req == nil {
+		req, err = http.ReadRequest(r)
+		if err != nil {
+			return nil, fmt.Errorf("read request: %w", err)
+		}
+	}
+
+	resp := &http.Response{
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	proto, exts, comp, err := s.checkRequest(req, resp.Header)
+	if err != nil {
+		msg := err.Error() + "\n"
+
+		resp.StatusCode = errorStatus(err)
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Body = io.NopCloser(strings.NewReader(msg))
+		resp.ContentLength = int64(len(msg))
+
+		_ = writeResponse(conn, resp)
+
+		return nil, err
+	}
+
+	resp.StatusCode = http.StatusSwitchingProtocols
+
+	err = writeResponse(conn, resp)
+	if err != nil {
+		return nil, fmt.Errorf("write response: %w", err)
+	}
+
+	wc := &Conn{
+		Conn: conn,
+		pool: s.BufferPool,
+
+		MaxMessageSize:  s.ReadLimit,
+		ReadBufferSize:  s.ReadBufferSize,
+		WriteBufferSize: s.WriteBufferSize,
+		WriteTimeout:    s.WriteTimeout,
+
+		subprotocol: proto,
+		extensions:  exts,
+		req:         handshakeRequest(req),
+
+		laddr: conn.LocalAddr(),
+		raddr: conn.RemoteAddr(),
+	}
+
+	wc.setCompression(comp)
+
+	err = wc.readBuffered(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return wc, nil
+}
+
+// handshakeDeadline sets HandshakeTimeout deadline at the start of the handshake
+// and clears it at the end.
+func (s *Server) handshakeDeadline(c net.Conn, start bool) error {
+	if s.HandshakeTimeout == 0 {
+		return nil
+	}
+
+	var t time.Time
+	if start {
+		t = time.Now().Add(s.HandshakeTimeout)
+	}
+
+	err := c.SetDeadline(t)
+	if err != nil {
+		return fmt.Errorf("set handshake deadline: %w", err)
+	}
+
+	return nil
+}
+
+// clearHandshakeDeadline clears the handshake deadline whatever the handshake result is.
+// The Conn is dropped if it fails.
+func (s *Server) clearHandshakeDeadline(conn net.Conn, c **Conn, errp *error) {
+	err := s.handshakeDeadline(conn, false)
+	if err == nil || *errp != nil {
+		return
+	}
+
+	if *c != nil {
+		(*c).discardReadBuf()
+	}
+
+	*c, *errp = nil, err
+}
+
+// handshakeRequest returns a copy of req safe to keep after the upgrade.
+// Body is replaced as the connection doesn't belong to net/http anymore,
+// or as it's the stream used by the Conn for HTTP/2.
+func handshakeRequest(req *http.Request) *http.Request {
+	if req.Body != nil && !isExtendedConnect(req) {
+		_ = req.Body.Close()
+	}
+
+	r := req.Clone(req.Context())
+	r.Body = http.NoBody
+	r.GetBody = nil
+
+	return r
+}
+
+// writeResponse writes the response with a single Write call.
+func writeResponse(c net.Conn, resp *http.Response) error {
+	w := bufio.NewWriter(c)
+
+	err := resp.Write(w)
+	if err != nil {
+		return err
 	}
 
+	return w.Flush()
+}
+
+// checkRequest validates the handshake request and sets the response headers.
+func (s *Server) checkRequest(req *http.Request, resp http.Header) (proto string, exts []string, comp *CompressionParams, err error) {
 	var key string
 	h := req.Header
+	h2 := isExtendedConnect(req)
 
-	if v := h.Get("Connection"); !strings.EqualFold(v, "Upgrade") {
-		return nil, ErrNotWebsocket
+	if !h2 && !headerHasToken(h, "Connection", "upgrade") {
+		return "", nil, nil, ErrNotWebsocket
 	}
-	if v := h.Get("Upgrade"); !strings.EqualFold(v, "websocket") {
-		return nil, ErrNotWebsocket
+	if !h2 && !headerHasProtocol(h, "Upgrade", "websocket") {
+		return "", nil, nil, ErrNotWebsocket
 	}
 	if v := h.Get("Sec-WebSocket-Version"); v != "13" {
-		return nil, ErrNotWebsocket
+		resp.Set("Sec-WebSocket-Version", "13")
+
+		return "", nil, nil, ErrBadVersion
 	}
-	if v := h.Get("Sec-WebSocket-Key"); v == "" {
-		return nil, ErrProtocol
+
+	// HTTP/2 request body is the stream, and there is no key
+	if !h2 && (req.ContentLength != 0 || len(req.TransferEncoding) != 0) {
+		return "", nil, nil, ErrTrailingData
+	}
+	if v := h.Get("Sec-WebSocket-Key"); v == "" && !h2 {
+		return "", nil, nil, ErrProtocol
 	} else {
 		key = v
 	}
 
-	h = w.Header()
+	if s.CheckOrigin != nil && !s.CheckOrigin(req) {
+		return "", nil, nil, ErrForbidden
+	}
 
-	h.Set("Connection", "Upgrade")
-	h.Set("Upgrade", "websocket")
-	h.Set("Sec-WebSocket-Accept", secKeyHash(key))
+	proto = s.selectSubprotocol(headerTokens(h, "Sec-WebSocket-Protocol"))
+	if proto == "" && s.SubprotocolRequired {
+		return "", nil, nil, ErrNoSubprotocol
+	}
 
-	w.WriteHeader(http.StatusSwitchingProtocols)
+	offered := headerTokens(h, "Sec-WebSocket-Extensions")
 
-	c, buf, err := hj.Hijack()
-	if err != nil {
-		return nil, fmt.Errorf("hijack: %w", err)
+	if s.Compression != nil {
+		comp, offered = s.negotiateCompression(offered)
 	}
 
-	if buf.Reader.Buffered() != 0 || buf.Writer.Buffered() != 0 {
-		return nil, ErrTrailingData
+	if s.NegotiateExtensions != nil {
+		exts = s.NegotiateExtensions(offered)
 	}
 
-	wc := &Conn{
-		Conn: c,
+	if comp != nil {
+		exts = append(exts, comp.String())
 	}
 
-	return wc, nil
+	for k, v := range s.ResponseHeader {
+		resp[k] = append(resp[k], v...)
+	}
+
+	if !h2 {
+		resp.Set("Connection", "Upgrade")
+		resp.Set("Upgrade", "websocket")
+		resp.Set("Sec-WebSocket-Accept", secKeyHash(key))
+	}
+
+	if proto != "" {
+		resp.Set("Sec-WebSocket-Protocol", proto)
+	}
+
+	if len(exts) != 0 {
+		resp.Set("Sec-WebSocket-Extensions", strings.Join(exts, ", "))
+	}
+
+	return proto, exts, comp, nil
+}
+
+// SameOriginChecker returns CheckOrigin func which allows requests
+// with Origin header host equal to the request Host.
+// The default port of the Origin scheme is assumed where the port is omitted,
+// so https://example.com and https://example.com:443 are the same origin.
+// Requests without Origin header are allowed as they are not from a browser.
+func SameOriginChecker() func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+
+		host := hostPort(&url.URL{Scheme: u.Scheme, Host: req.Host})
+
+		return u.Host != "" && strings.EqualFold(hostPort(u), host)
+	}
+}
+
+func (s *Server) selectSubprotocol(offered []string) string {
+	for _, p := range s.Subprotocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+
+	return ""
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrBadVersion):
+		return http.StatusUpgradeRequired
+	default:
+		return http.StatusBadRequest
+	}
 }
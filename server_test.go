@@ -0,0 +1,1232 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubprotocol(t *testing.T) {
+	ctx := context.Background()
+
+	s := &Server{
+		Subprotocols:        []string{"v2", "v1"},
+		SubprotocolRequired: true,
+		Handler: func(ctx context.Context, c *Conn) error {
+			if c.Subprotocol() != "v1" {
+				t.Errorf("server subprotocol: %q", c.Subprotocol())
+			}
+
+			return nil
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	cl := Client{Subprotocols: []string{"v1", "v0"}}
+
+	c, err := cl.DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	if c.Subprotocol() != "v1" {
+		t.Errorf("client subprotocol: %q", c.Subprotocol())
+	}
+
+	_ = c.Close()
+
+	cl.Subprotocols = []string{"v0"}
+
+	_, err = cl.DialContext(ctx, hs.URL)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	ctx := context.Background()
+
+	s := &Server{
+		CheckOrigin: SameOriginChecker(),
+		Handler: func(ctx context.Context, c *Conn) error {
+			return nil
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	for _, tc := range []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{hs.URL, http.StatusSwitchingProtocols},
+		{"http://evil.example.com", http.StatusForbidden},
+	} {
+		var cl Client
+
+		req, err := cl.NewRequest(ctx, hs.URL)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+
+		c, resp, err := cl.Handshake(ctx, req)
+		if resp == nil || resp.StatusCode != tc.status {
+			t.Errorf("origin %q: expected %v, got %v %v", tc.origin, tc.status, resp, err)
+		}
+
+		if c != nil {
+			_ = c.Close()
+		}
+	}
+}
+
+func TestUpgradeFunc(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, err := Upgrade(w, req,
+			UpgradeSubprotocols("v1", "v2"),
+			UpgradeCheckOrigin(SameOriginChecker()),
+			UpgradeResponseHeader("X-Test", "value"),
+			WithServer(func(s *Server) { s.ReadBufferSize = 128 }),
+		)
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		_ = c.WriteMessage(FrameText, fmt.Appendf(nil, "%s %d", c.Subprotocol(), c.ReadBufferSize))
+	}))
+	defer hs.Close()
+
+	c, resp, err := Dial(ctx, hs.URL, WithSubprotocols("v2"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if resp.Header.Get("X-Test") != "value" {
+		t.Errorf("response header: %v", resp.Header)
+	}
+
+	_, data, err := c.ReadMessage(ctx)
+	if err != nil || string(data) != "v2 128" {
+		t.Errorf("read: %q %v", data, err)
+	}
+
+	_, resp, err = Dial(ctx, hs.URL, WithHeader("Origin", "http://evil.example.com"))
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %v %v", resp, err)
+	}
+
+	resp, err = http.Get(hs.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), ErrNotWebsocket.Error()) {
+		t.Errorf("plain request: %v %q", resp.Status, body)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	ctx := context.Background()
+
+	s := &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			for {
+				op, data, err := c.appendMessage(ctx, nil)
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				_, err = c.WriteFrame(data, op, true)
+				if err != nil {
+					return err
+				}
+			}
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	var cl Client
+
+	c, err := cl.DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	for i, msg := range []string{"a", "", strings.Repeat("long message ", 1000)} {
+		_, err = c.WriteFrame([]byte(msg), FrameText, true)
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+
+		op, data, err := c.appendMessage(ctx, nil)
+		if err != nil || op != FrameText || string(data) != msg {
+			t.Errorf("read %d: %v %q %v", i, op, data, err)
+		}
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	hs := httptest.NewServer(&Server{})
+	defer hs.Close()
+
+	var cl Client
+
+	req := newRequest(t, &cl, hs.URL)
+	req.Header.Set("Sec-WebSocket-Version", "8")
+
+	_, resp, err := cl.Handshake(context.Background(), req)
+	if err == nil || resp == nil {
+		t.Fatalf("expected error response, got %v %v", resp, err)
+	}
+
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("unexpected response: %v %v", resp.Status, resp.Header)
+	}
+}
+
+func TestHandshakeHeaderTokens(t *testing.T) {
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error { return nil },
+	})
+	defer hs.Close()
+
+	for _, tc := range []struct {
+		connection []string
+		upgrade    []string
+		ok         bool
+	}{
+		{[]string{"keep-alive, Upgrade"}, []string{"WebSocket"}, true},
+		{[]string{"Upgrade, keep-alive"}, []string{"websocket, h2c"}, true},
+		{[]string{"keep-alive", "upgrade"}, []string{"h2c", "WEBSOCKET"}, true},
+		{[]string{"Upgrade"}, []string{"h2c, websocket/13"}, true},
+		{[]string{"Upgrade"}, []string{"websocket ; param=1"}, true},
+		{[]string{"Upgrade"}, []string{"h2c, websockets"}, false},
+		{[]string{"Upgrade"}, []string{"websocket-like"}, false},
+		{[]string{"keep-alive, upgrades"}, []string{"websocket"}, false},
+	} {
+		var cl Client
+
+		req := newRequest(t, &cl, hs.URL)
+		req.Header["Connection"] = tc.connection
+		req.Header["Upgrade"] = tc.upgrade
+
+		c, _, err := cl.Handshake(context.Background(), req)
+		if (err == nil) != tc.ok {
+			t.Errorf("connection %q upgrade %q: %v", tc.connection, tc.upgrade, err)
+		}
+
+		if c != nil {
+			_ = c.Close()
+		}
+
+		// the same rules for the response
+		accept := secKeyHash(req.Header.Get("Sec-WebSocket-Key"))
+
+		resp := &http.Response{Header: http.Header{
+			"Connection":           tc.connection,
+			"Upgrade":              tc.upgrade,
+			"Sec-Websocket-Accept": {accept},
+		}}
+
+		_, err = checkResponse(req, resp)
+		if (err == nil) != tc.ok {
+			t.Errorf("response: connection %q upgrade %q: %v", tc.connection, tc.upgrade, err)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	ctx := context.Background()
+
+	var offered []string
+
+	s := &Server{
+		NegotiateExtensions: func(exts []string) []string {
+			offered = exts
+
+			return []string{"x-bar"}
+		},
+		Handler: func(ctx context.Context, c *Conn) error {
+			if exts := c.NegotiatedExtensions(); !slices.Equal(exts, []string{"x-bar"}) {
+				t.Errorf("server extensions: %q", exts)
+			}
+
+			return nil
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	cl := Client{Extensions: []string{"x-foo; a=1", "x-bar"}}
+
+	c, err := cl.DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if !slices.Equal(offered, []string{"x-foo; a=1", "x-bar"}) {
+		t.Errorf("offered extensions: %q", offered)
+	}
+
+	if exts := c.NegotiatedExtensions(); !slices.Equal(exts, []string{"x-bar"}) {
+		t.Errorf("client extensions: %q", exts)
+	}
+
+	cl.Extensions = []string{"x-foo"}
+
+	_, err = cl.DialContext(ctx, hs.URL)
+	if err == nil {
+		t.Errorf("expected error for not requested extension")
+	}
+}
+
+func TestServerUpgradePipe(t *testing.T) {
+	ctx := context.Background()
+
+	sc, cc := net.Pipe()
+	defer sc.Close()
+
+	s := &Server{Subprotocols: []string{"proto"}}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		c, err := s.Upgrade(sc, nil, nil)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		defer c.Close()
+
+		if c.Subprotocol() != "proto" {
+			t.Errorf("server subprotocol: %q", c.Subprotocol())
+		}
+		if !c.IsServer() || c.IsClient() || c.Stats().Client {
+			t.Errorf("server conn has client role")
+		}
+
+		err = c.WriteMessage(FrameText, []byte("upgraded"))
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		_, _, err = c.ReadMessage(ctx)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+
+		errc <- err
+	}()
+
+	cl := Client{
+		Subprotocols: []string{"proto"},
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cc, nil
+		},
+	}
+
+	c, err := cl.DialContext(ctx, "ws://pipe/")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	if !c.IsClient() || c.IsServer() || !c.Stats().Client {
+		t.Errorf("client conn has server role")
+	}
+
+	_, data, err := c.ReadMessage(ctx)
+	if err != nil || string(data) != "upgraded" {
+		t.Errorf("read message: %q %v", data, err)
+	}
+
+	_ = c.Close()
+
+	if err := <-errc; err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
+
+func TestServerUpgradePipelined(t *testing.T) {
+	sc, cc := newPipe()
+	defer sc.Close()
+	defer cc.Close()
+
+	// the request and the first frame arrive in one write
+	in := []byte("GET / HTTP/1.1\r\nHost: pipe\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	in = append(in, maskedFrameBytes(FrameText, []byte("pipelined"), true)...)
+
+	_, err := cc.Write(in)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// the caller reads the request itself, so the frame is buffered in its reader
+	br := bufio.NewReader(sc)
+
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+
+	if br.Buffered() == 0 {
+		t.Fatalf("frame is not buffered")
+	}
+
+	c, err := (&Server{}).Upgrade(sc, br, req)
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	_, data, err := c.ReadMessage(context.Background())
+	if err != nil || string(data) != "pipelined" {
+		t.Errorf("read message: %q %v", data, err)
+	}
+}
+
+// clearDeadlineErrConn fails to clear the deadline.
+type clearDeadlineErrConn struct {
+	net.Conn
+}
+
+func (c clearDeadlineErrConn) SetDeadline(t time.Time) error {
+	if t.IsZero() {
+		return errors.New("clear deadline failed")
+	}
+
+	return c.Conn.SetDeadline(t)
+}
+
+func TestSameOriginChecker(t *testing.T) {
+	check := SameOriginChecker()
+
+	for _, tc := range []struct {
+		host, origin string
+		ok           bool
+	}{
+		{"example.com", "", true},
+		{"example.com", "https://example.com", true},
+		{"example.com", "https://EXAMPLE.com", true},
+		{"example.com", "https://example.com:443", true},
+		{"example.com:443", "https://example.com", true},
+		{"example.com", "http://example.com:80", true},
+		{"example.com:80", "http://example.com", true},
+		{"example.com:8080", "http://example.com:8080", true},
+		{"[::1]:443", "https://[::1]", true},
+		{"example.com", "https://example.com:8443", false},
+		{"example.com:443", "http://example.com", false},
+		{"example.com:80", "https://example.com", false},
+		{"example.com", "https://evil.example.com", false},
+		{"example.com", "null", false},
+		{"example.com", "://bad", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tc.host
+
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+
+		if ok := check(req); ok != tc.ok {
+			t.Errorf("host %q origin %q: expected %v", tc.host, tc.origin, tc.ok)
+		}
+	}
+}
+
+func TestServerUpgradeErrorPool(t *testing.T) {
+	sc, cc := newPipe()
+	defer sc.Close()
+	defer cc.Close()
+
+	in := []byte("GET / HTTP/1.1\r\nHost: pipe\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	in = append(in, maskedFrameBytes(FrameText, []byte("pipelined"), true)...)
+
+	_, err := cc.Write(in)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var p countPool
+
+	s := &Server{HandshakeTimeout: time.Second, BufferPool: &p}
+
+	// the pipelined frame is read into the pooled buffer before the handshake fails
+	c, err := s.Upgrade(clearDeadlineErrConn{Conn: sc}, nil, nil)
+	if err == nil || c != nil {
+		t.Fatalf("expected error, got %v %v", c, err)
+	}
+
+	if out := p.Out(); out != 0 {
+		t.Errorf("buffers not returned: %d", out)
+	}
+}
+
+func TestServerUpgradeReject(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+
+	errc := make(chan error, 1)
+
+	go func() {
+		_, err := (&Server{}).Upgrade(sc, nil, req)
+		errc <- err
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(cc), req)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("unexpected response: %v %v", resp.Status, resp.Header)
+	}
+
+	if err := <-errc; !errors.Is(err, ErrBadVersion) {
+		t.Errorf("expected %v, got %v", ErrBadVersion, err)
+	}
+}
+
+func TestConnRequest(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			req := c.Request()
+			if req == nil {
+				t.Errorf("no request")
+				return nil
+			}
+
+			if req.URL.Path != "/chat" || req.URL.Query().Get("room") != "1" || req.Header.Get("X-Token") != "secret" {
+				t.Errorf("unexpected request: %v %v", req.URL, req.Header)
+			}
+
+			if req.Body != http.NoBody {
+				t.Errorf("request body is not replaced")
+			}
+
+			return nil
+		},
+	})
+	defer hs.Close()
+
+	cl := Client{Header: http.Header{"X-Token": {"secret"}}}
+
+	c, err := cl.DialContext(ctx, hs.URL+"/chat?room=1")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	if c.Request() != nil {
+		t.Errorf("client conn request is not nil")
+	}
+
+	_, _, err = c.ReadMessage(ctx)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(&Server{
+		ResponseHeader: http.Header{
+			"Set-Cookie": {"session=abc"},
+			"X-Server":   {"test"},
+			"Upgrade":    {"overridden"},
+		},
+		Handler: func(ctx context.Context, c *Conn) error {
+			return nil
+		},
+	})
+	defer hs.Close()
+
+	var cl Client
+
+	c, resp, err := cl.Handshake(ctx, newRequest(t, &cl, hs.URL))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	defer c.Close()
+
+	if q := resp.Header.Get("Set-Cookie"); q != "session=abc" {
+		t.Errorf("set-cookie: %q", q)
+	}
+	if q := resp.Header.Get("X-Server"); q != "test" {
+		t.Errorf("x-server: %q", q)
+	}
+
+	// values set by the handler are kept
+
+	s := &Server{
+		ResponseHeader: http.Header{
+			"Set-Cookie": make([]string, 1, 4),
+		},
+	}
+
+	s.ResponseHeader["Set-Cookie"][0] = "session=abc"
+
+	hs = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Set-Cookie", "user=me")
+
+		c, err := s.Handshake(req.Context(), w, req)
+		if err != nil {
+			t.Errorf("server handshake: %v", err)
+			return
+		}
+
+		w.Header().Add("Set-Cookie", "late=1")
+
+		_ = c.Close()
+	}))
+	defer hs.Close()
+
+	for range 2 {
+		c, resp, err = cl.Handshake(ctx, newRequest(t, &cl, hs.URL))
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+
+		_ = c.Close()
+
+		if q := resp.Header.Values("Set-Cookie"); !slices.Equal(q, []string{"user=me", "session=abc"}) {
+			t.Errorf("set-cookie: %q", q)
+		}
+	}
+
+	if q := s.ResponseHeader["Set-Cookie"]; !slices.Equal(q[:cap(q)], []string{"session=abc", "", "", ""}) {
+		t.Errorf("server header modified: %q", q[:cap(q)])
+	}
+}
+
+func TestServerPipelinedFrame(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			op, data, err := c.ReadMessage(ctx)
+			if err != nil {
+				return err
+			}
+
+			return c.WriteMessage(op, data)
+		},
+	})
+	defer hs.Close()
+
+	var cl Client
+
+	req := newRequest(t, &cl, hs.URL)
+
+	var buf bytes.Buffer
+
+	err := req.Write(&buf)
+	if err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+
+	buf.Write(maskedFrameBytes(FrameText, []byte("pipelined"), true))
+
+	nc, err := net.Dial("tcp", hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer nc.Close()
+
+	_, err = nc.Write(buf.Bytes())
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	r := bufio.NewReader(nc)
+
+	resp, err := http.ReadResponse(r, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("read response: %v %v", resp, err)
+	}
+
+	c := &Conn{Conn: nc, client: 1}
+
+	err = c.readBuffered(r)
+	if err != nil {
+		t.Fatalf("read buffered: %v", err)
+	}
+
+	op, data, err := c.ReadMessage(ctx)
+	if err != nil || op != FrameText || string(data) != "pipelined" {
+		t.Errorf("read message: %v %q %v", op, data, err)
+	}
+}
+
+// brokenHijacker hijacks a connection failing to write the response.
+type brokenHijacker struct {
+	*httptest.ResponseRecorder
+
+	hijacked    bool
+	afterHijack bool
+}
+
+func (w *brokenHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, p := net.Pipe()
+	_ = p.Close()
+
+	w.hijacked = true
+
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+
+	return c, rw, nil
+}
+
+func (w *brokenHijacker) WriteHeader(code int) {
+	w.afterHijack = w.afterHijack || w.hijacked
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w *brokenHijacker) Write(p []byte) (int, error) {
+	w.afterHijack = w.afterHijack || w.hijacked
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestServerErrorAfterHijack(t *testing.T) {
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		return req
+	}
+
+	s := &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			t.Errorf("handler called")
+			return nil
+		},
+	}
+
+	w := &brokenHijacker{ResponseRecorder: httptest.NewRecorder()}
+
+	s.ServeHTTP(w, newReq())
+
+	if !w.hijacked || w.afterHijack {
+		t.Errorf("serve http: hijacked %v, response written after that %v", w.hijacked, w.afterHijack)
+	}
+
+	w = &brokenHijacker{ResponseRecorder: httptest.NewRecorder()}
+
+	hs, err := s.ServeHandler(w, newReq(), s.Handler)
+	if !hs || err == nil {
+		t.Errorf("serve handler: expected handshake error after hijack, got %v %v", hs, err)
+	}
+
+	w = &brokenHijacker{ResponseRecorder: httptest.NewRecorder()}
+
+	c, err := Upgrade(w, newReq())
+	if c != nil || err == nil {
+		t.Errorf("upgrade: expected error, got %v %v", c, err)
+	}
+
+	if !w.hijacked || w.afterHijack {
+		t.Errorf("upgrade: hijacked %v, response written after that %v", w.hijacked, w.afterHijack)
+	}
+
+	// the error response is sent if the request is rejected before the hijack
+
+	w = &brokenHijacker{ResponseRecorder: httptest.NewRecorder()}
+
+	req := newReq()
+	req.Header.Set("Sec-WebSocket-Version", "8")
+
+	s.ServeHTTP(w, req)
+
+	if w.hijacked || w.Code != http.StatusUpgradeRequired {
+		t.Errorf("rejected: hijacked %v, status %v", w.hijacked, w.Code)
+	}
+}
+
+func TestServerRequestBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", strings.NewReader("body"))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	_, _, _, err := (&Server{}).checkRequest(req, make(http.Header))
+	if !errors.Is(err, ErrTrailingData) {
+		t.Errorf("expected %v, got %v", ErrTrailingData, err)
+	}
+}
+
+type noAddrConn struct {
+	net.Conn
+}
+
+func (noAddrConn) LocalAddr() net.Addr  { return nil }
+func (noAddrConn) RemoteAddr() net.Addr { return nil }
+
+func TestConnAddrWrapped(t *testing.T) {
+	ctx := context.Background()
+
+	var raddr net.Addr
+
+	s := &Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			raddr = c.RemoteAddr()
+			laddr := c.LocalAddr()
+
+			c.Conn = noAddrConn{c.Conn}
+
+			if c.RemoteAddr() != raddr || c.LocalAddr() != laddr || raddr == nil || laddr == nil {
+				t.Errorf("server addrs: %v %v, expected %v %v", c.LocalAddr(), c.RemoteAddr(), laddr, raddr)
+			}
+
+			return nil
+		},
+	}
+
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	c, err := (&Client{}).DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	laddr := c.LocalAddr()
+
+	c.Conn = noAddrConn{c.Conn}
+
+	if c.RemoteAddr().String() != hs.Listener.Addr().String() || c.LocalAddr() != laddr {
+		t.Errorf("client addrs: %v %v", c.LocalAddr(), c.RemoteAddr())
+	}
+
+	_, _, _ = c.ReadMessage(ctx)
+
+	if raddr == nil || raddr.String() != laddr.String() {
+		t.Errorf("server remote addr: %v, expected %v", raddr, laddr)
+	}
+}
+
+// streamResponseWriter is HTTP/2 response writer streaming the body to w.
+type streamResponseWriter struct {
+	h      http.Header
+	status chan int
+	w      io.Writer
+}
+
+func (w *streamResponseWriter) Header() http.Header { return w.h }
+func (w *streamResponseWriter) Flush()              {}
+
+func (w *streamResponseWriter) WriteHeader(status int) {
+	w.status <- status
+}
+
+func (w *streamResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func TestServerHTTP2(t *testing.T) {
+	ctx := context.Background()
+
+	for _, enable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enable=%v", enable), func(t *testing.T) {
+			s := &Server{
+				EnableHTTP2:  enable,
+				Subprotocols: []string{"v1"},
+				Handler: func(ctx context.Context, c *Conn) error {
+					if c.Request().Method != http.MethodConnect || c.Subprotocol() != "v1" {
+						t.Errorf("server conn: %v %q", c.Request().Method, c.Subprotocol())
+					}
+
+					for {
+						op, data, err := c.ReadMessage(ctx)
+						if err != nil {
+							return err
+						}
+
+						err = c.WriteMessage(op, data)
+						if err != nil {
+							return err
+						}
+					}
+				},
+			}
+
+			reqr, reqw := io.Pipe()
+			respr, respw := io.Pipe()
+
+			req := httptest.NewRequest(http.MethodConnect, "https://example.com/path", reqr)
+			req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+			req.Header.Set(":protocol", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Protocol", "v1")
+
+			w := &streamResponseWriter{h: make(http.Header), status: make(chan int, 1), w: respw}
+
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				defer respw.Close()
+
+				s.ServeHTTP(w, req)
+			}()
+
+			status := <-w.status
+
+			if !enable {
+				if status != http.StatusBadRequest {
+					t.Errorf("status: %v", status)
+				}
+
+				_, _ = io.Copy(io.Discard, respr)
+
+				<-done
+
+				return
+			}
+
+			if status != http.StatusOK || w.h.Get("Sec-WebSocket-Protocol") != "v1" || w.h.Get("Sec-WebSocket-Accept") != "" {
+				t.Fatalf("response: %v %v", status, w.h)
+			}
+
+			c := &Conn{Conn: &splitConn{r: respr, w: reqw}, client: 1}
+
+			for i := range 3 {
+				msg := fmt.Appendf(nil, "message %d", i)
+
+				err := c.WriteMessage(FrameBinary, msg)
+				if err != nil {
+					t.Fatalf("write: %v", err)
+				}
+
+				_, data, err := c.ReadMessage(ctx)
+				if err != nil || !bytes.Equal(data, msg) {
+					t.Fatalf("read: %q %v", data, err)
+				}
+			}
+
+			err := c.CloseWriter(StatusOK)
+			if err != nil {
+				t.Errorf("close writer: %v", err)
+			}
+
+			_, _, err = c.ReadMessage(ctx)
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("expected EOF, got %v", err)
+			}
+
+			<-done
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	ctx := context.Background()
+	timeout := 50 * time.Millisecond
+
+	t.Run("slow_request", func(t *testing.T) {
+		sc, cc := net.Pipe()
+		defer sc.Close()
+		defer cc.Close()
+
+		go func() {
+			_, _ = cc.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n"))
+		}()
+
+		s := &Server{HandshakeTimeout: timeout}
+
+		_, err := s.Upgrade(sc, nil, nil)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	})
+
+	t.Run("cleared_on_reject", func(t *testing.T) {
+		sc, cc := net.Pipe()
+		defer sc.Close()
+		defer cc.Close()
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "8")
+
+		go func() {
+			resp, err := http.ReadResponse(bufio.NewReader(cc), req)
+			if err == nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+			}
+		}()
+
+		s := &Server{HandshakeTimeout: timeout}
+
+		_, err := s.Upgrade(sc, nil, req)
+		if !errors.Is(err, ErrBadVersion) {
+			t.Fatalf("expected %v, got %v", ErrBadVersion, err)
+		}
+
+		time.Sleep(2 * timeout)
+
+		go func() {
+			_, _ = cc.Read(make([]byte, 10))
+		}()
+
+		// the caller still owns the conn, it must not be left with the deadline
+		_, err = sc.Write([]byte("late"))
+		if err != nil {
+			t.Errorf("write after rejected upgrade: %v", err)
+		}
+	})
+
+	t.Run("cleared", func(t *testing.T) {
+		s := &Server{
+			HandshakeTimeout: timeout,
+			Handler: func(ctx context.Context, c *Conn) error {
+				time.Sleep(2 * timeout)
+
+				op, data, err := c.ReadMessage(ctx)
+				if err != nil {
+					return err
+				}
+
+				return c.WriteMessage(op, data)
+			},
+		}
+
+		hs := httptest.NewServer(s)
+		defer hs.Close()
+
+		var cl Client
+
+		c, err := cl.DialContext(ctx, hs.URL)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+
+		defer c.Close()
+
+		err = c.WriteMessage(FrameText, []byte("late"))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		_, data, err := c.ReadMessage(ctx)
+		if err != nil || string(data) != "late" {
+			t.Errorf("read: %q %v", data, err)
+		}
+	})
+}
+
+func TestHandlerContextCanceled(t *testing.T) {
+	ctx := context.Background()
+
+	causes := make(chan error, 1)
+
+	hs := httptest.NewServer(&Server{
+		Handler: func(ctx context.Context, c *Conn) error {
+			go func() {
+				_, _ = io.Copy(io.Discard, c)
+			}()
+
+			// write only handler
+			tk := time.NewTicker(10 * time.Millisecond)
+			defer tk.Stop()
+
+			for {
+				select {
+				case <-tk.C:
+				case <-ctx.Done():
+					causes <- context.Cause(ctx)
+					return nil
+				}
+
+				_, err := c.Write([]byte("tick"))
+				if err != nil {
+					causes <- err
+					return err
+				}
+			}
+		},
+	})
+	defer hs.Close()
+
+	for _, tc := range []struct {
+		name  string
+		close func(c *Conn) error
+		cause error
+	}{
+		{"normal close", func(c *Conn) error { return c.CloseWriter(StatusOK) }, io.EOF},
+		{"going away", func(c *Conn) error { return c.CloseWriter(StatusGoingAway) }, StatusGoingAway},
+		{"protocol violation", func(c *Conn) error {
+			_, err := c.WriteFrame([]byte("a"), FrameContinue, true)
+			return err
+		}, StatusProtocol},
+		{"connection lost", func(c *Conn) error { return c.Conn.Close() }, io.EOF},
+	} {
+		var cl Client
+
+		c, err := cl.DialContext(ctx, hs.URL)
+		if err != nil {
+			t.Fatalf("%s: dial: %v", tc.name, err)
+		}
+
+		// the handler is running
+		_, _, err = c.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("%s: read: %v", tc.name, err)
+		}
+
+		err = tc.close(c)
+		if err != nil {
+			t.Errorf("%s: close: %v", tc.name, err)
+		}
+
+		select {
+		case cause := <-causes:
+			if !errors.Is(cause, tc.cause) {
+				t.Errorf("%s: expected cause %v, got %v", tc.name, tc.cause, cause)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: handler context is not canceled", tc.name)
+		}
+
+		_ = c.Close()
+	}
+}
+
+func TestServerWriteTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	errc := make(chan error, 1)
+
+	hs := httptest.NewServer(&Server{
+		WriteTimeout: 50 * time.Millisecond,
+		Handler: func(ctx context.Context, c *Conn) error {
+			msg := make([]byte, 0x10000)
+
+			for {
+				_, err := c.Write(msg)
+				if err != nil {
+					errc <- err
+					return err
+				}
+			}
+		},
+	})
+	defer hs.Close()
+
+	var cl Client
+
+	c, err := cl.DialContext(ctx, hs.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	defer c.Close()
+
+	// the client never reads
+
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write didn't time out")
+	}
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestServerReadLimit(t *testing.T) {
+	ctx := context.Background()
+
+	// no Handler, the Conn is used directly after the handshake
+	c, s := pipeHandshake(t, &Server{ReadLimit: 100}, &Client{})
+	defer c.Close()
+	defer s.Close()
+
+	if s.MaxMessageSize != 100 || c.MaxMessageSize != 0 {
+		t.Errorf("max message size: server %v, client %v", s.MaxMessageSize, c.MaxMessageSize)
+	}
+
+	for _, msg := range [][]byte{make([]byte, 100), make([]byte, 101)} {
+		err := c.WriteMessage(FrameBinary, msg)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	_, data, err := s.ReadMessage(ctx)
+	if err != nil || len(data) != 100 {
+		t.Errorf("read message at the limit: %v %v", len(data), err)
+	}
+
+	_, _, err = s.ReadMessage(ctx)
+	if !errors.Is(err, ErrTooBig) {
+		t.Errorf("expected %v, got %v", ErrTooBig, err)
+	}
+
+	_, _, err = c.ReadMessage(ctx)
+	if CloseStatus(err) != StatusTooBig {
+		t.Errorf("client expected %v close, got %v", StatusTooBig, err)
+	}
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Stats are connection counters.
+	// Bytes are counted on the wire including frame headers.
+	Stats struct {
+		Client bool // the connection is the client side
+
+		BytesRead    int64
+		BytesWritten int64
+
+		FramesRead    int64
+		FramesWritten int64
+
+		MessagesRead    int64
+		MessagesWritten int64
+
+		PingsReceived int64
+		PingsSent     int64
+		PongsReceived int64
+		PongsSent     int64
+
+		LastActivity time.Time
+	}
+
+	connStats struct {
+		bytesRead    atomic.Int64
+		bytesWritten atomic.Int64
+
+		framesRead    atomic.Int64
+		framesWritten atomic.Int64
+
+		messagesRead    atomic.Int64
+		messagesWritten atomic.Int64
+
+		pingsReceived atomic.Int64
+		pingsSent     atomic.Int64
+		pongsReceived atomic.Int64
+		pongsSent     atomic.Int64
+
+		lastActivity atomic.Int64
+		lastRead     atomic.Int64 // for idle timeout
+	}
+)
+
+// Stats returns connection counters.
+// It's safe to call concurrently with reads and writes.
+func (c *Conn) Stats() Stats {
+	s := &c.stats
+
+	r := Stats{
+		Client: c.IsClient(),
+
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+
+		FramesRead:    s.framesRead.Load(),
+		FramesWritten: s.framesWritten.Load(),
+
+		MessagesRead:    s.messagesRead.Load(),
+		MessagesWritten: s.messagesWritten.Load(),
+
+		PingsReceived: s.pingsReceived.Load(),
+		PingsSent:     s.pingsSent.Load(),
+		PongsReceived: s.pongsReceived.Load(),
+		PongsSent:     s.pongsSent.Load(),
+	}
+
+	if ts := s.lastActivity.Load(); ts != 0 {
+		r.LastActivity = time.Unix(0, ts)
+	}
+
+	return r
+}
+
+func (s *connStats) read(n int) {
+	if n == 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	s.bytesRead.Add(int64(n))
+	s.lastActivity.Store(now)
+	s.lastRead.Store(now)
+}
+
+func (s *connStats) written(n int) {
+	if n == 0 {
+		return
+	}
+
+	s.bytesWritten.Add(int64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *connStats) frame(op Opcode, fin bool, recv bool) {
+	frames, messages, pings, pongs := &s.framesWritten, &s.messagesWritten, &s.pingsSent, &s.pongsSent
+	if recv {
+		frames, messages, pings, pongs = &s.framesRead, &s.messagesRead, &s.pingsReceived, &s.pongsReceived
+	}
+
+	frames.Add(1)
+
+	switch {
+	case op == FramePing:
+		pings.Add(1)
+	case op == FramePong:
+		pongs.Add(1)
+	case fin && op < FrameClose:
+		messages.Add(1)
+	}
+}
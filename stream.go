@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"net"
+	"time"
+)
+
+type (
+	// netConn is the byte stream adapter returned by StreamConn.
+	// Conn is not embedded to hide its message methods from type assertions.
+	netConn struct {
+		c *Conn
+	}
+
+	// MessageConn is io.ReadWriteCloser over the Conn keeping data message opcodes,
+	// so text messages can be read and written as a stream, see Conn.MessageConn.
+	MessageConn struct {
+		c *Conn
+
+		op  Opcode // opcode of the message the last Read returned data from
+		wop Opcode // opcode Write sends messages with
+	}
+)
+
+// StreamConn returns net.Conn with byte stream semantics over the websocket connection,
+// so it can back net/rpc, TLS tunnels, and other protocols made for TCP.
+//
+// Read returns data messages payload as one continuous stream:
+// message and frame boundaries are lost, and empty frames are skipped.
+// Both text and binary messages are read, and compressed messages are decompressed.
+// io.EOF is returned after a normal close, a Status or *StatusText error after other closes.
+//
+// Each Write is sent as a single binary message, so the peer sees
+// the stream split at arbitrary points and must not rely on message boundaries either.
+//
+// Close closes the Conn. Read and Write follow the Conn locking rules,
+// so one reader and one writer can run concurrently.
+// The Conn must not be used directly while the stream is in use.
+func (c *Conn) StreamConn() net.Conn {
+	return netConn{c: c}
+}
+
+func (s netConn) Read(p []byte) (n int, err error) {
+	for n == 0 && err == nil && len(p) != 0 {
+		n, err = s.c.Read(p)
+	}
+
+	return n, err
+}
+
+func (s netConn) Write(p []byte) (int, error) {
+	return s.c.WriteFrame(p, FrameBinary, true)
+}
+
+func (s netConn) Close() error         { return s.c.Close() }
+func (s netConn) LocalAddr() net.Addr  { return s.c.LocalAddr() }
+func (s netConn) RemoteAddr() net.Addr { return s.c.RemoteAddr() }
+
+func (s netConn) SetDeadline(t time.Time) error      { return s.c.SetDeadline(t) }
+func (s netConn) SetReadDeadline(t time.Time) error  { return s.c.SetReadDeadline(t) }
+func (s netConn) SetWriteDeadline(t time.Time) error { return s.c.SetWriteDeadline(t) }
+
+// MessageConn returns io.ReadWriteCloser keeping track of data message opcodes.
+// Write sends each call as a single message with op opcode,
+// which must be FrameText or FrameBinary, UnexpectedOpcode is returned otherwise.
+// WriteText and WriteBinary select the opcode explicitly.
+//
+// Read returns data messages payload the same way as Conn.Read, see it for details.
+// A single Read never returns data of two messages,
+// and Opcode returns the opcode of the message the last Read returned data from.
+//
+// Close closes the Conn. The Conn must not be used directly while the MessageConn is in use.
+func (c *Conn) MessageConn(op Opcode) (*MessageConn, error) {
+	if op != FrameText && op != FrameBinary {
+		return nil, UnexpectedOpcode(op)
+	}
+
+	return &MessageConn{c: c, wop: op}, nil
+}
+
+func (m *MessageConn) Read(p []byte) (n int, err error) {
+	n, err = m.c.Read(p)
+	m.op = m.c.MessageOpcode()
+
+	return n, err
+}
+
+// Opcode returns the opcode of the message the last Read returned data from,
+// FrameText or FrameBinary. It's zero before the first message is started.
+func (m *MessageConn) Opcode() Opcode { return m.op }
+
+func (m *MessageConn) Write(p []byte) (int, error) {
+	return m.c.WriteFrame(p, m.wop, true)
+}
+
+// WriteText sends p as a single text message.
+func (m *MessageConn) WriteText(p []byte) (int, error) {
+	return m.c.WriteFrame(p, FrameText, true)
+}
+
+// WriteBinary sends p as a single binary message.
+func (m *MessageConn) WriteBinary(p []byte) (int, error) {
+	return m.c.WriteFrame(p, FrameBinary, true)
+}
+
+func (m *MessageConn) Close() error { return m.c.Close() }
@@ -7,6 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -19,6 +23,36 @@ type (
 		Status Status
 		Text   string
 	}
+
+	// AbnormalCloseError is returned by reads if the connection is lost
+	// in the middle of a frame or fails with a transport error.
+	// It unwraps to both StatusAbnormal and the underlying error,
+	// which is io.ErrUnexpectedEOF if the connection was closed mid-frame.
+	// IsCloseError doesn't report it as no close frame was received.
+	AbnormalCloseError struct {
+		Err error
+	}
+
+	// closedError is returned by message reads when the reading side is closed.
+	closedError struct {
+		err error
+		eof bool // the following read, it wraps io.EOF as Read returns it
+	}
+
+	// UnexpectedOpcode is returned when a message of the wrong type is received.
+	UnexpectedOpcode Opcode
+
+	// HandshakeError is returned by the client if the server response is not a valid upgrade.
+	// Err wraps one of ErrBadStatus, ErrUpgradeMismatch, ErrBadAccept,
+	// or a subprotocol or extension negotiation error.
+	HandshakeError struct {
+		Response *http.Response
+		Err      error
+	}
+
+	deadline struct {
+		ns atomic.Int64 // 0 means no deadline
+	}
 )
 
 const (
@@ -28,24 +62,25 @@ const (
 	StatusCantAccept
 	_
 
-	_
-	_
+	StatusNoStatus // must not be sent on the wire
+	StatusAbnormal // must not be sent on the wire
 	StatusFormat
 	StatusPolicy
 	StatusTooBig
 
 	StatusExtensions
 	StatusInternal
-	_
-	_
-	_
+	StatusRestart
+	StatusTryAgain
+	StatusBadGateway
 
-	_
+	StatusTLS // must not be sent on the wire
 )
 
 const (
 	// first byte.
 	finbit     = 0x80
+	rsvMask    = 0x70
 	opcodeMask = 0xf
 
 	// second byte.
@@ -90,11 +125,37 @@ func (op Opcode) String() string {
 }
 
 var (
-	//	ErrClosed       = errors.New("attempt to write to closed connection")
+	ErrWriteClosed  = errors.New("write after close frame sent")
+	ErrBadVersion   = errors.New("unsupported websocket version")
+	ErrForbidden    = errors.New("forbidden")
 	ErrNotHijacker  = errors.New("response is not hijacker")
 	ErrNotWebsocket = errors.New("not websocket")
 	ErrProtocol     = StatusProtocol
+	ErrTooBig       = StatusTooBig
 	ErrTrailingData = errors.New("trailing data in request")
+
+	ErrNoSubprotocol = errors.New("no common subprotocol")
+	ErrInvalidUTF8   = errors.New("invalid utf-8")
+	ErrInvalidStatus = errors.New("invalid close status")
+	ErrControlTooBig = errors.New("control frame payload is too big")
+
+	ErrCompressionParams = errors.New("unsupported permessage-deflate parameters")
+	ErrCompressionLevel  = errors.New("invalid compression level")
+
+	// ErrClosed is wrapped by ReadMessage and ReadJSON errors
+	// when the reading side is closed by the close frame received
+	// or sent by Conn on a protocol violation, see IsCloseError for the status.
+	// It's not wrapped if the connection just ended, even on a frame boundary.
+	ErrClosed = errors.New("connection closed")
+
+	// ErrReadInterrupted is wrapped by message reads following the one
+	// interrupted in the middle of the message, see ReadMessage.
+	// Compressed messages can't be resumed by any read, so Read wraps it too.
+	ErrReadInterrupted = errors.New("message read interrupted")
+
+	ErrBadStatus       = errors.New("didn't switch protocol")
+	ErrUpgradeMismatch = errors.New("upgrade mismatch")
+	ErrBadAccept       = errors.New("sec-accept mismatch")
 )
 
 func maskBuf(p []byte, key [4]byte, off int) {
@@ -126,6 +187,10 @@ func (f *HeaderBits) Parse(b []byte, st int) int {
 	return st + 2
 }
 
+// ParseLen parses the payload length starting at b[st].
+// i is -1 if b is too short.
+// l is -1 if the 64-bit length has the most significant bit set,
+// which is forbidden, or doesn't fit into int.
 func (f HeaderBits) ParseLen(b []byte, st int) (l, i int) {
 	l = f.len7()
 	i = st
@@ -140,25 +205,34 @@ func (f HeaderBits) ParseLen(b []byte, st int) (l, i int) {
 
 		l = int(binary.BigEndian.Uint16(b[i:]))
 		i += 2
-	case l == len64:
+	default:
 		if i+8 > len(b) {
 			return l, -1
 		}
 
 		x := binary.BigEndian.Uint64(b[i:])
-		l = int(x) //nolint:gosec
 		i += 8
 
-		if uint64(l) != x { //nolint:gosec
-			panic("too big frame")
+		if x > maxLen64 || uint64(int(x)) != x { //nolint:gosec
+			return -1, i
 		}
-	default:
-		panic(l)
+
+		l = int(x)
 	}
 
 	return l, i
 }
 
+// lenStatus returns the close status for the length ParseLen(b, st) rejected.
+// The most significant bit set violates the protocol, other lengths are just too big.
+func lenStatus(b []byte, st int) Status {
+	if b[st]&0x80 != 0 {
+		return StatusProtocol
+	}
+
+	return StatusTooBig
+}
+
 func (f HeaderBits) ReadMaskingKey(b []byte, st int, key []byte) (i int) {
 	if st+4 > len(b) {
 		return -1
@@ -171,6 +245,11 @@ func (f HeaderBits) Fin() bool {
 	return f[0]&finbit != 0
 }
 
+// RSV returns reserved bits of the first byte: 0x40 for RSV1, 0x20 for RSV2, 0x10 for RSV3.
+func (f HeaderBits) RSV() byte {
+	return f[0] & rsvMask
+}
+
 func (f HeaderBits) Opcode() Opcode {
 	return Opcode(f[0] & opcodeMask)
 }
@@ -187,11 +266,100 @@ func (f HeaderBits) len7() int {
 	return int(f[1] & len7Mask)
 }
 
+// Valid reports whether the status is allowed to be sent in a close frame.
+func (s Status) Valid() bool {
+	switch {
+	case s >= StatusOK && s <= StatusCantAccept:
+		return true
+	case s >= StatusFormat && s <= StatusBadGateway:
+		return true
+	case s >= 3000 && s < 5000:
+		return true
+	}
+
+	return false
+}
+
 func (s Status) OK() bool           { return s == StatusOK }
 func (s Status) Error() string      { return fmt.Sprintf("status:%d", int(s)) }
 func (s *StatusText) Error() string { return fmt.Sprintf("status:%d %v", int(s.Status), s.Text) }
 func (s *StatusText) Unwrap() error { return s.Status }
 
+// IsCloseError reports whether err means the connection was closed with a status
+// and returns the status and the reason.
+// It's the close frame received from the peer or the one sent by Conn on a protocol violation.
+// ErrClosed wrapped by message reads after a clean close is reported as StatusOK.
+// Bare io.EOF is not a close error as it may mean the connection just ended.
+// Neither is AbnormalCloseError as no close frame was exchanged,
+// errors.Is(err, StatusAbnormal) detects it.
+func IsCloseError(err error) (Status, string, bool) {
+	var abnormal *AbnormalCloseError
+	if errors.As(err, &abnormal) {
+		return 0, "", false
+	}
+
+	var st *StatusText
+	if errors.As(err, &st) {
+		return st.Status, st.Text, true
+	}
+
+	var s Status
+	if errors.As(err, &s) {
+		return s, "", true
+	}
+
+	if errors.Is(err, ErrClosed) {
+		return StatusOK, "", true
+	}
+
+	return 0, "", false
+}
+
+// CloseStatus returns the close status of err as IsCloseError does.
+// Status is unsigned, so it can't be -1 for errors which are not close errors,
+// zero is returned instead, which is never a valid status either.
+func CloseStatus(err error) Status {
+	s, _, _ := IsCloseError(err)
+
+	return s
+}
+
+func (e *AbnormalCloseError) Error() string   { return fmt.Sprintf("abnormal closure: %v", e.Err) }
+func (e *AbnormalCloseError) Unwrap() []error { return []error{StatusAbnormal, e.Err} }
+
+func (e *closedError) Error() string { return fmt.Sprintf("%v: %v", ErrClosed, e.err) }
+
+func (e *closedError) Unwrap() []error {
+	if e.eof {
+		return []error{ErrClosed, e.err, io.EOF}
+	}
+
+	return []error{ErrClosed, e.err}
+}
+
+func (op UnexpectedOpcode) Error() string { return fmt.Sprintf("unexpected opcode: %v", Opcode(op)) }
+
+func (e *HandshakeError) Error() string { return e.Err.Error() }
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+func (d *deadline) Store(t time.Time) {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+
+	d.ns.Store(ns)
+}
+
+func (d *deadline) Load() time.Time {
+	ns := d.ns.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ns)
+}
+
 func secKeyHash(key string) string {
 	const guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
@@ -207,6 +375,56 @@ func secKeyHash(key string) string {
 	return base64.StdEncoding.EncodeToString(sum[:])
 }
 
+// headerTokens returns comma separated values of all the header lines with the given name.
+func headerTokens(h http.Header, name string) (r []string) {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			t = strings.TrimSpace(t)
+			if t != "" {
+				r = append(r, t)
+			}
+		}
+	}
+
+	return r
+}
+
+// extensionName returns extension name without parameters.
+func extensionName(ext string) string {
+	name, _, _ := strings.Cut(ext, ";")
+
+	return strings.TrimSpace(name)
+}
+
+// headerHasToken reports whether the header comma separated list contains the token
+// compared case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerHasProtocol reports whether the Upgrade-like header comma separated list
+// contains the protocol compared case-insensitively.
+// Protocol version and parameters after / or ; are ignored.
+func headerHasProtocol(h http.Header, name, proto string) bool {
+	for _, t := range headerTokens(h, name) {
+		if i := strings.IndexAny(t, "/;"); i >= 0 {
+			t = strings.TrimSpace(t[:i])
+		}
+
+		if strings.EqualFold(t, proto) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func grow(b []byte, n int) []byte {
 	if n > cap(b) {
 		b = append(b, make([]byte, n-cap(b))...)
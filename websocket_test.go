@@ -1,6 +1,9 @@
 package websocket
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"testing"
 )
 
@@ -14,3 +17,60 @@ func TestSecKey(t *testing.T) {
 		t.Errorf("expected [%v], got [%v]", exp, sum)
 	}
 }
+
+func TestStatusValid(t *testing.T) {
+	for _, tc := range []struct {
+		s  Status
+		ok bool
+	}{
+		{0, false},
+		{999, false},
+		{StatusOK, true},
+		{StatusCantAccept, true},
+		{1004, false},
+		{StatusNoStatus, false},
+		{StatusAbnormal, false},
+		{StatusFormat, true},
+		{StatusBadGateway, true},
+		{StatusTLS, false},
+		{2999, false},
+		{3000, true},
+		{4999, true},
+		{5000, false},
+	} {
+		if tc.s.Valid() != tc.ok {
+			t.Errorf("status %d: expected valid %v", tc.s, tc.ok)
+		}
+	}
+}
+
+func TestIsCloseError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status Status
+		text   string
+		ok     bool
+	}{
+		{nil, 0, "", false},
+		{errors.New("other"), 0, "", false},
+		{io.EOF, 0, "", false},
+		{&closedError{err: io.EOF}, StatusOK, "", true},
+		{fmt.Errorf("read: %w", &closedError{err: io.EOF, eof: true}), StatusOK, "", true},
+		{&closedError{err: StatusGoingAway, eof: true}, StatusGoingAway, "", true},
+		{StatusGoingAway, StatusGoingAway, "", true},
+		{&StatusText{Status: 4000, Text: "reason"}, 4000, "reason", true},
+		{fmt.Errorf("read: %w", &StatusText{Status: StatusPolicy, Text: "bye"}), StatusPolicy, "bye", true},
+		{fmt.Errorf("wrapped: %w", ErrProtocol), StatusProtocol, "", true},
+		{&AbnormalCloseError{Err: io.ErrUnexpectedEOF}, 0, "", false},
+		{fmt.Errorf("read: %w", &AbnormalCloseError{Err: io.ErrUnexpectedEOF}), 0, "", false},
+	} {
+		s, text, ok := IsCloseError(tc.err)
+		if s != tc.status || text != tc.text || ok != tc.ok {
+			t.Errorf("%v: got %v %q %v, expected %v %q %v", tc.err, s, text, ok, tc.status, tc.text, tc.ok)
+		}
+
+		if s := CloseStatus(tc.err); s != tc.status {
+			t.Errorf("%v: close status %v, expected %v", tc.err, s, tc.status)
+		}
+	}
+}